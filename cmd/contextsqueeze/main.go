@@ -3,13 +3,13 @@ package main
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -19,12 +19,14 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"contextsqueezer/internal/ingest"
 	"contextsqueezer/internal/pipeline"
 	"contextsqueezer/internal/version"
 	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/contextsqueeze"
+	"contextsqueezer/pkg/format"
+	"contextsqueezer/pkg/tokenizer"
 )
 
 const (
@@ -36,31 +38,6 @@ const (
 	exitInternal = 6
 )
 
-type buildInfo struct {
-	GOOS   string `json:"goos"`
-	GOARCH string `json:"goarch"`
-	CGO    string `json:"cgo"`
-}
-
-type jsonResult struct {
-	SchemaVersion   int       `json:"schema_version"`
-	EngineVersion   string    `json:"engine_version"`
-	Build           buildInfo `json:"build"`
-	BytesIn         int       `json:"bytes_in"`
-	BytesOut        int       `json:"bytes_out"`
-	TokensInApprox  int       `json:"tokens_in_approx"`
-	TokensOutApprox int       `json:"tokens_out_approx"`
-	ReductionPct    float64   `json:"reduction_pct"`
-	Aggressiveness  int       `json:"aggressiveness"`
-	Profile         string    `json:"profile"`
-	BudgetApplied   bool      `json:"budget_applied"`
-	Truncated       bool      `json:"truncated"`
-	SourceType      string    `json:"source_type"`
-	Warnings        []string  `json:"warnings"`
-	Text            string    `json:"text,omitempty"`
-	TextB64         string    `json:"text_b64,omitempty"`
-}
-
 type benchRun struct {
 	Run       int    `json:"run"`
 	Duration  int64  `json:"duration_ms"`
@@ -70,28 +47,65 @@ type benchRun struct {
 }
 
 type benchCase struct {
-	File        string     `json:"file"`
-	Aggressives []int      `json:"aggressives"`
-	Runs        []benchRun `json:"runs"`
-	MinMS       int64      `json:"min_ms"`
-	MedianMS    int64      `json:"median_ms"`
-	P95MS       int64      `json:"p95_ms"`
-	Determinism bool       `json:"deterministic"`
+	File           string     `json:"file"`
+	Engine         string     `json:"engine"`
+	Aggressives    []int      `json:"aggressives"`
+	Runs           []benchRun `json:"runs"`
+	MinMS          int64      `json:"min_ms"`
+	MedianMS       int64      `json:"median_ms"`
+	P95MS          int64      `json:"p95_ms"`
+	ThroughputMBps float64    `json:"throughput_mb_per_s"`
+	Determinism    bool       `json:"deterministic"`
+	// Workers lists the worker counts whose output was checked; the runs use the first.
+	Workers []int `json:"workers"`
+}
+
+// benchComparison sets an engine against the first one benchmarked on the same file and level.
+type benchComparison struct {
+	File           string  `json:"file"`
+	Aggr           int     `json:"aggr"`
+	Baseline       string  `json:"baseline"`
+	Engine         string  `json:"engine"`
+	BaselineMBps   float64 `json:"baseline_mb_per_s"`
+	ThroughputMBps float64 `json:"throughput_mb_per_s"`
+	Identical      bool    `json:"identical_output"`
 }
 
 type benchJSON struct {
-	SchemaVersion string      `json:"schema_version"`
-	Suite         string      `json:"suite"`
-	Runs          int         `json:"runs"`
-	Warmup        int         `json:"warmup"`
-	Cases         []benchCase `json:"cases"`
+	SchemaVersion string            `json:"schema_version"`
+	Suite         string            `json:"suite"`
+	Runs          int               `json:"runs"`
+	Warmup        int               `json:"warmup"`
+	Cases         []benchCase       `json:"cases"`
+	Comparisons   []benchComparison `json:"comparisons,omitempty"`
 }
 
-func cgoEnabled() string {
-	if strings.Contains(runtime.Version(), "cgo") {
-		return "enabled"
-	}
-	return "unknown"
+// tokenPlan says what it takes to fit a --max-tokens budget. Aggressiveness is omitted when
+// even 9 keeps too much; TargetRatio still fits.
+type tokenPlan struct {
+	NeedsSqueeze   bool    `json:"needs_squeeze"`
+	TargetRatio    float64 `json:"target_ratio,omitempty"`
+	Aggressiveness *int    `json:"aggressiveness,omitempty"`
+}
+
+type tokenCount struct {
+	Tokenizer string     `json:"tokenizer"`
+	Tokens    int        `json:"tokens"`
+	Plan      *tokenPlan `json:"plan,omitempty"`
+}
+
+type tokenFile struct {
+	File       string       `json:"file"`
+	SourceType string       `json:"source_type"`
+	Bytes      int          `json:"bytes"`
+	Counts     []tokenCount `json:"counts"`
+}
+
+type tokensJSON struct {
+	SchemaVersion string      `json:"schema_version"`
+	MaxTokens     int         `json:"max_tokens,omitempty"`
+	Files         []tokenFile `json:"files"`
+	Total         tokenFile   `json:"total"`
 }
 
 func printErr(stderr io.Writer, code int, msg string, err error) int {
@@ -113,6 +127,10 @@ func classifyErr(err error) int {
 	if errors.Is(err, context.DeadlineExceeded) {
 		return exitTimeout
 	}
+	var inputErr *ingest.InputError
+	if errors.As(err, &inputErr) {
+		return exitInput
+	}
 	s := strings.ToLower(err.Error())
 	if strings.Contains(s, "unsupported binary") || strings.Contains(s, "input") || strings.Contains(s, "max bytes") {
 		return exitInput
@@ -123,6 +141,10 @@ func classifyErr(err error) int {
 	return exitInternal
 }
 
+func sourceChoices() string {
+	return "auto|" + strings.Join(format.Names(), "|")
+}
+
 func writeOutput(path string, data []byte, stdout io.Writer) error {
 	if path == "" {
 		_, err := stdout.Write(data)
@@ -131,16 +153,87 @@ func writeOutput(path string, data []byte, stdout io.Writer) error {
 	return os.WriteFile(path, data, 0o644)
 }
 
-func parseInputArg(fs *flag.FlagSet, inputFlag string) (string, error) {
+// stdinPiped reports whether stdin carries data rather than an interactive terminal.
+func stdinPiped(stdin io.Reader) bool {
+	if stdin == nil {
+		return false
+	}
+	f, ok := stdin.(*os.File)
+	if !ok {
+		return true
+	}
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice == 0
+}
+
+// parseInputArg resolves the input path; "-" means stdin, which is also the default when no
+// path is given and stdin is piped.
+func parseInputArg(fs *flag.FlagSet, inputFlag string, stdin io.Reader) (string, error) {
 	if inputFlag != "" {
 		return inputFlag, nil
 	}
 	if fs.NArg() == 1 {
 		return fs.Arg(0), nil
 	}
+	if fs.NArg() == 0 && stdinPiped(stdin) {
+		return "-", nil
+	}
 	return "", errors.New("input file required")
 }
 
+// parseEngines resolves a comma-separated engine list; "both" means native then go.
+func parseEngines(s string) ([]api.Engine, error) {
+	if s == "both" {
+		s = "native,go"
+	}
+	engines := make([]api.Engine, 0, 2)
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		e, err := api.EngineByName(name)
+		if err != nil {
+			return nil, err
+		}
+		engines = append(engines, e)
+	}
+	return engines, nil
+}
+
+// parseWorkers reads a comma-separated list of worker counts, where 0 means all CPUs.
+func parseWorkers(s string) ([]int, error) {
+	out := make([]int, 0, 2)
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("worker count must not be negative, got %d", n)
+		}
+		if n == 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		if !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func joinInts(ns []int) string {
+	parts := make([]string, len(ns))
+	for i, n := range ns {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
 func parseAggrRange(s string) ([]int, error) {
 	if s == "" || s == "0..9" {
 		arr := make([]int, 10)
@@ -187,18 +280,82 @@ func parseAggrRange(s string) ([]int, error) {
 	return []int{v}, nil
 }
 
-func runSqueeze(args []string, stdout io.Writer, stderr io.Writer, statsMode bool) int {
+func printStats(stderr io.Writer, res pipeline.Result, det ingest.Detection, engine string, verbose, quiet bool) {
+	_, _ = fmt.Fprintf(stderr, "source: %s (confidence %.2f, %s)\n", res.SourceType, det.Confidence, det.Reason)
+	_, _ = fmt.Fprintf(stderr, "engine: %s\n", engine)
+	_, _ = fmt.Fprintf(stderr, "bytes in/out: %d/%d\n", res.BytesIn, res.BytesOut)
+	counted := "approx"
+	if res.Tokenizer != "" {
+		counted = res.Tokenizer
+	}
+	_, _ = fmt.Fprintf(stderr, "tokens in/out (%s): %d/%d\n", counted, res.TokensInApprox, res.TokensOutApprox)
+	_, _ = fmt.Fprintf(stderr, "reduction: %.2f%%\n", res.ReductionPct)
+	_, _ = fmt.Fprintf(stderr, "aggressiveness: %d\n", res.Aggressiveness)
+	_, _ = fmt.Fprintf(stderr, "budget applied: %v\n", res.BudgetApplied)
+	_, _ = fmt.Fprintf(stderr, "truncated: %v\n", res.Truncated)
+	for _, t := range res.Targets {
+		_, _ = fmt.Fprintf(stderr, "target %s: %g achieved %g\n", t.Name, t.Target, math.Round(t.Achieved*1e4)/1e4)
+	}
+	if verbose {
+		_, _ = fmt.Fprintf(stderr, "stage ms ingest/segment/tokenize/filter/sim/prune/assembly/registry/budget: %d/%d/%d/%d/%d/%d/%d/%d/%d\n",
+			res.Metrics.IngestMS, res.Metrics.SegmentationMS, res.Metrics.TokenizationMS, res.Metrics.CandidateFilterMS,
+			res.Metrics.SimilarityMS, res.Metrics.PruneMS, res.Metrics.AssemblyMS, res.Metrics.CrossChunkRegistryMS, res.Metrics.BudgetLoopMS)
+	}
+	_, _ = fmt.Fprintf(stderr, "counters tokens/sentences/candidates/pairs: %d/%d/%d/%d\n",
+		res.Metrics.TokensParsed, res.Metrics.SentencesTotal, res.Metrics.SimilarityCandidates, res.Metrics.SimilarityPairs)
+	if !quiet && len(res.Warnings) > 0 {
+		_, _ = fmt.Fprintf(stderr, "warnings: %s\n", strings.Join(res.Warnings, "; "))
+	}
+}
+
+// streamSqueeze squeezes a local text file or stdin with pipeline.RunStream, writing to out.
+func streamSqueeze(ctx context.Context, path string, stdin io.Reader, out io.Writer, opt api.Options, opts ingest.Options, cfg pipeline.RunConfig) (pipeline.Result, error) {
+	r := stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return pipeline.Result{}, err
+		}
+		defer f.Close()
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			cfg.StreamSize = st.Size()
+		}
+		r = f
+	}
+	cfg.Prepare = func(b []byte) ([]byte, []string) { return ingest.PrepareText(b, opts) }
+	return pipeline.RunStream(ctx, r, out, opt, cfg)
+}
+
+func runSqueeze(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, statsMode bool) int {
 	fs := flag.NewFlagSet("contextsqueeze", flag.ContinueOnError)
 	fs.SetOutput(stderr)
 	showVersion := fs.Bool("version", false, "print version")
-	inPath := fs.String("input", "", "input file")
+	inPath := fs.String("input", "", "input file or http(s) url")
 	outPath := fs.String("out", "", "output file path")
 	aggr := fs.Int("aggr", -1, "aggressiveness 0..9")
 	profile := fs.String("profile", "", "profile local|api")
 	maxTokens := fs.Int("max-tokens", 0, "approx token budget")
+	targetRatio := fs.Float64("target-ratio", 0, "keep about this fraction (0..1) of the input's approx tokens")
+	maxBytes := fs.Int("max-bytes", 0, "output size cap in bytes")
+	maxWords := fs.Int("max-words", 0, "output size cap in words")
+	tokenizerSpec := fs.String("tokenizer", "approx", "token counting: approx or the path of a tiktoken-format BPE vocabulary")
+	query := fs.String("query", "", "favour sentences relevant to this query and their neighbours")
 	maxMemMB := fs.Int("max-memory-mb", 1024, "soft memory ceiling in MB")
 	asJSON := fs.Bool("json", false, "emit json")
-	source := fs.String("source", "auto", "source override: auto|pdf|docx|html|text")
+	source := fs.String("source", "auto", "source override: "+sourceChoices())
+	encoding := fs.String("encoding", "auto", "text encoding: auto|utf-8|utf-16le|utf-16be|windows-1252|iso-8859-1")
+	noNormalize := fs.Bool("no-normalize", false, "skip unicode normalization and invisible-character scrubbing")
+	noHeadings := fs.Bool("no-infer-headings", false, "do not turn underlined, numbered or all-caps lines of plain text into headings")
+	fetchTimeout := fs.Duration("fetch-timeout", 30*time.Second, "timeout for http(s) inputs")
+	fetchMaxBytes := fs.Int64("fetch-max-bytes", 0, "size cap for http(s) inputs (default CSQ_MAX_BYTES)")
+	userAgent := fs.String("user-agent", "contextsqueeze/"+version.Current(), "user agent for http(s) inputs")
+	maxRedirects := fs.Int("max-redirects", 5, "redirect limit for http(s) inputs")
+	provenance := fs.Bool("provenance", false, "include source locations of kept spans in json output")
+	metadataHeader := fs.Bool("metadata-header", false, "prepend a one-line document metadata header to the output")
+	engineName := fs.String("engine", api.DefaultEngine().Name(), "compression engine: native|go")
+	workers := fs.Int("workers", 0, "chunks compressed in parallel (0 means all CPUs)")
+	timeout := fs.Duration("timeout", 0, "time limit for squeezing after ingest (0 means none)")
+	stream := fs.Bool("stream", false, "squeeze text incrementally with memory bounded by the chunk size")
 	quiet := fs.Bool("quiet", false, "suppress warnings")
 	verbose := fs.Bool("verbose", false, "print stage timing")
 	if err := fs.Parse(args); err != nil {
@@ -208,26 +365,95 @@ func runSqueeze(args []string, stdout io.Writer, stderr io.Writer, statsMode boo
 		_, _ = fmt.Fprintln(stdout, version.Current())
 		return exitSuccess
 	}
-	path, err := parseInputArg(fs, *inPath)
+	engine, err := api.EngineByName(*engineName)
 	if err != nil {
-		return printErr(stderr, exitUsage, "usage: contextsqueeze [file] [--input file] [--max-tokens N] [--json] [--out path] [--source auto|pdf|docx|html|text]", err)
+		return printErr(stderr, exitUsage, "invalid --engine", err)
+	}
+	path, err := parseInputArg(fs, *inPath, stdin)
+	if err != nil {
+		return printErr(stderr, exitUsage, "usage: contextsqueeze [file|-] [--input file|url] [--max-tokens N] [--json] [--out path] [--source "+sourceChoices()+"] [--encoding auto|utf-8|...]", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// The --timeout clock starts once the input is ready to squeeze.
+	squeezeContext := func() (context.Context, context.CancelFunc) {
+		if *timeout > 0 {
+			return context.WithTimeout(context.Background(), *timeout)
+		}
+		return context.WithCancel(context.Background())
+	}
+	opt := api.Options{Aggressiveness: *aggr, MaxTokens: *maxTokens, Profile: *profile, TargetRatio: *targetRatio, MaxBytes: *maxBytes, MaxWords: *maxWords, Query: *query}
+	if _, err := opt.Limit(nil); err != nil {
+		return printErr(stderr, exitUsage, "invalid size limit", err)
+	}
+	if *query != "" && len(api.QueryTerms(*query)) == 0 {
+		return printErr(stderr, exitUsage, "invalid --query", fmt.Errorf("%q has no terms to match; use words other than stopwords", *query))
+	}
+	if *tokenizerSpec != "approx" {
+		if opt.Tokenizer, err = tokenizer.Open(*tokenizerSpec); err != nil {
+			return printErr(stderr, exitUsage, "invalid --tokenizer", err)
+		}
+	}
+	opts := ingest.Options{Source: *source, Encoding: *encoding, NoNormalize: *noNormalize, NoHeadings: *noHeadings}
+
+	if *stream {
+		if *asJSON || *provenance || *metadataHeader || ingest.IsURL(path) || (*source != "auto" && *source != "text") || (*encoding != "auto" && *encoding != "utf-8") {
+			return printErr(stderr, exitUsage, "invalid --stream", errors.New("streaming reads utf-8 text from a file or stdin and cannot be combined with --json, --provenance or --metadata-header"))
+		}
+		var out io.Writer = stdout
+		if statsMode {
+			out = io.Discard
+		} else if *outPath != "" {
+			f, err := os.Create(*outPath)
+			if err != nil {
+				return printErr(stderr, exitInternal, "write output", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		squeezeCtx, cancelSqueeze := squeezeContext()
+		defer cancelSqueeze()
+		res, err := streamSqueeze(squeezeCtx, path, stdin, out, opt, opts, pipeline.RunConfig{MaxMemoryMB: *maxMemMB, Engine: engine, Workers: *workers})
+		if err != nil {
+			return printErr(stderr, classifyErr(err), "squeeze error", err)
+		}
+		if statsMode {
+			printStats(stderr, res, ingest.Detection{Confidence: 1, Reason: "streamed as text"}, engine.Name(), *verbose, *quiet)
+		} else if !*quiet && len(res.Warnings) > 0 {
+			_, _ = fmt.Fprintf(stderr, "warnings: %s\n", strings.Join(res.Warnings, "; "))
+		}
+		return exitSuccess
+	}
+
+	ingestTimeout := 5 * time.Second
+	if ingest.IsURL(path) {
+		ingestTimeout += *fetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ingestTimeout)
 	defer cancel()
 	ingStart := time.Now()
-	ing, err := ingest.Run(ctx, path, *source)
+	var ing ingest.Result
+	switch {
+	case path == "-":
+		ing, err = ingest.RunReader(ctx, "", stdin, opts)
+	case ingest.IsURL(path):
+		ing, err = ingest.RunURL(ctx, path, opts, ingest.FetchOptions{Timeout: *fetchTimeout, MaxBytes: *fetchMaxBytes, UserAgent: *userAgent, MaxRedirects: *maxRedirects})
+	default:
+		ing, err = ingest.RunWithOptions(ctx, path, opts)
+	}
 	ingestMS := time.Since(ingStart).Milliseconds()
 	if err != nil {
 		return printErr(stderr, classifyErr(err), "ingest error", err)
 	}
 
+	squeezeCtx, cancelSqueeze := squeezeContext()
+	defer cancelSqueeze()
 	res, err := pipeline.RunResultWithConfig(
+		squeezeCtx,
 		ing.Text,
-		api.Options{Aggressiveness: *aggr, MaxTokens: *maxTokens, Profile: *profile},
+		opt,
 		ing.SourceType,
 		ing.Warnings,
-		pipeline.RunConfig{MaxMemoryMB: *maxMemMB},
+		pipeline.RunConfig{MaxMemoryMB: *maxMemMB, Provenance: *provenance && *asJSON, SourceMap: ing.SourceMap, Metadata: ing.Metadata, MetadataHeader: *metadataHeader, Engine: engine, Workers: *workers},
 	)
 	if err != nil {
 		return printErr(stderr, classifyErr(err), "squeeze error", err)
@@ -235,37 +461,12 @@ func runSqueeze(args []string, stdout io.Writer, stderr io.Writer, statsMode boo
 	res.Metrics.IngestMS = ingestMS
 
 	if statsMode {
-		_, _ = fmt.Fprintf(stderr, "source: %s\n", res.SourceType)
-		_, _ = fmt.Fprintf(stderr, "bytes in/out: %d/%d\n", res.BytesIn, res.BytesOut)
-		_, _ = fmt.Fprintf(stderr, "tokens in/out (approx): %d/%d\n", res.TokensInApprox, res.TokensOutApprox)
-		_, _ = fmt.Fprintf(stderr, "reduction: %.2f%%\n", res.ReductionPct)
-		_, _ = fmt.Fprintf(stderr, "aggressiveness: %d\n", res.Aggressiveness)
-		_, _ = fmt.Fprintf(stderr, "budget applied: %v\n", res.BudgetApplied)
-		_, _ = fmt.Fprintf(stderr, "truncated: %v\n", res.Truncated)
-		if *verbose {
-			_, _ = fmt.Fprintf(stderr, "stage ms ingest/segment/tokenize/filter/sim/prune/assembly/registry/budget: %d/%d/%d/%d/%d/%d/%d/%d/%d\n",
-				res.Metrics.IngestMS, res.Metrics.SegmentationMS, res.Metrics.TokenizationMS, res.Metrics.CandidateFilterMS,
-				res.Metrics.SimilarityMS, res.Metrics.PruneMS, res.Metrics.AssemblyMS, res.Metrics.CrossChunkRegistryMS, res.Metrics.BudgetLoopMS)
-		}
-		_, _ = fmt.Fprintf(stderr, "counters tokens/sentences/candidates/pairs: %d/%d/%d/%d\n",
-			res.Metrics.TokensParsed, res.Metrics.SentencesTotal, res.Metrics.SimilarityCandidates, res.Metrics.SimilarityPairs)
-		if !*quiet && len(res.Warnings) > 0 {
-			_, _ = fmt.Fprintf(stderr, "warnings: %s\n", strings.Join(res.Warnings, "; "))
-		}
+		printStats(stderr, res, ing.Detection, engine.Name(), *verbose, *quiet)
 		return exitSuccess
 	}
 
 	if *asJSON {
-		jr := jsonResult{SchemaVersion: 1, EngineVersion: version.Current(), Build: buildInfo{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, CGO: cgoEnabled()},
-			BytesIn: res.BytesIn, BytesOut: res.BytesOut, TokensInApprox: res.TokensInApprox, TokensOutApprox: res.TokensOutApprox,
-			ReductionPct: res.ReductionPct, Aggressiveness: res.Aggressiveness, Profile: res.Profile, BudgetApplied: res.BudgetApplied,
-			Truncated: res.Truncated, SourceType: res.SourceType, Warnings: res.Warnings}
-		if utf8.Valid(res.Text) {
-			jr.Text = string(res.Text)
-		} else {
-			jr.TextB64 = base64.StdEncoding.EncodeToString(res.Text)
-		}
-		buf, err := json.MarshalIndent(jr, "", "  ")
+		buf, err := json.MarshalIndent(contextsqueeze.NewResult(ing, res, engine.Name()), "", "  ")
 		if err != nil {
 			return printErr(stderr, exitInternal, "json error", err)
 		}
@@ -303,7 +504,7 @@ func runProfile(args []string, stdout io.Writer, stderr io.Writer) int {
 	if err := fs.Parse(args); err != nil {
 		return exitUsage
 	}
-	path, err := parseInputArg(fs, *inPath)
+	path, err := parseInputArg(fs, *inPath, nil)
 	if err != nil {
 		return printErr(stderr, exitUsage, "usage: contextsqueeze profile <file> --cpu out/cpu.pprof --heap out/heap.pprof --seconds 10", err)
 	}
@@ -332,7 +533,7 @@ func runProfile(args []string, stdout io.Writer, stderr io.Writer) int {
 	var last pipeline.Result
 	loops := 0
 	for time.Now().Before(deadline) {
-		res, err := pipeline.RunResultWithConfig(ing.Text, api.Options{Aggressiveness: *aggr}, ing.SourceType, ing.Warnings, pipeline.RunConfig{MaxMemoryMB: *maxMemMB})
+		res, err := pipeline.RunResultWithConfig(context.Background(), ing.Text, api.Options{Aggressiveness: *aggr}, ing.SourceType, ing.Warnings, pipeline.RunConfig{MaxMemoryMB: *maxMemMB})
 		if err != nil {
 			if cpuFile != nil {
 				pprof.StopCPUProfile()
@@ -443,9 +644,19 @@ func runBench(args []string, stdout io.Writer, stderr io.Writer) int {
 	maxMemMB := fs.Int("max-memory-mb", 1024, "soft memory ceiling in MB")
 	source := fs.String("source", "auto", "source override")
 	profile := fs.String("profile", "", "profile")
+	engineList := fs.String("engine", api.DefaultEngine().Name(), "engines to compare: native, go, native,go or both")
+	workerList := fs.String("workers", "0,1", "worker counts that must give identical output; runs are timed with the first (0 means all CPUs)")
 	if err := fs.Parse(args); err != nil {
 		return exitUsage
 	}
+	workerCounts, err := parseWorkers(*workerList)
+	if err != nil {
+		return printErr(stderr, exitUsage, "invalid --workers", err)
+	}
+	engines, err := parseEngines(*engineList)
+	if err != nil {
+		return printErr(stderr, exitUsage, "invalid --engine", err)
+	}
 	aggrs, err := parseAggrRange(*aggrRange)
 	if err != nil {
 		return printErr(stderr, exitUsage, "invalid --aggr", err)
@@ -456,6 +667,7 @@ func runBench(args []string, stdout io.Writer, stderr io.Writer) int {
 	}
 
 	cases := make([]benchCase, 0)
+	comparisons := make([]benchComparison, 0)
 	for _, file := range files {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		ing, err := ingest.Run(ctx, file, *source)
@@ -465,76 +677,290 @@ func runBench(args []string, stdout io.Writer, stderr io.Writer) int {
 		}
 
 		for _, a := range aggrs {
-			for i := 0; i < *warmup; i++ {
-				_, _ = pipeline.RunResultWithConfig(ing.Text, api.Options{Aggressiveness: a, MaxTokens: *maxTokens, Profile: *profile}, ing.SourceType, ing.Warnings, pipeline.RunConfig{MaxMemoryMB: *maxMemMB})
-			}
-			runsOut := make([]benchRun, 0, *runs)
-			var baseline string
-			deterministic := true
-			for i := 0; i < *runs; i++ {
-				t0 := time.Now()
-				res, err := pipeline.RunResultWithConfig(ing.Text, api.Options{Aggressiveness: a, MaxTokens: *maxTokens, Profile: *profile}, ing.SourceType, ing.Warnings, pipeline.RunConfig{MaxMemoryMB: *maxMemMB})
-				if err != nil {
-					return printErr(stderr, classifyErr(err), fmt.Sprintf("bench run error %s aggr=%d", file, a), err)
+			first := len(cases)
+			for _, engine := range engines {
+				cfg := pipeline.RunConfig{MaxMemoryMB: *maxMemMB, Engine: engine, Workers: workerCounts[0]}
+				opt := api.Options{Aggressiveness: a, MaxTokens: *maxTokens, Profile: *profile}
+				for i := 0; i < *warmup; i++ {
+					_, _ = pipeline.RunResultWithConfig(context.Background(), ing.Text, opt, ing.SourceType, ing.Warnings, cfg)
 				}
-				dur := time.Since(t0).Milliseconds()
-				hash := sha256.Sum256(res.Text)
-				digest := hex.EncodeToString(hash[:])
-				if i == 0 {
-					baseline = digest
-				} else if digest != baseline {
-					deterministic = false
+				runsOut := make([]benchRun, 0, *runs)
+				var baseline string
+				var total time.Duration
+				deterministic := true
+				for i := 0; i < *runs; i++ {
+					t0 := time.Now()
+					res, err := pipeline.RunResultWithConfig(context.Background(), ing.Text, opt, ing.SourceType, ing.Warnings, cfg)
+					if err != nil {
+						return printErr(stderr, classifyErr(err), fmt.Sprintf("bench run error %s aggr=%d engine=%s", file, a, engine.Name()), err)
+					}
+					elapsed := time.Since(t0)
+					total += elapsed
+					hash := sha256.Sum256(res.Text)
+					digest := hex.EncodeToString(hash[:])
+					if i == 0 {
+						baseline = digest
+					} else if digest != baseline {
+						deterministic = false
+					}
+					runsOut = append(runsOut, benchRun{Run: i + 1, Duration: elapsed.Milliseconds(), Hash: digest, BytesOut: res.BytesOut, TokensOut: res.TokensOutApprox})
 				}
-				runsOut = append(runsOut, benchRun{Run: i + 1, Duration: dur, Hash: digest, BytesOut: res.BytesOut, TokensOut: res.TokensOutApprox})
-			}
-			if !deterministic {
-				return printErr(stderr, exitInternal, fmt.Sprintf("determinism failed for %s aggr=%d", file, a), nil)
+				for _, w := range workerCounts[1:] {
+					wcfg := cfg
+					wcfg.Workers = w
+					res, err := pipeline.RunResultWithConfig(context.Background(), ing.Text, opt, ing.SourceType, ing.Warnings, wcfg)
+					if err != nil {
+						return printErr(stderr, classifyErr(err), fmt.Sprintf("bench run error %s aggr=%d engine=%s workers=%d", file, a, engine.Name(), w), err)
+					}
+					if hash := sha256.Sum256(res.Text); hex.EncodeToString(hash[:]) != baseline {
+						deterministic = false
+					}
+				}
+				if !deterministic {
+					return printErr(stderr, exitInternal, fmt.Sprintf("determinism failed for %s aggr=%d engine=%s", file, a, engine.Name()), nil)
+				}
+				durs := make([]int64, 0, len(runsOut))
+				for _, r := range runsOut {
+					durs = append(durs, r.Duration)
+				}
+				sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+				mbps := 0.0
+				if total > 0 {
+					mbps = float64(len(ing.Text)) * float64(len(runsOut)) / total.Seconds() / (1024 * 1024)
+				}
+				cases = append(cases, benchCase{File: file, Engine: engine.Name(), Aggressives: []int{a}, Runs: runsOut, MinMS: durs[0], MedianMS: quantile(durs, 0.5), P95MS: quantile(durs, 0.95), ThroughputMBps: mbps, Determinism: true, Workers: workerCounts})
 			}
-			durs := make([]int64, 0, len(runsOut))
-			for _, r := range runsOut {
-				durs = append(durs, r.Duration)
+			base := cases[first]
+			for _, c := range cases[first+1:] {
+				comparisons = append(comparisons, benchComparison{File: file, Aggr: a, Baseline: base.Engine, Engine: c.Engine,
+					BaselineMBps: base.ThroughputMBps, ThroughputMBps: c.ThroughputMBps, Identical: c.Runs[0].Hash == base.Runs[0].Hash})
 			}
-			sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
-			cases = append(cases, benchCase{File: file, Aggressives: []int{a}, Runs: runsOut, MinMS: durs[0], MedianMS: quantile(durs, 0.5), P95MS: quantile(durs, 0.95), Determinism: true})
 		}
 	}
 
+	mismatch := false
+	for _, c := range comparisons {
+		if !c.Identical {
+			mismatch = true
+		}
+	}
 	if *jsonOut {
-		obj := benchJSON{SchemaVersion: "1", Suite: *suite, Runs: *runs, Warmup: *warmup, Cases: cases}
+		obj := benchJSON{SchemaVersion: "1", Suite: *suite, Runs: *runs, Warmup: *warmup, Cases: cases, Comparisons: comparisons}
 		buf, _ := json.MarshalIndent(obj, "", "  ")
 		buf = append(buf, '\n')
 		_, _ = stdout.Write(buf)
+		if mismatch {
+			return printErr(stderr, exitInternal, "engine outputs differ", nil)
+		}
 		return exitSuccess
 	}
 
-	_, _ = fmt.Fprintln(stderr, "| file | aggr | run | ms | bytes out | tokens out | sha256 |")
-	_, _ = fmt.Fprintln(stderr, "|---|---:|---:|---:|---:|---:|---|")
+	_, _ = fmt.Fprintln(stderr, "| file | aggr | run | ms | bytes out | tokens out | sha256 | engine |")
+	_, _ = fmt.Fprintln(stderr, "|---|---:|---:|---:|---:|---:|---|---|")
 	for _, c := range cases {
 		a := c.Aggressives[0]
 		for _, r := range c.Runs {
-			_, _ = fmt.Fprintf(stderr, "| %s | %d | %d | %d | %d | %d | %s |\n", c.File, a, r.Run, r.Duration, r.BytesOut, r.TokensOut, r.Hash)
+			_, _ = fmt.Fprintf(stderr, "| %s | %d | %d | %d | %d | %d | %s | %s |\n", c.File, a, r.Run, r.Duration, r.BytesOut, r.TokensOut, r.Hash, c.Engine)
 		}
 	}
-	_, _ = fmt.Fprintln(stderr, "\n| file | aggr | min ms | median ms | p95 ms | deterministic |")
-	_, _ = fmt.Fprintln(stderr, "|---|---:|---:|---:|---:|:---:|")
+	_, _ = fmt.Fprintln(stderr, "\n| file | aggr | min ms | median ms | p95 ms | deterministic | MB/s | engine | workers |")
+	_, _ = fmt.Fprintln(stderr, "|---|---:|---:|---:|---:|:---:|---:|---|---|")
 	for _, c := range cases {
-		_, _ = fmt.Fprintf(stderr, "| %s | %d | %d | %d | %d | %v |\n", c.File, c.Aggressives[0], c.MinMS, c.MedianMS, c.P95MS, c.Determinism)
+		_, _ = fmt.Fprintf(stderr, "| %s | %d | %d | %d | %d | %v | %.2f | %s | %s |\n", c.File, c.Aggressives[0], c.MinMS, c.MedianMS, c.P95MS, c.Determinism, c.ThroughputMBps, c.Engine, joinInts(c.Workers))
+	}
+	if len(comparisons) > 0 {
+		_, _ = fmt.Fprintln(stderr, "\n| file | aggr | engines | MB/s | speedup | identical output |")
+		_, _ = fmt.Fprintln(stderr, "|---|---:|---|---:|---:|:---:|")
+		for _, c := range comparisons {
+			speedup := 0.0
+			if c.BaselineMBps > 0 {
+				speedup = c.ThroughputMBps / c.BaselineMBps
+			}
+			_, _ = fmt.Fprintf(stderr, "| %s | %d | %s vs %s | %.2f vs %.2f | %.2fx | %v |\n", c.File, c.Aggr, c.Engine, c.Baseline, c.ThroughputMBps, c.BaselineMBps, speedup, c.Identical)
+		}
+	}
+	if mismatch {
+		return printErr(stderr, exitInternal, "engine outputs differ", nil)
+	}
+	return exitSuccess
+}
+
+// planTokens returns the plan for one tokenizer given its count of each aggressiveness's
+// kept text, indexed by aggressiveness with 0 for the whole input; nil without a budget.
+func planTokens(kept []int, maxTokens int) *tokenPlan {
+	if maxTokens <= 0 {
+		return nil
+	}
+	if kept[0] <= maxTokens {
+		return &tokenPlan{}
+	}
+	ratio := float64(maxTokens) / float64(kept[0])
+	p := &tokenPlan{NeedsSqueeze: true, TargetRatio: math.Floor(ratio*1e4) / 1e4}
+	for aggr := 1; aggr < len(kept); aggr++ {
+		if kept[aggr] <= maxTokens {
+			p.Aggressiveness = &aggr
+			break
+		}
+	}
+	return p
+}
+
+// keptTokens counts text under each tokenizer as kept at aggressiveness 0 through levels-1:
+// kept[i][0] is the whole text and kept[i][aggr] the Kept text of one analysis at aggr.
+func keptTokens(text []byte, tokenizers []api.Tokenizer, levels int) ([][]int, error) {
+	kept := make([][]int, len(tokenizers))
+	for i := range kept {
+		kept[i] = make([]int, levels)
+	}
+	for aggr := 0; aggr < levels; aggr++ {
+		in := text
+		if aggr > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			a, _, err := api.DefaultEngine().Analyze(ctx, text, api.Options{Aggressiveness: aggr})
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			in = a.Kept()
+		}
+		for i, tok := range tokenizers {
+			kept[i][aggr] = tok.Count(in)
+		}
+	}
+	return kept, nil
+}
+
+func (p *tokenPlan) String() string {
+	switch {
+	case p == nil:
+		return ""
+	case !p.NeedsSqueeze:
+		return " (fits)"
+	case p.Aggressiveness != nil:
+		return fmt.Sprintf(" (aggr %d)", *p.Aggressiveness)
+	}
+	return fmt.Sprintf(" (target ratio %g)", p.TargetRatio)
+}
+
+// runTokens counts the tokens of each input after extraction, without squeezing it.
+func runTokens(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("contextsqueeze tokens", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	tokenizerList := fs.String("tokenizer", "approx", "comma-separated tokenizers: approx or paths of tiktoken-format BPE vocabularies")
+	maxTokens := fs.Int("max-tokens", 0, "token budget to plan a squeeze for")
+	jsonOut := fs.Bool("json", false, "emit JSON")
+	source := fs.String("source", "auto", "source override: "+sourceChoices())
+	encoding := fs.String("encoding", "auto", "text encoding: auto|utf-8|utf-16le|utf-16be|windows-1252|iso-8859-1")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		return printErr(stderr, exitUsage, "usage: contextsqueeze tokens [--tokenizer approx,vocab.tiktoken] [--max-tokens N] [--json] file|- ...", nil)
+	}
+	if *maxTokens < 0 {
+		return printErr(stderr, exitUsage, "invalid --max-tokens", fmt.Errorf("must not be negative, got %d", *maxTokens))
+	}
+	tokenizers := make([]api.Tokenizer, 0)
+	for _, spec := range strings.Split(*tokenizerList, ",") {
+		tok, err := tokenizer.Open(strings.TrimSpace(spec))
+		if err != nil {
+			return printErr(stderr, exitUsage, "invalid --tokenizer", err)
+		}
+		tokenizers = append(tokenizers, tok)
+	}
+
+	opts := ingest.Options{Source: *source, Encoding: *encoding}
+	report := tokensJSON{SchemaVersion: "1", MaxTokens: *maxTokens, Files: make([]tokenFile, 0, fs.NArg()), Total: tokenFile{File: "total"}}
+	texts := make([][]byte, 0, fs.NArg())
+	whole := make([]int, len(tokenizers))
+	for _, path := range fs.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var ing ingest.Result
+		var err error
+		if path == "-" {
+			ing, err = ingest.RunReader(ctx, "", stdin, opts)
+		} else {
+			ing, err = ingest.RunWithOptions(ctx, path, opts)
+		}
+		cancel()
+		if err != nil {
+			return printErr(stderr, classifyErr(err), "ingest error", fmt.Errorf("%s: %w", path, err))
+		}
+		report.Files = append(report.Files, tokenFile{File: path, SourceType: ing.SourceType, Bytes: len(ing.Text)})
+		report.Total.Bytes += len(ing.Text)
+		texts = append(texts, ing.Text)
+		for i, tok := range tokenizers {
+			whole[i] += tok.Count(ing.Text)
+		}
+	}
+	// The plans measure every aggressiveness only when some total is over the budget; files
+	// then need all of them too, even those that fit, since the total plan sums what each
+	// file keeps.
+	levels := 1
+	for _, n := range whole {
+		if *maxTokens > 0 && n > *maxTokens {
+			levels = 10
+		}
+	}
+	totals := make([][]int, len(tokenizers))
+	for i := range totals {
+		totals[i] = make([]int, levels)
+	}
+	for fi, text := range texts {
+		kept, err := keptTokens(text, tokenizers, levels)
+		if err != nil {
+			return printErr(stderr, exitInternal, "analyze error", fmt.Errorf("%s: %w", report.Files[fi].File, err))
+		}
+		f := &report.Files[fi]
+		f.Counts = make([]tokenCount, 0, len(tokenizers))
+		for i, tok := range tokenizers {
+			for aggr, n := range kept[i] {
+				totals[i][aggr] += n
+			}
+			f.Counts = append(f.Counts, tokenCount{Tokenizer: tok.Name(), Tokens: kept[i][0], Plan: planTokens(kept[i], *maxTokens)})
+		}
+	}
+	for i, tok := range tokenizers {
+		report.Total.Counts = append(report.Total.Counts, tokenCount{Tokenizer: tok.Name(), Tokens: totals[i][0], Plan: planTokens(totals[i], *maxTokens)})
+	}
+
+	if *jsonOut {
+		buf, _ := json.MarshalIndent(report, "", "  ")
+		buf = append(buf, '\n')
+		_, _ = stdout.Write(buf)
+		return exitSuccess
+	}
+	header, rule := "| file | source | bytes |", "|---|---|---:|"
+	for _, tok := range tokenizers {
+		header += " " + tok.Name() + " |"
+		rule += "---:|"
+	}
+	_, _ = fmt.Fprintln(stderr, header)
+	_, _ = fmt.Fprintln(stderr, rule)
+	for _, f := range append(report.Files, report.Total) {
+		row := fmt.Sprintf("| %s | %s | %d |", f.File, f.SourceType, f.Bytes)
+		for _, c := range f.Counts {
+			row += fmt.Sprintf(" %d%s |", c.Tokens, c.Plan)
+		}
+		_, _ = fmt.Fprintln(stderr, row)
 	}
 	return exitSuccess
 }
 
-func run(args []string, stdout io.Writer, stderr io.Writer) int {
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
 	if len(args) > 0 {
 		switch args[0] {
 		case "bench":
 			return runBench(args[1:], stdout, stderr)
 		case "stats":
-			return runSqueeze(args[1:], stdout, stderr, true)
+			return runSqueeze(args[1:], stdin, stdout, stderr, true)
 		case "profile":
 			return runProfile(args[1:], stdout, stderr)
+		case "tokens":
+			return runTokens(args[1:], stdin, stdout, stderr)
 		}
 	}
-	return runSqueeze(args, stdout, stderr, false)
+	return runSqueeze(args, stdin, stdout, stderr, false)
 }
 
-func main() { os.Exit(run(os.Args[1:], os.Stdout, os.Stderr)) }
+func main() { os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)) }
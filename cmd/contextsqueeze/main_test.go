@@ -1,12 +1,20 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/contextsqueeze"
+	"contextsqueezer/pkg/tokenizer"
 )
 
 func TestJSONSchemaTextField(t *testing.T) {
@@ -17,7 +25,7 @@ func TestJSONSchemaTextField(t *testing.T) {
 	}
 	var out bytes.Buffer
 	var errb bytes.Buffer
-	rc := run([]string{"--json", "--aggr", "0", infile}, &out, &errb)
+	rc := run([]string{"--json", "--aggr", "0", infile}, nil, &out, &errb)
 	if rc != 0 {
 		t.Fatalf("run failed: %s", errb.String())
 	}
@@ -25,7 +33,7 @@ func TestJSONSchemaTextField(t *testing.T) {
 	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
 		t.Fatalf("invalid json: %v", err)
 	}
-	required := []string{"schema_version", "engine_version", "build", "bytes_in", "bytes_out", "tokens_in_approx", "tokens_out_approx", "reduction_pct", "aggressiveness", "profile", "budget_applied", "truncated", "source_type", "warnings"}
+	required := []string{"schema_version", "engine_version", "build", "bytes_in", "bytes_out", "tokens_in", "tokens_out", "tokens_in_approx", "tokens_out_approx", "reduction_pct", "aggressiveness", "profile", "budget_applied", "truncated", "source_type", "detection", "metadata", "sections", "warnings"}
 	for _, k := range required {
 		if _, ok := m[k]; !ok {
 			t.Fatalf("missing key %s", k)
@@ -44,7 +52,7 @@ func TestJSONSchemaBase64Field(t *testing.T) {
 	}
 	var out bytes.Buffer
 	var errb bytes.Buffer
-	rc := run([]string{"--json", "--aggr", "0", infile}, &out, &errb)
+	rc := run([]string{"--json", "--aggr", "0", "--encoding", "utf-8", infile}, nil, &out, &errb)
 	if rc != 0 {
 		t.Fatalf("run failed: %s", errb.String())
 	}
@@ -65,7 +73,7 @@ func TestProfileCommandOutput(t *testing.T) {
 	}
 	var out bytes.Buffer
 	var errb bytes.Buffer
-	rc := run([]string{"profile", "--seconds", "1", "--max-memory-mb", "64", infile}, &out, &errb)
+	rc := run([]string{"profile", "--seconds", "1", "--max-memory-mb", "64", infile}, nil, &out, &errb)
 	if rc != 0 {
 		t.Fatalf("profile failed: %s", errb.String())
 	}
@@ -78,7 +86,7 @@ func TestProfileCommandOutput(t *testing.T) {
 func TestBenchSuiteOutput(t *testing.T) {
 	var out bytes.Buffer
 	var errb bytes.Buffer
-	rc := run([]string{"bench", "--suite", "default", "--runs", "1", "--warmup", "0", "--aggr", "6"}, &out, &errb)
+	rc := run([]string{"bench", "--suite", "default", "--runs", "1", "--warmup", "0", "--aggr", "6"}, nil, &out, &errb)
 	if rc != 0 {
 		t.Fatalf("bench failed: %s", errb.String())
 	}
@@ -91,7 +99,7 @@ func TestBenchSuiteOutput(t *testing.T) {
 func TestBenchJSONSchemaVersion(t *testing.T) {
 	var out bytes.Buffer
 	var errb bytes.Buffer
-	rc := run([]string{"bench", "--suite", "default", "--runs", "1", "--warmup", "0", "--aggr", "6", "--json"}, &out, &errb)
+	rc := run([]string{"bench", "--suite", "default", "--runs", "1", "--warmup", "0", "--aggr", "6", "--json"}, nil, &out, &errb)
 	if rc != 0 {
 		t.Fatalf("bench json failed: %s", errb.String())
 	}
@@ -109,3 +117,384 @@ func TestBenchJSONSchemaVersion(t *testing.T) {
 		t.Fatalf("unexpected schema version: %v", m["schema_version"])
 	}
 }
+
+func TestEncodingWarningUTF16(t *testing.T) {
+	tmp := t.TempDir()
+	infile := filepath.Join(tmp, "in.txt")
+	raw := []byte{0xff, 0xfe}
+	for _, r := range "caf\u00e9 menu\n" {
+		raw = append(raw, byte(r), byte(r>>8))
+	}
+	if err := os.WriteFile(infile, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	var errb bytes.Buffer
+	rc := run([]string{"--json", "--aggr", "0", infile}, nil, &out, &errb)
+	if rc != 0 {
+		t.Fatalf("run failed: %s", errb.String())
+	}
+	var m map[string]any
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if m["text"] != "caf\u00e9 menu\n" {
+		t.Fatalf("unexpected text: %v", m["text"])
+	}
+	if !strings.Contains(out.String(), "input decoded as utf-16le (byte order mark)") {
+		t.Fatalf("missing encoding warning: %s", out.String())
+	}
+}
+
+func TestDecompressionBombExitInput(t *testing.T) {
+	tmp := t.TempDir()
+	infile := filepath.Join(tmp, "bomb.docx")
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	w, _ := zw.Create("word/document.xml")
+	_, _ = w.Write(bytes.Repeat([]byte("<w:p/>"), 1<<20))
+	_ = zw.Close()
+	if err := os.WriteFile(infile, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	var errb bytes.Buffer
+	if rc := run([]string{infile}, nil, &out, &errb); rc != exitInput {
+		t.Fatalf("expected exit %d, got %d: %s", exitInput, rc, errb.String())
+	}
+}
+
+func TestStdinPipeline(t *testing.T) {
+	page := "<!DOCTYPE html><html><body><h1>Piped</h1><p>Fetched page body for the pipeline.</p></body></html>"
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--aggr", "0"}, strings.NewReader(page), &out, &errb); rc != exitSuccess {
+		t.Fatalf("stdin run failed: %d %s", rc, errb.String())
+	}
+	if !strings.Contains(out.String(), "# Piped") || strings.Contains(out.String(), "<p>") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	out.Reset()
+	errb.Reset()
+	if rc := run([]string{"--json", "--source", "text", "-"}, strings.NewReader(page), &out, &errb); rc != exitSuccess {
+		t.Fatalf("explicit stdin run failed: %d %s", rc, errb.String())
+	}
+	var m map[string]any
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if m["source_type"] != "text" {
+		t.Fatalf("source override ignored: %v", m["source_type"])
+	}
+
+	errb.Reset()
+	if rc := run([]string{"--aggr", "0"}, nil, &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error without input, got %d", rc)
+	}
+}
+
+func TestJSONProvenance(t *testing.T) {
+	infile := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(infile, []byte("# Notes\n\nFirst finding is here.\nSecond finding follows.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--json", "--provenance", "--aggr", "0", infile}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("run failed: %s", errb.String())
+	}
+	var res struct {
+		Text       string `json:"text"`
+		Provenance []struct {
+			OutStart int `json:"out_start"`
+			OutEnd   int `json:"out_end"`
+			Line     int `json:"line"`
+		} `json:"provenance"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	found := false
+	for _, p := range res.Provenance {
+		if res.Text[p.OutStart:p.OutEnd] == "Second finding follows." && p.Line == 4 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing provenance for second finding: %+v", res.Provenance)
+	}
+}
+
+func TestBenchEngineComparison(t *testing.T) {
+	if _, err := api.NativeEngine(); err != nil {
+		t.Skip(err)
+	}
+	var out, errb bytes.Buffer
+	rc := run([]string{"bench", "--file", "../../testdata/bench/small.txt", "--runs", "1", "--warmup", "0", "--aggr", "6", "--engine", "both", "--json"}, nil, &out, &errb)
+	if rc != exitSuccess {
+		t.Fatalf("bench failed: %d %s", rc, errb.String())
+	}
+	var res benchJSON
+	if err := json.Unmarshal(out.Bytes()[bytes.LastIndex(out.Bytes(), []byte("{\n  \"schema_version\"")):], &res); err != nil {
+		t.Fatalf("invalid bench json: %v", err)
+	}
+	if len(res.Cases) != 2 || len(res.Comparisons) != 1 || !res.Comparisons[0].Identical || res.Comparisons[0].Engine != "go" {
+		t.Fatalf("unexpected comparison: %+v", res.Comparisons)
+	}
+	if rc := run([]string{"--engine", "rust", "x.txt"}, nil, &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error for unknown engine, got %d", rc)
+	}
+}
+
+func TestBenchWorkersDeterminism(t *testing.T) {
+	var out, errb bytes.Buffer
+	rc := run([]string{"bench", "--file", "../../testdata/bench/large.txt", "--runs", "1", "--warmup", "0", "--aggr", "6", "--workers", "4,1", "--json"}, nil, &out, &errb)
+	if rc != exitSuccess {
+		t.Fatalf("bench failed: %d %s", rc, errb.String())
+	}
+	var res benchJSON
+	if err := json.Unmarshal(out.Bytes()[bytes.LastIndex(out.Bytes(), []byte("{\n  \"schema_version\"")):], &res); err != nil {
+		t.Fatalf("invalid bench json: %v", err)
+	}
+	if len(res.Cases) != 1 || !res.Cases[0].Determinism || joinInts(res.Cases[0].Workers) != "4,1" {
+		t.Fatalf("unexpected bench cases: %+v", res.Cases)
+	}
+	if rc := run([]string{"bench", "--workers", "-1"}, nil, &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error for negative workers, got %d", rc)
+	}
+}
+
+func TestSqueezeTimeoutExitCode(t *testing.T) {
+	infile := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(infile, []byte(strings.Repeat("Some sentence to squeeze here. ", 2000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--timeout", "1ns", infile}, nil, &out, &errb); rc != exitTimeout {
+		t.Fatalf("expected exit %d, got %d: %s", exitTimeout, rc, errb.String())
+	}
+}
+
+func TestStreamFlag(t *testing.T) {
+	var out, errb bytes.Buffer
+	in := strings.Repeat("Disk check passed on node seven.\n", 50)
+	if rc := run([]string{"--stream", "--aggr", "0"}, strings.NewReader(in), &out, &errb); rc != exitSuccess {
+		t.Fatalf("stream run failed: %d %s", rc, errb.String())
+	}
+	if out.String() != "Disk check passed on node seven.\n" {
+		t.Fatalf("unexpected stream output %q", out.String())
+	}
+	if rc := run([]string{"--stream", "--json", "-"}, strings.NewReader(in), &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error for --stream --json, got %d", rc)
+	}
+}
+
+func TestSizeLimitFlags(t *testing.T) {
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--json", "--target-ratio", "0.3", "--max-bytes", "20000", "../../testdata/bench/large.txt"}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("run failed: %d %s", rc, errb.String())
+	}
+	var res contextsqueeze.Result
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(res.Targets) != 2 || res.Targets[0].Name != "ratio" || res.Targets[1].Achieved > 20000 || res.BytesOut > 20000 {
+		t.Fatalf("unexpected targets %+v (%d bytes out)", res.Targets, res.BytesOut)
+	}
+	for _, args := range [][]string{{"--target-ratio", "1.5", "x.txt"}, {"--max-words", "-1", "x.txt"}} {
+		if rc := run(args, nil, &out, &errb); rc != exitUsage {
+			t.Fatalf("expected usage error for %v, got %d", args, rc)
+		}
+	}
+}
+
+func TestTokenizerFlag(t *testing.T) {
+	var vocab strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&vocab, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, m := range []string{"th", "the", " th", " the", "in", "ing", "er", "re"} {
+		fmt.Fprintf(&vocab, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(m)), 256+i)
+	}
+	path := filepath.Join(t.TempDir(), "tiny.tiktoken")
+	if err := os.WriteFile(path, []byte(vocab.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--json", "--tokenizer", path, "--max-tokens", "60", "../../testdata/bench/small.txt"}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("run failed: %d %s", rc, errb.String())
+	}
+	var res contextsqueeze.Result
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	tok, err := tokenizer.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Tokenizer != "tiny" || res.TokensOut > 60 || res.TokensOut != tok.Count(res.Text) || res.TokensOutApprox != res.TokensOut {
+		t.Fatalf("budget not counted with the tokenizer: %s %d tokens", res.Tokenizer, res.TokensOut)
+	}
+	if rc := run([]string{"--tokenizer", "missing.tiktoken", "x.txt"}, nil, &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error for a missing vocabulary, got %d", rc)
+	}
+}
+
+func TestTokensCommand(t *testing.T) {
+	// A vocabulary of single bytes counts one token per byte.
+	var vocab strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&vocab, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	bytesVocab := filepath.Join(t.TempDir(), "bytes.tiktoken")
+	if err := os.WriteFile(bytesVocab, []byte(vocab.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	small, err := os.ReadFile("../../testdata/bench/small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const medium = "../../testdata/bench/medium.txt"
+	args := []string{"tokens", "--json", "--max-tokens", "24000", "--tokenizer", "approx," + bytesVocab, "-", medium}
+	var out, errb bytes.Buffer
+	if rc := run(args, bytes.NewReader(small), &out, &errb); rc != exitSuccess {
+		t.Fatalf("tokens failed: %d %s", rc, errb.String())
+	}
+	var report tokensJSON
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if report.SchemaVersion != "1" || len(report.Files) != 2 || report.Files[0].File != "-" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for i, name := range []string{"approx", "bytes"} {
+		sc, mc, tc := report.Files[0].Counts[i], report.Files[1].Counts[i], report.Total.Counts[i]
+		if sc.Tokenizer != name || mc.Tokenizer != name || tc.Tokens != sc.Tokens+mc.Tokens {
+			t.Fatalf("total is not the sum of the files under %s: %+v", name, report.Total)
+		}
+		if sc.Plan == nil || sc.Plan.NeedsSqueeze || mc.Plan == nil || !mc.Plan.NeedsSqueeze || mc.Plan.TargetRatio <= 0 {
+			t.Fatalf("unexpected plans under %s: %+v %+v", name, sc.Plan, mc.Plan)
+		}
+	}
+	if got := report.Files[0].Counts[0].Tokens; got != api.ApproxTokenizer().Count(small) {
+		t.Fatalf("stdin counted %d approx tokens, want %d", got, api.ApproxTokenizer().Count(small))
+	}
+	if got := report.Files[1].Counts[1].Tokens; got != report.Files[1].Bytes {
+		t.Fatalf("bytes tokenizer counted %d, want %d", got, report.Files[1].Bytes)
+	}
+
+	// Each plan is the lowest aggressiveness whose kept text fits under its tokenizer.
+	text, err := os.ReadFile(medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytesTok, err := tokenizer.Open(bytesVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tok := range []api.Tokenizer{api.ApproxTokenizer(), bytesTok} {
+		want := -1
+		for aggr := 1; aggr <= 9 && want < 0; aggr++ {
+			a, err := api.AnalyzeContext(context.Background(), text, api.Options{Aggressiveness: aggr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.Count(a.Kept()) <= 24000 {
+				want = aggr
+			}
+		}
+		if plan := report.Files[1].Counts[i].Plan; plan.Aggressiveness == nil || *plan.Aggressiveness != want {
+			t.Fatalf("planned aggressiveness %v under %s, want %d", plan.Aggressiveness, tok.Name(), want)
+		}
+	}
+	aggr := *report.Files[1].Counts[0].Plan.Aggressiveness
+
+	out.Reset()
+	errb.Reset()
+	if rc := run([]string{"tokens", "--max-tokens", "24000", "--tokenizer", "approx," + bytesVocab, medium}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("tokens failed: %d %s", rc, errb.String())
+	}
+	table := errb.String()
+	if out.Len() != 0 || !strings.Contains(table, "| file | source | bytes | approx | bytes |") ||
+		!strings.Contains(table, fmt.Sprintf("(aggr %d) |", aggr)) || !strings.Contains(table, "| total |") {
+		t.Fatalf("unexpected table:\n%s", table)
+	}
+
+	// Two halves that each fit still need a squeeze together, and the total plan says how much.
+	cut := bytes.Index(text[len(text)/2:], []byte("\n\n")) + len(text)/2 + 2
+	dir := t.TempDir()
+	halves := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}
+	for i, part := range [][]byte{text[:cut], text[cut:]} {
+		if err := os.WriteFile(halves[i], part, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.Reset()
+	if rc := run(append([]string{"tokens", "--json", "--max-tokens", "20000"}, halves...), nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("tokens failed: %d %s", rc, errb.String())
+	}
+	report = tokensJSON{}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	for _, f := range report.Files {
+		if f.Counts[0].Tokens > 20000 || f.Counts[0].Plan.NeedsSqueeze {
+			t.Fatalf("expected %s to fit alone: %+v", f.File, f.Counts[0])
+		}
+	}
+	if plan := report.Total.Counts[0].Plan; !plan.NeedsSqueeze || plan.Aggressiveness == nil {
+		t.Fatalf("total plan %+v has no aggressiveness", plan)
+	}
+	if rc := run([]string{"tokens"}, nil, &out, &errb); rc != exitUsage {
+		t.Fatalf("expected usage error without files, got %d", rc)
+	}
+}
+
+func TestQueryFlag(t *testing.T) {
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--json", "--max-tokens", "20000", "--query", "Pemberley", "../../testdata/bench/large.txt"}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("run failed: %d %s", rc, errb.String())
+	}
+	var res contextsqueeze.Result
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	relevant := 0
+	for _, s := range res.Sections {
+		if s.Relevance != nil && *s.Relevance > 0 {
+			relevant++
+		}
+	}
+	if relevant == 0 || !bytes.Contains(res.Text, []byte("Pemberley")) {
+		t.Fatalf("query had no effect: %d relevant sections", relevant)
+	}
+	errb.Reset()
+	if rc := run([]string{"--query", "the of and", "../../testdata/bench/small.txt"}, nil, &out, &errb); rc != exitUsage || !strings.Contains(errb.String(), "invalid --query") {
+		t.Fatalf("expected a usage error for a query of stopwords, got %d %s", rc, errb.String())
+	}
+}
+
+func TestJSONMatchesLibrary(t *testing.T) {
+	const path = "../../testdata/bench/small.txt"
+	var out, errb bytes.Buffer
+	if rc := run([]string{"--json", "--aggr", "6", "--provenance", path}, nil, &out, &errb); rc != exitSuccess {
+		t.Fatalf("run failed: %d %s", rc, errb.String())
+	}
+	sq, err := contextsqueeze.New(contextsqueeze.Config{Aggressiveness: 6, Provenance: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := sq.SqueezeFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Metrics.SentencesTotal == 0 {
+		t.Fatal("expected engine counters in metrics")
+	}
+	lib, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.TrimSuffix(out.Bytes(), []byte("\n")); !bytes.Equal(got, lib) {
+		t.Fatalf("cli json differs from the library result:\n%s\n---\n%s", got, lib)
+	}
+}
@@ -0,0 +1,175 @@
+package ingest
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode"
+
+	"contextsqueezer/pkg/format"
+)
+
+const maxNestingDepth = 2
+
+type archiveMember struct {
+	name string
+	data []byte
+}
+
+func isGzip(raw []byte) bool { return len(raw) >= 2 && raw[0] == 0x1f && raw[1] == 0x8b }
+
+func isTar(raw []byte) bool {
+	return len(raw) >= 262 && bytes.Equal(raw[257:262], []byte("ustar"))
+}
+
+func skipMemberName(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".")
+}
+
+func oversizedMember(name string, declared int64, warnings *[]string) bool {
+	if limit := maxBytes(); declared > limit {
+		*warnings = append(*warnings, fmt.Sprintf("skipped member %s: exceeds max bytes limit (%d)", name, limit))
+		return true
+	}
+	return false
+}
+
+func zipMembers(raw []byte, budget format.Budget, warnings *[]string) ([]archiveMember, error) {
+	r, err := openZip(budget, raw)
+	if err != nil {
+		var inputErr *InputError
+		if errors.As(err, &inputErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("parse zip archive: %w", err)
+	}
+	members := make([]archiveMember, 0, len(r.File))
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || skipMemberName(f.Name) || oversizedMember(f.Name, int64(f.UncompressedSize64), warnings) {
+			continue
+		}
+		data, err := readZipFile(budget, f)
+		if err != nil {
+			var inputErr *InputError
+			if errors.As(err, &inputErr) {
+				return nil, err
+			}
+			*warnings = append(*warnings, fmt.Sprintf("skipped member %s: %v", f.Name, err))
+			continue
+		}
+		members = append(members, archiveMember{name: f.Name, data: data})
+	}
+	return members, nil
+}
+
+func tarMembers(r io.Reader, budget format.Budget, warnings *[]string) ([]archiveMember, error) {
+	tr := tar.NewReader(r)
+	members := make([]archiveMember, 0)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return members, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || skipMemberName(hdr.Name) || oversizedMember(hdr.Name, hdr.Size, warnings) {
+			continue
+		}
+		data, err := budget.Inflate(hdr.Name, tr, 0)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{name: hdr.Name, data: data})
+	}
+}
+
+func archiveMembers(name string, raw []byte, budget format.Budget, warnings *[]string) ([]archiveMember, error) {
+	switch {
+	case isGzip(raw):
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("parse gzip archive: %w", err)
+		}
+		defer zr.Close()
+		br := bufio.NewReaderSize(zr, 512)
+		if head, _ := br.Peek(262); isTar(head) {
+			return tarMembers(br, budget, warnings)
+		}
+		inner := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		data, err := budget.Inflate(inner, br, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []archiveMember{{name: inner, data: data}}, nil
+	case isTar(raw):
+		return tarMembers(bytes.NewReader(raw), budget, warnings)
+	default:
+		return zipMembers(raw, budget, warnings)
+	}
+}
+
+// parseArchive ingests every supported member through the regular detectors and joins them
+// under per-file headings. Unsupported or oversized members are skipped with a warning, while
+// breaching the input's decompression budget rejects the whole archive.
+func parseArchive(ctx context.Context, name string, raw []byte, budget format.Budget, nested func(context.Context, string, []byte) (format.Document, error)) (format.Document, error) {
+	warnings := []string{}
+	members, err := archiveMembers(name, raw, budget, &warnings)
+	if err != nil {
+		return format.Document{}, err
+	}
+	var b bytes.Buffer
+	spans := make([]format.SourceSpan, 0)
+	for _, m := range members {
+		select {
+		case <-ctx.Done():
+			return format.Document{}, ctx.Err()
+		default:
+		}
+		res, err := nested(ctx, m.name, m.data)
+		var inputErr *InputError
+		if errors.As(err, &inputErr) {
+			return format.Document{}, err
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("skipped member %s: %v", m.name, err))
+			continue
+		}
+		for _, w := range res.Warnings {
+			warnings = append(warnings, m.name+": "+w)
+		}
+		text := bytes.TrimSpace(res.Text)
+		if len(text) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString("# ")
+		b.WriteString(m.name)
+		b.WriteString("\n\n")
+		lead := len(res.Text) - len(bytes.TrimLeftFunc(res.Text, unicode.IsSpace))
+		for _, sp := range shiftSpans(res.SourceMap, b.Len()-lead, m.name) {
+			sp.Start = max(sp.Start, b.Len())
+			sp.End = min(sp.End, b.Len()+len(text))
+			if sp.Start < sp.End {
+				spans = append(spans, sp)
+			}
+		}
+		b.Write(text)
+	}
+	if b.Len() == 0 {
+		warnings = append(warnings, "archive contained no supported documents")
+		return format.Document{Text: []byte{}, Warnings: warnings}, nil
+	}
+	b.WriteByte('\n')
+	return format.Document{Text: b.Bytes(), Warnings: warnings, SourceMap: spans}, nil
+}
@@ -1,55 +1,72 @@
 package ingest
 
 import (
-	"bytes"
 	"errors"
-	"path/filepath"
-	"strings"
+	"fmt"
+
+	"contextsqueezer/pkg/format"
 )
 
-func DetectType(path string, data []byte, override string) (string, error) {
-	if override != "" && override != "auto" {
-		switch override {
-		case "pdf", "docx", "html", "text":
-			return override, nil
-		default:
-			return "", errors.New("invalid source override")
+// Detection records how the source type was chosen, for the JSON output.
+type Detection struct {
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason"`
+}
+
+func isBinary(data []byte) bool {
+	nullCount := 0
+	for _, b := range data {
+		if b == 0 {
+			nullCount++
 		}
 	}
+	return len(data) > 0 && float64(nullCount)/float64(len(data)) > 0.02
+}
 
-	ext := strings.ToLower(filepath.Ext(path))
-	if len(data) >= 5 && string(data[:5]) == "%PDF-" {
-		return "pdf", nil
-	}
-	if len(data) >= 4 && bytes.Equal(data[:4], []byte{'P', 'K', 0x03, 0x04}) {
-		if ext == ".docx" {
-			return "docx", nil
+func DetectType(path string, data []byte, override string) (string, error) {
+	kind, _, err := Detect(path, data, override)
+	return kind, err
+}
+
+// Detect picks the parser for data and explains the choice. An override always wins with full
+// confidence; otherwise the best sniff score is used.
+func Detect(path string, data []byte, override string) (string, Detection, error) {
+	if override != "" && override != "auto" {
+		if _, ok := format.Lookup(override); ok {
+			return override, Detection{Confidence: 1, Reason: "source override"}, nil
 		}
+		return "", Detection{}, errors.New("invalid source override")
 	}
-	if ext == ".pdf" {
-		return "pdf", nil
-	}
-	if ext == ".docx" {
-		return "docx", nil
+
+	zk := zipContainerKind(data)
+	d := best(path, data, zk)
+	if d.Score <= scoreFallback && zk.kind != "" {
+		return "", Detection{}, fmt.Errorf("unsupported document container %s (%s)", zk.kind, zk.reason)
 	}
-	if ext == ".html" || ext == ".htm" {
-		return "html", nil
+	if d.Score < format.ScoreStructure && isBinary(data) {
+		return "", Detection{}, errors.New("unsupported binary file")
 	}
-	if ext == ".txt" || ext == ".md" {
-		return "text", nil
+	if d.Parser == nil {
+		return "", Detection{}, errors.New("unsupported source type")
 	}
+	return d.Parser.Name(), Detection{Confidence: d.Confidence(), Reason: d.Reason}, nil
+}
 
-	nullCount := 0
-	for _, b := range data {
-		if b == 0 {
-			nullCount++
+// best is format.Best, except that parsers that sniff zip containers get zk rather than
+// reading the central directory once each.
+func best(path string, data []byte, zk zipKind) format.Detection {
+	d := format.Detection{}
+	for _, p := range format.Parsers() {
+		var s int
+		var reason string
+		if ks, ok := p.(kindSniffer); ok {
+			s, reason = ks.sniffKind(path, data, zk)
+		} else {
+			s, reason = p.Sniff(path, data)
+		}
+		if s > d.Score {
+			d = format.Detection{Parser: p, Score: s, Reason: reason}
 		}
 	}
-	if len(data) > 0 && float64(nullCount)/float64(len(data)) > 0.02 {
-		return "", errors.New("unsupported binary file")
-	}
-	if bytes.Contains(bytes.ToLower(data), []byte("<html")) {
-		return "html", nil
-	}
-	return "text", nil
+	return d
 }
@@ -1,12 +1,12 @@
 package ingest
 
 import (
-	"archive/zip"
 	"bytes"
 	"encoding/xml"
 	"errors"
-	"io"
 	"strings"
+
+	"contextsqueezer/pkg/format"
 )
 
 type xmlNode struct {
@@ -16,9 +16,17 @@ type xmlNode struct {
 }
 
 func ParseDOCX(raw []byte) ([]byte, []string, error) {
+	return parseDOCX(raw, newDecompressBudget(int64(len(raw))))
+}
+
+func parseDOCX(raw []byte, budget format.Budget) ([]byte, []string, error) {
 	warnings := []string{}
-	r, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	r, err := openZip(budget, raw)
 	if err != nil {
+		var inputErr *InputError
+		if errors.As(err, &inputErr) {
+			return nil, warnings, err
+		}
 		if bytes.Contains(raw, []byte("<w:document")) || bytes.Contains(raw, []byte("<document")) {
 			text := extractDocxXMLText(raw)
 			warnings = append(warnings, "docx parsed from xml fallback")
@@ -29,12 +37,7 @@ func ParseDOCX(raw []byte) ([]byte, []string, error) {
 	var doc []byte
 	for _, f := range r.File {
 		if f.Name == "word/document.xml" {
-			rc, openErr := f.Open()
-			if openErr != nil {
-				return nil, warnings, openErr
-			}
-			doc, err = io.ReadAll(rc)
-			_ = rc.Close()
+			doc, err = readZipFile(budget, f)
 			if err != nil {
 				return nil, warnings, err
 			}
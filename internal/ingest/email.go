@@ -0,0 +1,147 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+const maxMIMEDepth = 8
+
+var emailHeaderOrder = []string{"From", "To", "Cc", "Date"}
+
+// ParseEmail renders an RFC 5322 message as the subject heading, the addressing headers and the
+// body. Multipart messages prefer text/plain alternatives and fall back to text/html.
+func ParseEmail(raw []byte) ([]byte, []string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse email: %w", err)
+	}
+	dec := new(mime.WordDecoder)
+	header := func(k string) string {
+		v := msg.Header.Get(k)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			return d
+		}
+		return v
+	}
+	warnings := []string{}
+	var b strings.Builder
+	if s := header("Subject"); s != "" {
+		b.WriteString("# " + s + "\n\n")
+	}
+	for _, k := range emailHeaderOrder {
+		if v := header(k); v != "" {
+			b.WriteString(k + ": " + v + "\n")
+		}
+	}
+	body, err := emailBody(textproto.MIMEHeader(msg.Header), msg.Body, 0, &warnings)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body = strings.TrimSpace(body); body != "" {
+		b.WriteString("\n" + body + "\n")
+	} else {
+		warnings = append(warnings, "email has no readable text body")
+	}
+	return []byte(b.String()), warnings, nil
+}
+
+func emailBody(h textproto.MIMEHeader, r io.Reader, depth int, warnings *[]string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			*warnings = append(*warnings, "email mime nesting too deep; parts skipped")
+			return "", nil
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		var plain, html string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("parse email part: %w", err)
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				*warnings = append(*warnings, fmt.Sprintf("skipped email attachment %s", part.FileName()))
+				continue
+			}
+			text, err := emailBody(part.Header, part, depth+1, warnings)
+			if err != nil {
+				return "", err
+			}
+			pt, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch {
+			case mediaType == "multipart/alternative" && pt == "text/html":
+				if html == "" {
+					html = text
+				}
+			case mediaType == "multipart/alternative":
+				if plain == "" {
+					plain = text
+				}
+			default:
+				if text = strings.TrimSpace(text); text != "" {
+					plain = strings.TrimSpace(plain + "\n\n" + text)
+				}
+			}
+		}
+		if plain != "" {
+			return plain, nil
+		}
+		return html, nil
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decode email body: %w", err)
+	}
+	if cs := strings.ToLower(params["charset"]); cs != "" && cs != "utf-8" && cs != "us-ascii" {
+		if decoded, _, err := DecodeText(data, cs); err == nil {
+			data = decoded
+		}
+	}
+	if mediaType == "text/html" {
+		data, _, _ = ParseHTML(data)
+	}
+	return string(data), nil
+}
+
+// newlineStripper drops line breaks so base64 bodies wrapped at 76 columns decode cleanly.
+type newlineStripper struct{ r io.Reader }
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		k, err := n.r.Read(p)
+		j := 0
+		for _, c := range p[:k] {
+			if c != '\r' && c != '\n' {
+				p[j] = c
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// cp1252High maps bytes 0x80..0x9F to their Windows-1252 code points; zero marks an undefined byte.
+var cp1252High = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, 0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+func normalizeEncodingName(name string) (string, error) {
+	switch name {
+	case "", "auto":
+		return "auto", nil
+	case "utf-8", "utf8":
+		return "utf-8", nil
+	case "utf-16le", "utf16le":
+		return "utf-16le", nil
+	case "utf-16be", "utf16be":
+		return "utf-16be", nil
+	case "windows-1252", "cp1252":
+		return "windows-1252", nil
+	case "iso-8859-1", "latin-1", "latin1":
+		return "iso-8859-1", nil
+	default:
+		return "", errors.New("invalid encoding override")
+	}
+}
+
+func hasBinaryContainerMagic(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte("%PDF-")) || bytes.HasPrefix(raw, []byte{'P', 'K', 0x03, 0x04}) ||
+		isGzip(raw) || isTar(raw)
+}
+
+// sniffUTF16 reports a BOM-less UTF-16 byte order when one half of the code units is
+// almost always zero, which is how ASCII-heavy UTF-16 text looks on disk.
+func sniffUTF16(raw []byte) string {
+	n := len(raw)
+	if n > 4096 {
+		n = 4096
+	}
+	n -= n % 2
+	if n < 4 {
+		return ""
+	}
+	evenZero, oddZero := 0, 0
+	for i := 0; i < n; i += 2 {
+		if raw[i] == 0 {
+			evenZero++
+		}
+		if raw[i+1] == 0 {
+			oddZero++
+		}
+	}
+	pairs := n / 2
+	if oddZero*10 >= pairs*4 && evenZero*20 < pairs {
+		return "utf-16le"
+	}
+	if evenZero*10 >= pairs*4 && oddZero*20 < pairs {
+		return "utf-16be"
+	}
+	return ""
+}
+
+func guessSingleByte(raw []byte) string {
+	for _, b := range raw {
+		if b >= 0x80 && b <= 0x9F && cp1252High[b-0x80] == 0 {
+			return "iso-8859-1"
+		}
+	}
+	return "windows-1252"
+}
+
+func decodeUTF16(raw []byte, order binary.ByteOrder) []byte {
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		units = append(units, order.Uint16(raw[i:]))
+	}
+	var b bytes.Buffer
+	b.Grow(len(raw))
+	for _, r := range utf16.Decode(units) {
+		b.WriteRune(r)
+	}
+	return b.Bytes()
+}
+
+func decodeSingleByte(raw []byte, enc string) []byte {
+	var b bytes.Buffer
+	b.Grow(len(raw) + len(raw)/4)
+	for _, c := range raw {
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c <= 0x9F && enc == "windows-1252" && cp1252High[c-0x80] != 0:
+			b.WriteRune(cp1252High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.Bytes()
+}
+
+// DecodeText transcodes raw text to UTF-8. With encoding "auto" it honours a byte order mark,
+// then sniffs BOM-less UTF-16, keeps valid UTF-8 untouched and otherwise falls back to a
+// single-byte Windows code page. The returned warnings record any encoding that was assumed.
+func DecodeText(raw []byte, encoding string) ([]byte, []string, error) {
+	enc, err := normalizeEncodingName(encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	reason := "override"
+	if enc == "auto" {
+		switch {
+		case bytes.HasPrefix(raw, []byte{0xEF, 0xBB, 0xBF}):
+			return raw[3:], nil, nil
+		case bytes.HasPrefix(raw, []byte{0xFF, 0xFE}):
+			enc, reason, raw = "utf-16le", "byte order mark", raw[2:]
+		case bytes.HasPrefix(raw, []byte{0xFE, 0xFF}):
+			enc, reason, raw = "utf-16be", "byte order mark", raw[2:]
+		default:
+			if guess := sniffUTF16(raw); guess != "" {
+				enc, reason = guess, "heuristic"
+			} else if utf8.Valid(raw) {
+				return raw, nil, nil
+			} else {
+				enc, reason = guessSingleByte(raw), "heuristic"
+			}
+		}
+	}
+
+	var out []byte
+	switch enc {
+	case "utf-8":
+		out = bytes.TrimPrefix(raw, []byte{0xEF, 0xBB, 0xBF})
+		if !utf8.Valid(out) {
+			return out, []string{"input is not valid utf-8; bytes passed through unchanged"}, nil
+		}
+		return out, nil, nil
+	case "utf-16le":
+		out = decodeUTF16(bytes.TrimPrefix(raw, []byte{0xFF, 0xFE}), binary.LittleEndian)
+	case "utf-16be":
+		out = decodeUTF16(bytes.TrimPrefix(raw, []byte{0xFE, 0xFF}), binary.BigEndian)
+	default:
+		out = decodeSingleByte(raw, enc)
+	}
+	warnings := []string{fmt.Sprintf("input decoded as %s (%s)", enc, reason)}
+	if (enc == "utf-16le" || enc == "utf-16be") && len(raw)%2 != 0 {
+		warnings = append(warnings, "utf-16 input has odd length; trailing byte dropped")
+	}
+	return out, warnings, nil
+}
@@ -0,0 +1,178 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"contextsqueezer/pkg/format"
+)
+
+const (
+	defaultFetchTimeout   = 30 * time.Second
+	defaultMaxRedirects   = 5
+	defaultFetchUserAgent = "contextsqueeze"
+)
+
+// contentTypeParsers maps response media types onto parser names. Generic types such as
+// text/plain and application/octet-stream are left to content sniffing.
+var contentTypeParsers = map[string]string{
+	"text/html":             "html",
+	"application/xhtml+xml": "html",
+	"application/pdf":       "pdf",
+	"application/json":      "json",
+	"application/xml":       "xml",
+	"text/xml":              "xml",
+	"application/rtf":       "rtf",
+	"text/rtf":              "rtf",
+	"message/rfc822":        "email",
+	"text/vtt":              "transcript",
+	"application/x-subrip":  "transcript",
+	"application/epub+zip":  "epub",
+	"text/markdown":         "text",
+	"application/vnd.oasis.opendocument.text":                                   "odt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   "docx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": "pptx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         "xlsx",
+}
+
+type FetchOptions struct {
+	Timeout   time.Duration
+	MaxBytes  int64
+	UserAgent string
+	// MaxRedirects is how many redirects are followed; 0 follows none and a negative value
+	// means the default of 5.
+	MaxRedirects int
+	// Client replaces the default client (e.g. an httptest TLS client); Timeout and
+	// MaxRedirects do not apply to it.
+	Client *http.Client
+}
+
+type FetchResult struct {
+	Data        []byte
+	ContentType string
+	FinalURL    string
+}
+
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func (o FetchOptions) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	maxRedirects := o.MaxRedirects
+	if maxRedirects < 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects == 0 {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// Fetch downloads rawURL, refusing bodies larger than MaxBytes (CSQ_MAX_BYTES by default).
+func Fetch(ctx context.Context, rawURL string, opts FetchOptions) (FetchResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return FetchResult{}, errors.New("invalid input url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	ua := opts.UserAgent
+	if ua == "" {
+		ua = defaultFetchUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	resp, err := opts.client().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return FetchResult{}, ctx.Err()
+		}
+		return FetchResult{}, fmt.Errorf("fetch input: %w", err)
+	}
+	defer resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode <= 399 && loc != "" {
+		return FetchResult{}, fmt.Errorf("fetch input: %s redirects to %s, and following redirects is disabled", resp.Status, loc)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return FetchResult{}, fmt.Errorf("fetch input: unexpected status %s", resp.Status)
+	}
+	limit := opts.MaxBytes
+	if limit <= 0 {
+		limit = maxBytes()
+	}
+	if resp.ContentLength > limit {
+		return FetchResult{}, &InputError{Reason: fmt.Sprintf("response of %d bytes exceeds fetch size limit (%d)", resp.ContentLength, limit)}
+	}
+	data, err := io.ReadAll(&io.LimitedReader{R: resp.Body, N: limit + 1})
+	if err != nil {
+		if ctx.Err() != nil {
+			return FetchResult{}, ctx.Err()
+		}
+		return FetchResult{}, fmt.Errorf("fetch input: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return FetchResult{}, &InputError{Reason: fmt.Sprintf("response exceeds fetch size limit (%d)", limit)}
+	}
+	return FetchResult{Data: data, ContentType: resp.Header.Get("Content-Type"), FinalURL: resp.Request.URL.String()}, nil
+}
+
+// RunURL fetches and ingests a remote document. Unless opts.Source forces a parser, a specific
+// Content-Type picks it; otherwise detection sniffs the body and the final URL's path.
+func RunURL(ctx context.Context, rawURL string, opts Options, fopts FetchOptions) (Result, error) {
+	fetched, err := Fetch(ctx, rawURL, fopts)
+	if err != nil {
+		return Result{}, err
+	}
+	name := ""
+	if u, err := url.Parse(fetched.FinalURL); err == nil {
+		name = path.Base(u.Path)
+	}
+	var detection *Detection
+	mediaType, params, _ := mime.ParseMediaType(fetched.ContentType)
+	if opts.Source == "" || opts.Source == "auto" {
+		if kind, ok := contentTypeParsers[mediaType]; ok {
+			if _, registered := format.Lookup(kind); registered {
+				opts.Source = kind
+				detection = &Detection{Confidence: float64(format.ScoreMagic) / float64(format.ScoreOverride), Reason: "content-type " + mediaType}
+			}
+		}
+	}
+	if opts.Encoding == "" || opts.Encoding == "auto" {
+		if enc, err := normalizeEncodingName(strings.ToLower(params["charset"])); err == nil {
+			opts.Encoding = enc
+		}
+	}
+	res, err := runBytes(ctx, name, fetched.Data, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if detection != nil {
+		res.Detection = *detection
+	}
+	res.SourceURL = fetched.FinalURL
+	return res, nil
+}
@@ -0,0 +1,116 @@
+package ingest
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxHeadingLen = 80
+
+var (
+	reNumberedHeading = regexp.MustCompile(`^(\d+(?:\.\d+)*)\.?\s+(\S.*)$`)
+	// reListItem is an ordered list item such as "1. Buy milk", which a section number only
+	// looks like when it has one component.
+	reListItem = regexp.MustCompile(`^\d+[.)]\s`)
+)
+
+// terminalPunct ends sentences and clauses, which headings do not, in Latin and CJK text.
+const terminalPunct = ".,;:!。，、；：！？"
+
+// InferHeadings rewrites headings that plain text marks by convention into Markdown ATX
+// headings so the pipeline can see section structure:
+//
+//	Title          # Title          (=== underline, level 1; --- underline, level 2)
+//	2.3 Scope      ## 2.3 Scope     (one level per number component)
+//	RESULTS        # RESULTS        (standalone all-caps line)
+//
+// Fenced code blocks and lines that are already headings are left alone.
+func InferHeadings(text []byte) []byte {
+	lines := bytes.Split(text, []byte("\n"))
+	out := make([][]byte, 0, len(lines))
+	inFence := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		s := string(bytes.TrimSpace(line))
+		if strings.HasPrefix(s, "```") || strings.HasPrefix(s, "~~~") {
+			inFence = !inFence
+		}
+		if inFence || s == "" || s[0] == '#' || !isHeadingText(s) {
+			out = append(out, line)
+			continue
+		}
+		prevBlank := i == 0 || len(bytes.TrimSpace(lines[i-1])) == 0
+		next := ""
+		if i+1 < len(lines) {
+			next = string(bytes.TrimSpace(lines[i+1]))
+		}
+		level := 0
+		switch {
+		case underlineLevel(next) > 0 && prevBlank:
+			level = underlineLevel(next)
+			i++
+		case prevBlank && reNumberedHeading.MatchString(s) && !reListItem.MatchString(s):
+			m := reNumberedHeading.FindStringSubmatch(s)
+			if startsUpper(m[2]) && !reNumberedHeading.MatchString(next) {
+				level = strings.Count(m[1], ".") + 1
+			}
+		case prevBlank && isAllCaps(s):
+			level = 1
+		}
+		if level == 0 {
+			out = append(out, line)
+			continue
+		}
+		out = append(out, []byte(strings.Repeat("#", min(level, 6))+" "+s))
+	}
+	return bytes.Join(out, []byte("\n"))
+}
+
+func isHeadingText(s string) bool {
+	if len(s) > maxHeadingLen || len(strings.Fields(s)) > 12 {
+		return false
+	}
+	if strings.ContainsRune("-*>|+", rune(s[0])) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(s)
+	return !strings.ContainsRune(terminalPunct, last)
+}
+
+func underlineLevel(s string) int {
+	if len(s) < 3 || strings.Trim(s, s[:1]) != "" {
+		return 0
+	}
+	switch s[0] {
+	case '=':
+		return 1
+	case '-':
+		return 2
+	}
+	return 0
+}
+
+func startsUpper(s string) bool {
+	for _, r := range s {
+		return unicode.IsUpper(r)
+	}
+	return false
+}
+
+// isAllCaps reports whether s has at least four capital letters and no lowercase ones.
+// Scripts without case, such as CJK, are never all caps.
+func isAllCaps(s string) bool {
+	upper := 0
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsUpper(r) || unicode.IsTitle(r) {
+			upper++
+		}
+	}
+	return upper >= 4
+}
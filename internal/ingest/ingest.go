@@ -6,27 +6,34 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strconv"
+
+	"contextsqueezer/internal/textnorm"
+	"contextsqueezer/pkg/format"
 )
 
 const defaultMaxBytes = 50 * 1024 * 1024
 
+type Options struct {
+	Source      string
+	Encoding    string
+	NoNormalize bool
+	// NoHeadings disables InferHeadings on plain text input.
+	NoHeadings bool
+}
+
 type Result struct {
 	Text       []byte
 	SourceType string
+	Detection  Detection
+	SourceURL  string
 	Warnings   []string
+	// SourceMap ties byte ranges of Text to locations in the original input.
+	SourceMap []format.SourceSpan
+	Metadata  format.Metadata
 }
 
 func maxBytes() int64 {
-	v := os.Getenv("CSQ_MAX_BYTES")
-	if v == "" {
-		return defaultMaxBytes
-	}
-	n, err := strconv.ParseInt(v, 10, 64)
-	if err != nil || n <= 0 {
-		return defaultMaxBytes
-	}
-	return n
+	return envLimit("CSQ_MAX_BYTES", defaultMaxBytes)
 }
 
 func ReadFileLimited(path string) ([]byte, error) {
@@ -35,8 +42,13 @@ func ReadFileLimited(path string) ([]byte, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return ReadLimited(f)
+}
+
+// ReadLimited buffers r up to CSQ_MAX_BYTES, failing rather than truncating larger input.
+func ReadLimited(r io.Reader) ([]byte, error) {
 	limit := maxBytes()
-	lr := &io.LimitedReader{R: f, N: limit + 1}
+	lr := &io.LimitedReader{R: r, N: limit + 1}
 	b, err := io.ReadAll(lr)
 	if err != nil {
 		return nil, err
@@ -48,6 +60,10 @@ func ReadFileLimited(path string) ([]byte, error) {
 }
 
 func Run(ctx context.Context, path string, sourceOverride string) (Result, error) {
+	return RunWithOptions(ctx, path, Options{Source: sourceOverride})
+}
+
+func RunWithOptions(ctx context.Context, path string, opts Options) (Result, error) {
 	select {
 	case <-ctx.Done():
 		return Result{}, ctx.Err()
@@ -57,26 +73,88 @@ func Run(ctx context.Context, path string, sourceOverride string) (Result, error
 	if err != nil {
 		return Result{}, err
 	}
-	kind, err := DetectType(path, raw, sourceOverride)
+	return runBytes(ctx, path, raw, opts)
+}
+
+// RunReader ingests a stream such as stdin. name may be empty; without an extension to go on,
+// detection relies on content sniffing or opts.Source.
+func RunReader(ctx context.Context, name string, r io.Reader, opts Options) (Result, error) {
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	default:
+	}
+	raw, err := ReadLimited(r)
 	if err != nil {
 		return Result{}, err
 	}
-	var text []byte
-	var warnings []string
-	switch kind {
-	case "pdf":
-		text, warnings, err = ParsePDF(raw)
-	case "docx":
-		text, warnings, err = ParseDOCX(raw)
-	case "html":
-		text, warnings, err = ParseHTML(raw)
-	case "text":
-		text, warnings, err = ParseText(raw)
-	default:
-		err = errors.New("unsupported source type")
+	return runBytes(ctx, name, raw, opts)
+}
+
+// PrepareText applies the plain-text steps of ingest, heading inference and normalization, to
+// UTF-8 text that skips format detection, such as one window of a stream.
+func PrepareText(text []byte, opts Options) ([]byte, []string) {
+	if !opts.NoHeadings {
+		text = InferHeadings(text)
+	}
+	if opts.NoNormalize {
+		return text, nil
+	}
+	out, rep := textnorm.Normalize(text)
+	return out, rep.Warnings()
+}
+
+func runBytes(ctx context.Context, name string, raw []byte, opts Options) (Result, error) {
+	res, err := ingestBytes(ctx, name, raw, opts, newDecompressBudget(int64(len(raw))), 0)
+	if err != nil {
+		return Result{}, err
+	}
+	if !opts.NoNormalize {
+		var rep textnorm.Report
+		res.Text, res.SourceMap, rep = normalizeMapped(res.Text, res.SourceMap)
+		res.Warnings = append(res.Warnings, rep.Warnings()...)
+	}
+	return res, nil
+}
+
+// ingestBytes parses raw at nesting depth, inflating containers from budget, which nested
+// members share with the input they came from.
+func ingestBytes(ctx context.Context, name string, raw []byte, opts Options, budget format.Budget, depth int) (Result, error) {
+	var decodeWarnings []string
+	var err error
+	if !hasBinaryContainerMagic(raw) {
+		raw, decodeWarnings, err = DecodeText(raw, opts.Encoding)
+		if err != nil {
+			return Result{}, err
+		}
 	}
+	kind, detection, err := Detect(name, raw, opts.Source)
 	if err != nil {
 		return Result{}, err
 	}
-	return Result{Text: text, SourceType: kind, Warnings: warnings}, nil
+	p, ok := format.Lookup(kind)
+	if !ok {
+		return Result{}, errors.New("unsupported source type")
+	}
+	nested := func(ctx context.Context, member string, data []byte) (format.Document, error) {
+		if depth+1 > maxNestingDepth {
+			return format.Document{}, errors.New("input archive nesting too deep")
+		}
+		res, err := ingestBytes(ctx, member, data, Options{Encoding: opts.Encoding, NoNormalize: opts.NoNormalize, NoHeadings: opts.NoHeadings}, budget, depth+1)
+		if err != nil {
+			return format.Document{}, err
+		}
+		return format.Document{Text: res.Text, Warnings: res.Warnings, SourceMap: res.SourceMap, Metadata: res.Metadata}, nil
+	}
+	doc, err := p.Parse(ctx, format.Source{Name: name, Data: raw, Nested: nested, Budget: budget})
+	if err != nil {
+		return Result{}, err
+	}
+	if kind == "text" && !opts.NoHeadings {
+		doc.Text = InferHeadings(doc.Text)
+	}
+	if doc.SourceMap == nil && !hasBinaryContainerMagic(raw) {
+		doc.SourceMap = lineSourceMap(raw, doc.Text)
+	}
+	return Result{Text: doc.Text, SourceType: kind, Detection: detection, Warnings: append(decodeWarnings, doc.Warnings...), SourceMap: doc.SourceMap, Metadata: doc.Metadata}, nil
 }
@@ -1,13 +1,22 @@
 package ingest
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"contextsqueezer/pkg/format"
 )
 
 func fixture(t *testing.T, name string) string {
@@ -116,3 +125,583 @@ func TestRunIngest(t *testing.T) {
 		t.Fatalf("source type mismatch: %s", res.SourceType)
 	}
 }
+
+func TestParseTranscriptSRT(t *testing.T) {
+	raw := []byte("1\r\n00:00:01,000 --> 00:00:03,000\r\nALICE: Welcome to the planning sync.\r\n\r\n" +
+		"2\r\n00:00:03,500 --> 00:00:05,000\r\nWe will cover the roadmap.\r\n\r\n" +
+		"3\r\n00:00:05,000 --> 00:00:06,000\r\n[music]\r\n\r\n" +
+		"4\r\n00:00:06,000 --> 00:00:07,000\r\nBOB: Um.\r\n\r\n" +
+		"5\r\n00:05:10,000 --> 00:05:12,000\r\nBOB: Thanks, starting with storage.\r\n")
+	if got, _ := DetectType("call.srt", raw, "auto"); got != "transcript" {
+		t.Fatalf("detect srt failed: %s", got)
+	}
+	if got, _ := DetectType("upload", raw, "auto"); got != "transcript" {
+		t.Fatalf("sniff srt failed: %s", got)
+	}
+	out, _, err := ParseTranscript(raw)
+	if err != nil {
+		t.Fatalf("ParseTranscript: %v", err)
+	}
+	want := "## 00:00:00\n\nALICE: Welcome to the planning sync. We will cover the roadmap.\n\n" +
+		"## 00:05:00\n\nBOB: Thanks, starting with storage.\n"
+	if string(out) != want {
+		t.Fatalf("unexpected transcript text:\n%q", out)
+	}
+}
+
+func TestParseTranscriptProsePrefix(t *testing.T) {
+	raw := []byte("1\n00:00:01,000 --> 00:00:03,000\nNote: the demo starts late.\n\n" +
+		"2\n00:00:03,000 --> 00:00:05,000\nEve: Hi all.\n\n" +
+		"3\n00:00:05,000 --> 00:00:07,000\nSummary: nothing shipped yet.\n\n" +
+		"4\n00:00:07,000 --> 00:00:09,000\nEve: Let us begin.\n")
+	out, _, err := ParseTranscript(raw)
+	if err != nil {
+		t.Fatalf("ParseTranscript: %v", err)
+	}
+	want := "## 00:00:00\n\nNote: the demo starts late.\n\nEve: Hi all. Summary: nothing shipped yet. Let us begin.\n"
+	if string(out) != want {
+		t.Fatalf("unexpected transcript text:\n%q", out)
+	}
+}
+
+func TestParseTranscriptVTT(t *testing.T) {
+	raw := []byte("WEBVTT\n\nNOTE exported by meeting tool\n\n" +
+		"intro\n00:01.000 --> 00:02.000 align:start\n<v Carol>Status is green.</v>\n\n" +
+		"00:02.000 --> 00:03.000\n<v Carol>Status is green.</v>\n\n" +
+		"00:03.000 --> 00:04.000\n<v Dan><i>Any blockers?</i></v>\n")
+	if got, _ := DetectType("notes", raw, "auto"); got != "transcript" {
+		t.Fatalf("sniff vtt failed: %s", got)
+	}
+	out, warnings, err := ParseTranscript(raw)
+	if err != nil {
+		t.Fatalf("ParseTranscript: %v", err)
+	}
+	want := "## 00:00:00\n\nCarol: Status is green.\n\nDan: Any blockers?\n"
+	if string(out) != want {
+		t.Fatalf("unexpected transcript text:\n%q", out)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "repeated cues") {
+		t.Fatalf("expected repeated cue warning, got %v", warnings)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+		enc  string
+		want string
+		warn string
+	}{
+		{"utf8", []byte("plain \xc3\xa9"), "auto", "plain é", ""},
+		{"utf8-bom", []byte("\xef\xbb\xbfplain"), "auto", "plain", ""},
+		{"utf16be-bom", []byte{0xfe, 0xff, 0x00, 'h', 0x00, 'i'}, "auto", "hi", "utf-16be (byte order mark)"},
+		{"utf16le-sniff", []byte{'h', 0x00, 'e', 0x00, 'y', 0x00, '!', 0x00}, "auto", "hey!", "utf-16le (heuristic)"},
+		{"cp1252", []byte("\x93quoted\x94 \x80 caf\xe9"), "auto", "“quoted” € café", "windows-1252 (heuristic)"},
+		{"latin1", []byte("\x81 caf\xe9"), "auto", "\u0081 café", "iso-8859-1 (heuristic)"},
+		{"override", []byte("caf\xe9"), "latin-1", "café", "iso-8859-1 (override)"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, warnings, err := DecodeText(tc.raw, tc.enc)
+			if err != nil {
+				t.Fatalf("DecodeText: %v", err)
+			}
+			if string(out) != tc.want {
+				t.Fatalf("got %q want %q", out, tc.want)
+			}
+			if tc.warn == "" && len(warnings) > 0 {
+				t.Fatalf("unexpected warnings: %v", warnings)
+			}
+			if tc.warn != "" && (len(warnings) == 0 || !strings.Contains(warnings[0], tc.warn)) {
+				t.Fatalf("expected warning %q, got %v", tc.warn, warnings)
+			}
+		})
+	}
+	if _, _, err := DecodeText([]byte("x"), "ebcdic"); err == nil {
+		t.Fatal("expected invalid encoding error")
+	}
+}
+
+func TestRunArchiveZip(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	add := func(name string, data []byte) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(data)
+	}
+	add("notes/readme.txt", []byte("Plain notes for the bundle.\n"))
+	add("report.docx", makeDOCX())
+	add("page.html", []byte("<html><body><h2>Web</h2><p>Scraped paragraph.</p></body></html>"))
+	add("logo.bin", []byte{0, 0, 0, 0, 1, 2, 3})
+	add("big.txt", bytes.Repeat([]byte("x"), 200))
+	_ = zw.Close()
+
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CSQ_MAX_BYTES", "150")
+	res, err := Run(context.Background(), path, "auto")
+	if err == nil {
+		t.Fatal("expected outer archive to exceed 150 byte limit")
+	}
+	t.Setenv("CSQ_MAX_BYTES", "4096")
+	res, err = Run(context.Background(), path, "auto")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.SourceType != "archive" {
+		t.Fatalf("source type mismatch: %s", res.SourceType)
+	}
+	s := string(res.Text)
+	for _, want := range []string{"# notes/readme.txt\n\nPlain notes", "# report.docx\n\nDocx Heading", "# page.html\n\n## Web"} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("missing %q in:\n%s", want, s)
+		}
+	}
+	w := strings.Join(res.Warnings, "; ")
+	if !strings.Contains(w, "skipped member logo.bin") {
+		t.Fatalf("expected skipped binary member warning, got %s", w)
+	}
+}
+
+func TestRunArchiveTarGzMemberLimit(t *testing.T) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write(data)
+	}
+	add("a.md", []byte("# Alpha\n\nFirst member.\n"))
+	add("huge.txt", bytes.Repeat([]byte("y"), 5000))
+	add("b.txt", []byte("Second member.\n"))
+	_ = tw.Close()
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	_, _ = gw.Write(tarBuf.Bytes())
+	_ = gw.Close()
+
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(path, gzBuf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CSQ_MAX_BYTES", "4096")
+	res, err := Run(context.Background(), path, "auto")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !strings.Contains(strings.Join(res.Warnings, "; "), "skipped member huge.txt: exceeds max bytes limit (4096)") {
+		t.Fatalf("expected oversized member warning, got %v", res.Warnings)
+	}
+	s := string(res.Text)
+	if !strings.Contains(s, "# a.md\n\n# Alpha") || !strings.Contains(s, "# b.txt\n\nSecond member.") {
+		t.Fatalf("unexpected archive text:\n%s", s)
+	}
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	bomb := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(bomb)
+	w, _ := zw.Create("word/document.xml")
+	_, _ = w.Write([]byte(`<?xml version="1.0"?><w:document xmlns:w="x"><w:body><w:p><w:r><w:t>`))
+	_, _ = w.Write(bytes.Repeat([]byte("a"), 4<<20))
+	_, _ = w.Write([]byte(`</w:t></w:r></w:p></w:body></w:document>`))
+	_ = zw.Close()
+	_, _, err := ParseDOCX(bomb.Bytes())
+	var inputErr *InputError
+	if !errors.As(err, &inputErr) || !strings.Contains(err.Error(), "compression ratio") {
+		t.Fatalf("expected compression ratio input error, got %v", err)
+	}
+
+	t.Setenv("CSQ_MAX_BYTES", "1024")
+	t.Setenv("CSQ_MAX_COMPRESSION_RATIO", "100000")
+	_, _, err = ParseDOCX(bomb.Bytes())
+	if !errors.As(err, &inputErr) || !strings.Contains(err.Error(), "max bytes") {
+		t.Fatalf("expected max bytes input error, got %v", err)
+	}
+
+	many := bytes.NewBuffer(nil)
+	zw = zip.NewWriter(many)
+	for i := 0; i < 5; i++ {
+		w, _ := zw.Create(fmt.Sprintf("doc%d.txt", i))
+		_, _ = w.Write([]byte("member text\n"))
+	}
+	_ = zw.Close()
+	t.Setenv("CSQ_MAX_ARCHIVE_ENTRIES", "3")
+	_, err = ingestBytes(context.Background(), "many.zip", many.Bytes(), Options{}, newDecompressBudget(int64(len(many.Bytes()))), 0)
+	if !errors.As(err, &inputErr) || !strings.Contains(err.Error(), "entries") {
+		t.Fatalf("expected entry count input error, got %v", err)
+	}
+}
+
+func TestNestedArchivesShareLimits(t *testing.T) {
+	// Each inner zip inflates to 300 KB, within the 1 MB limit alone but not all together.
+	body := strings.Repeat("Nested member line.\n", 15000)
+	inner := make([][2]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		inner = append(inner, [2]string{fmt.Sprintf("inner%d.zip", i), string(makeZip(t, [2]string{"doc.txt", body}))})
+	}
+	outer := makeZip(t, inner...)
+	t.Setenv("CSQ_MAX_BYTES", "1048576")
+	if _, err := RunReader(context.Background(), "one.zip", bytes.NewReader(makeZip(t, inner[0])), Options{}); err != nil {
+		t.Fatalf("one nested archive: %v", err)
+	}
+	_, err := RunReader(context.Background(), "outer.zip", bytes.NewReader(outer), Options{})
+	var inputErr *InputError
+	if !errors.As(err, &inputErr) {
+		t.Fatalf("expected the nested archives to breach the input limit, got %v", err)
+	}
+
+	t.Setenv("CSQ_MAX_BYTES", "104857600")
+	t.Setenv("CSQ_MAX_ARCHIVE_ENTRIES", "8")
+	if _, err := RunReader(context.Background(), "outer.zip", bytes.NewReader(outer), Options{}); !errors.As(err, &inputErr) || !strings.Contains(err.Error(), "entries") {
+		t.Fatalf("expected the nested entries to breach the entry limit, got %v", err)
+	}
+}
+
+type wikiParser struct{}
+
+func (wikiParser) Name() string { return "wiki-export" }
+
+func (wikiParser) Sniff(path string, data []byte) (int, string) {
+	if bytes.HasPrefix(data, []byte("=WIKI=")) {
+		return format.ScoreMagic, "=WIKI= signature"
+	}
+	return format.ScoreNone, ""
+}
+
+func (wikiParser) Parse(_ context.Context, src format.Source) (format.Document, error) {
+	body := strings.TrimPrefix(string(src.Data), "=WIKI=\n")
+	return format.Document{Text: []byte(strings.ReplaceAll(body, "== ", "## "))}, nil
+}
+
+func TestRegisteredParser(t *testing.T) {
+	format.MustRegister(wikiParser{})
+	t.Cleanup(func() { format.Unregister(wikiParser{}.Name()) })
+	path := filepath.Join(t.TempDir(), "page.txt")
+	if err := os.WriteFile(path, []byte("=WIKI=\n== Intro\nWiki body.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(context.Background(), path, "auto")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.SourceType != "wiki-export" || string(res.Text) != "## Intro\nWiki body.\n" {
+		t.Fatalf("unexpected result: %s %q", res.SourceType, res.Text)
+	}
+	if got, err := DetectType("plain.md", []byte("x"), "wiki-export"); err != nil || got != "wiki-export" {
+		t.Fatalf("override by registered name failed: %s %v", got, err)
+	}
+}
+
+func makeZip(t *testing.T, members ...[2]string) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for _, m := range members {
+		w, err := zw.Create(m[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(m[1]))
+	}
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+func TestDetectZipContainers(t *testing.T) {
+	ct := func(main string) [2]string {
+		return [2]string{"[Content_Types].xml", `<Types><Override PartName="/x.xml" ContentType="application/vnd.openxmlformats-officedocument.` + main + `"/></Types>`}
+	}
+	cases := []struct {
+		want string
+		data []byte
+	}{
+		{"docx", makeZip(t, ct("wordprocessingml.document.main+xml"), [2]string{"word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Word body</w:t></w:r></w:p></w:body></w:document>`})},
+		{"pptx", makeZip(t, ct("presentationml.presentation.main+xml"),
+			[2]string{"ppt/slides/slide2.xml", `<p:sld><a:p><a:r><a:t>Second slide</a:t></a:r></a:p></p:sld>`},
+			[2]string{"ppt/slides/slide1.xml", `<p:sld><a:p><a:r><a:t>First slide</a:t></a:r></a:p></p:sld>`})},
+		{"xlsx", makeZip(t, ct("spreadsheetml.sheet.main+xml"), [2]string{"xl/sharedStrings.xml", `<sst><si><t>Region</t></si><si><r><t>North </t></r><r><t>East</t></r></si></sst>`})},
+		{"odt", makeZip(t, [2]string{"mimetype", "application/vnd.oasis.opendocument.text"},
+			[2]string{"content.xml", `<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"><office:body><office:text><text:h text:outline-level="2">Odt Title</text:h><text:p>Odt <text:span>body</text:span> text.</text:p></office:text></office:body></office:document-content>`})},
+		{"epub", makeZip(t, [2]string{"mimetype", "application/epub+zip"},
+			[2]string{"META-INF/container.xml", `<container><rootfiles><rootfile full-path="OEBPS/book.opf"/></rootfiles></container>`},
+			[2]string{"OEBPS/book.opf", `<package><manifest><item id="c2" href="ch2.xhtml"/><item id="c1" href="ch1.xhtml"/></manifest><spine><itemref idref="c1"/><itemref idref="c2"/></spine></package>`},
+			[2]string{"OEBPS/ch2.xhtml", `<html><body><p>Chapter two.</p></body></html>`},
+			[2]string{"OEBPS/ch1.xhtml", `<html><body><h1>Book</h1><p>Chapter one.</p></body></html>`})},
+		{"archive", makeZip(t, [2]string{"notes.txt", "plain notes"})},
+	}
+	for _, tc := range cases {
+		kind, det, err := Detect("upload-7f3a", tc.data, "auto")
+		if err != nil || kind != tc.want {
+			t.Fatalf("want %s, got %s (%v)", tc.want, kind, err)
+		}
+		if det.Confidence <= 0 || det.Reason == "" {
+			t.Fatalf("%s: missing detection detail: %+v", tc.want, det)
+		}
+	}
+
+	want := map[string]string{
+		"pptx": "## Slide 1\n\nFirst slide\n\n## Slide 2\n\nSecond slide",
+		"xlsx": "Region\nNorth East",
+		"odt":  "## Odt Title\n\nOdt body text.\n",
+		"epub": "# Book\n\nChapter one.\n\nChapter two.\n",
+	}
+	for _, tc := range cases {
+		exp, ok := want[tc.want]
+		if !ok {
+			continue
+		}
+		res, err := ingestBytes(context.Background(), "upload", tc.data, Options{}, newDecompressBudget(int64(len(tc.data))), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.want, err)
+		}
+		if string(res.Text) != exp {
+			t.Fatalf("%s: unexpected text %q", tc.want, res.Text)
+		}
+	}
+
+	ods := makeZip(t, [2]string{"mimetype", "application/vnd.oasis.opendocument.spreadsheet"}, [2]string{"content.xml", "<x/>"})
+	if _, _, err := Detect("upload", ods, "auto"); err == nil || !strings.Contains(err.Error(), "opendocument.spreadsheet") {
+		t.Fatalf("expected unsupported container error, got %v", err)
+	}
+}
+
+func TestDetectStructural(t *testing.T) {
+	cases := []struct {
+		want string
+		data string
+	}{
+		{"html", "\n<!DOCTYPE html><title>x</title><p>Body</p>"},
+		{"html", `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"><body>x</body></html>`},
+		{"xml", `<?xml version="1.0"?><catalog><item>Widget</item></catalog>`},
+		{"json", `{"title": "Report", "items": [1, 2]}`},
+		{"rtf", `{\rtf1\ansi{\fonttbl\f0 Arial;}\f0 Hello}`},
+		{"email", "From: a@example.com\r\nTo: b@example.com\r\nSubject: Hi\r\n\r\nBody\r\n"},
+		{"text", `{"not": json`},
+		{"text", "Subject: notes from the meeting\nWe agreed on the plan.\n"},
+	}
+	for _, tc := range cases {
+		if got, err := DetectType("upload", []byte(tc.data), "auto"); err != nil || got != tc.want {
+			t.Fatalf("%q: want %s, got %s (%v)", tc.data, tc.want, got, err)
+		}
+	}
+	if _, det, _ := Detect("notes.txt", []byte("hello"), "auto"); det.Reason != "file extension .txt" || det.Confidence != 0.6 {
+		t.Fatalf("unexpected extension detection: %+v", det)
+	}
+}
+
+func TestParseRTF(t *testing.T) {
+	raw := []byte(`{\rtf1\ansi{\fonttbl{\f0 Arial;}}{\*\generator Writer;}\f0\b Title\b0\par Caf\'e9 na\u239?ve \{ok\}\par}`)
+	got, _, err := ParseRTF(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Title\nCafé naïve {ok}\n" {
+		t.Fatalf("unexpected rtf text %q", got)
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	raw := "From: Ann <ann@example.com>\r\nTo: team@example.com\r\nSubject: =?UTF-8?Q?Q3_r=C3=A9view?=\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: multipart/alternative; boundary=b2\r\n\r\n" +
+		"--b2\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nNumbers are up =E2=80=94 see attached.\r\n" +
+		"--b2\r\nContent-Type: text/html\r\n\r\n<p>Numbers are up</p>\r\n--b2--\r\n" +
+		"--b1\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=q3.pdf\r\n\r\nJVBERi0=\r\n--b1--\r\n"
+	got, warnings, err := ParseEmail([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Q3 réview\n\nFrom: Ann <ann@example.com>\nTo: team@example.com\n\nNumbers are up — see attached.\n"
+	if string(got) != want {
+		t.Fatalf("unexpected email text %q", got)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "q3.pdf") {
+		t.Fatalf("expected attachment warning, got %v", warnings)
+	}
+}
+
+func TestRunReaderLimit(t *testing.T) {
+	res, err := RunReader(context.Background(), "", strings.NewReader("WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello there.\n"), Options{})
+	if err != nil || res.SourceType != "transcript" {
+		t.Fatalf("unexpected stdin result: %s %v", res.SourceType, err)
+	}
+	t.Setenv("CSQ_MAX_BYTES", "8")
+	if _, err := RunReader(context.Background(), "", strings.NewReader("more than eight bytes"), Options{}); err == nil || !strings.Contains(err.Error(), "max bytes") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+}
+
+func TestRunURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/article", http.StatusFound)
+	})
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "csq-test/1" {
+			http.Error(w, "bad agent", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=windows-1252")
+		_, _ = w.Write([]byte("<p>Caf\xe9 article body.</p>"))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 4096))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	fopts := FetchOptions{UserAgent: "csq-test/1", MaxRedirects: 2}
+	res, err := RunURL(context.Background(), srv.URL+"/old", Options{}, fopts)
+	if err != nil {
+		t.Fatalf("RunURL: %v", err)
+	}
+	if res.SourceType != "html" || res.SourceURL != srv.URL+"/article" || res.Detection.Reason != "content-type text/html" {
+		t.Fatalf("unexpected result: %s %s %+v", res.SourceType, res.SourceURL, res.Detection)
+	}
+	if !strings.Contains(string(res.Text), "Café article body.") {
+		t.Fatalf("charset not honoured: %q", res.Text)
+	}
+
+	if _, err := RunURL(context.Background(), srv.URL+"/loop", Options{}, fopts); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("expected redirect limit error, got %v", err)
+	}
+	if _, err := RunURL(context.Background(), srv.URL+"/old", Options{}, FetchOptions{MaxRedirects: 0}); err == nil || !strings.Contains(err.Error(), "redirects to /article") {
+		t.Fatalf("expected disabled redirect error, got %v", err)
+	}
+	var inputErr *InputError
+	if _, err := RunURL(context.Background(), srv.URL+"/big", Options{}, FetchOptions{MaxBytes: 1024}); !errors.As(err, &inputErr) {
+		t.Fatalf("expected size cap input error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := RunURL(ctx, srv.URL+"/slow", Options{}, FetchOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context deadline, got %v", err)
+	}
+}
+
+func TestSourceMaps(t *testing.T) {
+	pdf := []byte("%PDF-1.1\n3 0 obj << /Type /Page >> endobj\n4 0 obj stream\n(First page line) Tj\n(Also first) Tj\nendstream\n" +
+		"6 0 obj << /Type /Page >> endobj\n7 0 obj stream\n(Second page line) Tj\nendstream\n")
+	docx := makeDOCX()
+	html := []byte("<html><body>\n<h1>Title</h1>\n<div><p>One para.</p><p>Two <b>bold</b> para.</p></div>\n</body></html>")
+	text := []byte("alpha line\n\nbeta line\ngamma line\n")
+	cases := []struct {
+		name string
+		data []byte
+		find string
+		want format.Location
+	}{
+		{"doc.pdf", pdf, "Second page line", format.Location{Page: 2}},
+		{"doc.pdf", pdf, "Also first", format.Location{Page: 1}},
+		{"doc.docx", docx, "Paragraph", format.Location{Paragraph: 2}},
+		{"doc.html", html, "Two bold para.", format.Location{Line: 3, Element: "/html[1]/body[1]/div[1]/p[2]"}},
+		{"doc.txt", text, "gamma line", format.Location{Line: 4}},
+	}
+	for _, tc := range cases {
+		res, err := ingestBytes(context.Background(), tc.name, tc.data, Options{}, newDecompressBudget(int64(len(tc.data))), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		at := bytes.Index(res.Text, []byte(tc.find))
+		if at < 0 {
+			t.Fatalf("%s: %q not in %q", tc.name, tc.find, res.Text)
+		}
+		if loc, ok := format.Locate(res.SourceMap, at); !ok || loc != tc.want {
+			t.Fatalf("%s: %q located at %+v, want %+v", tc.name, tc.find, loc, tc.want)
+		}
+	}
+
+	bundle := makeZip(t, [2]string{"a/notes.txt", "\u00a0first\nsecond line\n"}, [2]string{"b.html", string(html)})
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := os.WriteFile(path, bundle, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(context.Background(), path, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for find, want := range map[string]format.Location{
+		"second line": {File: "a/notes.txt", Line: 2},
+		"One para.":   {File: "b.html", Line: 3, Element: "/html[1]/body[1]/div[1]/p[1]"},
+	} {
+		at := bytes.Index(res.Text, []byte(find))
+		if loc, ok := format.Locate(res.SourceMap, at); at < 0 || !ok || loc != want {
+			t.Fatalf("archive %q located at %+v, want %+v", find, loc, want)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	pdf := bytes.Replace(makePDF(), []byte("trailer << /Root 1 0 R"), []byte("6 0 obj << /Title (Quarterly \\(Q3\\) Report) /Author (Ann Lee) /CreationDate (D:20240301100000+01'00') >> endobj\ntrailer << /Info 6 0 R /Root 1 0 R"), 1)
+	docx := makeZip(t,
+		[2]string{"word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Body</w:t></w:r></w:p></w:body></w:document>`},
+		[2]string{"docProps/core.xml", `<cp:coreProperties xmlns:cp="x" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/"><dc:title>Plan</dc:title><dc:creator>Bo</dc:creator><dcterms:created>2023-11-05T08:30:00Z</dcterms:created><dc:language>en-GB</dc:language></cp:coreProperties>`},
+		[2]string{"docProps/app.xml", `<Properties><Pages>7</Pages></Properties>`})
+	page := `<!DOCTYPE html><html lang="fr"><head><title>Le &amp; titre</title><meta name="author" content="Cé"><meta property="article:published_time" content="2022-02-01"></head><body><p>Texte</p></body></html>`
+	mail := "From: Ann <ann@example.com>\r\nSubject: Status\r\nDate: Tue, 5 Mar 2024 09:00:00 -0500\r\n\r\nAll good.\r\n"
+	cases := []struct {
+		name string
+		raw  []byte
+		want format.Metadata
+	}{
+		{"in.pdf", pdf, format.Metadata{Title: "Quarterly (Q3) Report", Author: "Ann Lee", Created: "2024-03-01T09:00:00Z", Pages: 1}},
+		{"in.docx", docx, format.Metadata{Title: "Plan", Author: "Bo", Created: "2023-11-05T08:30:00Z", Pages: 7, Language: "en-GB"}},
+		{"in.html", []byte(page), format.Metadata{Title: "Le & titre", Author: "Cé", Created: "2022-02-01T00:00:00Z", Language: "fr"}},
+		{"in.eml", []byte(mail), format.Metadata{Title: "Status", Author: "Ann <ann@example.com>", Created: "2024-03-05T14:00:00Z"}},
+		{"in.txt", []byte("plain words\n"), format.Metadata{}},
+	}
+	for _, tc := range cases {
+		res, err := runBytes(context.Background(), tc.name, tc.raw, Options{})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.Metadata != tc.want {
+			t.Fatalf("%s: got %+v want %+v", tc.name, res.Metadata, tc.want)
+		}
+	}
+}
+
+func TestInferHeadings(t *testing.T) {
+	in := "Project Plan\n============\nIntro text.\n\nBackground\n----------\nMore text.\n\n2.3 Scope of Work\nDetails.\n\nRESULTS AND FINDINGS\nAll good.\n\n" +
+		"1. Buy milk\n2. Eat cake\n\nNOTE: keep this line.\n\n```\nCODE BLOCK\n```\n\n# Already a heading\n"
+	want := "# Project Plan\nIntro text.\n\n## Background\nMore text.\n\n## 2.3 Scope of Work\nDetails.\n\n# RESULTS AND FINDINGS\nAll good.\n\n" +
+		"1. Buy milk\n2. Eat cake\n\nNOTE: keep this line.\n\n```\nCODE BLOCK\n```\n\n# Already a heading\n"
+	if got := string(InferHeadings([]byte(in))); got != want {
+		t.Fatalf("unexpected headings:\n%s", got)
+	}
+
+	res, err := runBytes(context.Background(), "plan.txt", []byte(in), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := bytes.Index(res.Text, []byte("## 2.3"))
+	if loc, ok := format.Locate(res.SourceMap, scope); !ok || loc.Line != 9 {
+		t.Fatalf("heading not mapped to source line 9: %+v", loc)
+	}
+	res, err = runBytes(context.Background(), "plan.txt", []byte(in), Options{NoHeadings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Text) != in {
+		t.Fatalf("inference not disabled: %q", res.Text)
+	}
+
+	plain := "这是一个测试文档的内容\n\n1. Only item\n\n3) Another item\n\n结论如下！\n\n总结。\n\nAPI 设计文档\n"
+	if got := string(InferHeadings([]byte(plain))); got != plain {
+		t.Fatalf("list items or caseless text promoted:\n%s", got)
+	}
+}
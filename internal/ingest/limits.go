@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"contextsqueezer/pkg/format"
+)
+
+const (
+	defaultMaxCompressionRatio = 100
+	defaultMaxArchiveEntries   = 10000
+	// ratioFloorBytes lets tiny, highly repetitive entries through the ratio check.
+	ratioFloorBytes = 1 << 20
+)
+
+// InputError marks input that was rejected by a safety limit rather than failing to parse.
+type InputError struct {
+	Reason string
+}
+
+func (e *InputError) Error() string { return "input rejected: " + e.Reason }
+
+func envLimit(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// decompressBudget bounds what may be inflated out of one input, across every container nested
+// in it: total decompressed bytes (CSQ_MAX_BYTES), compression ratio (CSQ_MAX_COMPRESSION_RATIO)
+// per entry and for the input as a whole, and the number of entries (CSQ_MAX_ARCHIVE_ENTRIES).
+// It is the format.Budget of the built-in parsers.
+type decompressBudget struct {
+	maxBytes   int64
+	maxRatio   int64
+	maxEntries int
+	compressed int64
+	used       int64
+	entries    int
+}
+
+func newDecompressBudget(compressed int64) *decompressBudget {
+	return &decompressBudget{
+		maxBytes:   maxBytes(),
+		maxRatio:   envLimit("CSQ_MAX_COMPRESSION_RATIO", defaultMaxCompressionRatio),
+		maxEntries: int(envLimit("CSQ_MAX_ARCHIVE_ENTRIES", defaultMaxArchiveEntries)),
+		compressed: compressed,
+	}
+}
+
+func (b *decompressBudget) ratioAllowance(compressed int64) int64 {
+	if compressed <= 0 {
+		return ratioFloorBytes
+	}
+	if compressed > (1<<62)/b.maxRatio {
+		return 1 << 62
+	}
+	allow := compressed * b.maxRatio
+	if allow < ratioFloorBytes {
+		return ratioFloorBytes
+	}
+	return allow
+}
+
+// Entries fails when n entries on top of those already read exceed the limit.
+func (b *decompressBudget) Entries(n int) error {
+	if n += b.entries; n > b.maxEntries {
+		return &InputError{Reason: fmt.Sprintf("input has %d entries, limit is %d; set CSQ_MAX_ARCHIVE_ENTRIES to override", n, b.maxEntries)}
+	}
+	return nil
+}
+
+// Inflate reads one entry. compressed is the entry's stored size, or 0 when unknown.
+func (b *decompressBudget) Inflate(name string, r io.Reader, compressed int64) ([]byte, error) {
+	if err := b.Entries(1); err != nil {
+		return nil, err
+	}
+	b.entries++
+	limit := b.maxBytes - b.used
+	reason := fmt.Sprintf("decompressed size exceeds max bytes limit (%d); set CSQ_MAX_BYTES to override", b.maxBytes)
+	if allow := b.ratioAllowance(compressed); compressed > 0 && allow < limit {
+		limit = allow
+		reason = fmt.Sprintf("%s expands beyond compression ratio limit (%d:1); set CSQ_MAX_COMPRESSION_RATIO to override", name, b.maxRatio)
+	}
+	if allow := b.ratioAllowance(b.compressed) - b.used; allow < limit {
+		limit = allow
+		reason = fmt.Sprintf("input expands beyond compression ratio limit (%d:1); set CSQ_MAX_COMPRESSION_RATIO to override", b.maxRatio)
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	data, err := io.ReadAll(&io.LimitedReader{R: r, N: limit + 1})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &InputError{Reason: reason}
+	}
+	b.used += int64(len(data))
+	return data, nil
+}
+
+// budgetFor returns the budget src spends from, or a fresh one for src.Data alone when the
+// caller did not pass one.
+func budgetFor(src format.Source) format.Budget {
+	if src.Budget != nil {
+		return src.Budget
+	}
+	return newDecompressBudget(int64(len(src.Data)))
+}
+
+func openZip(budget format.Budget, raw []byte) (*zip.Reader, error) {
+	r, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return nil, err
+	}
+	if err := budget.Entries(len(r.File)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func readZipFile(budget format.Budget, f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return budget.Inflate(f.Name, rc, int64(f.CompressedSize64))
+}
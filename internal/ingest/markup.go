@@ -0,0 +1,158 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// rtfSkipDestinations are groups whose content is formatting tables or metadata, not text.
+var rtfSkipDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"header": true, "footer": true, "listtable": true, "listoverridetable": true, "themedata": true,
+	"datastore": true, "latentstyles": true, "rsidtbl": true, "generator": true, "xmlnstbl": true,
+}
+
+// ParseXML keeps the character data of every element, one element per line.
+func ParseXML(raw []byte) ([]byte, []string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	dec.Strict = false
+	lines := make([]string, 0)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse xml: %w", err)
+		}
+		if cd, ok := tok.(xml.CharData); ok {
+			if t := strings.Join(strings.Fields(string(cd)), " "); t != "" {
+				lines = append(lines, t)
+			}
+		}
+	}
+	warnings := []string{}
+	if len(lines) == 0 {
+		warnings = append(warnings, "xml extraction produced no text")
+		return []byte{}, warnings, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), warnings, nil
+}
+
+// ParseJSON passes documents through as text after checking they are well formed; the
+// structure itself is what the reader needs to see.
+func ParseJSON(raw []byte) ([]byte, []string, error) {
+	if !json.Valid(raw) {
+		return nil, nil, errors.New("invalid json document")
+	}
+	return ParseText(raw)
+}
+
+// ParseRTF strips control words and skippable destinations, keeping paragraph breaks and
+// decoding \'hh (Windows-1252) and \uN escapes.
+func ParseRTF(raw []byte) ([]byte, []string, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`{\rtf`)) {
+		return nil, nil, errors.New("invalid rtf header")
+	}
+	var b strings.Builder
+	type group struct{ skip bool }
+	stack := []group{{}}
+	skipping := func() bool { return stack[len(stack)-1].skip }
+	ucSkip := 1
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch c {
+		case '{':
+			stack = append(stack, group{skip: skipping()})
+			if i+2 < len(raw) && raw[i+1] == '\\' && raw[i+2] == '*' {
+				stack[len(stack)-1].skip = true
+			}
+		case '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case '\r', '\n':
+		case '\\':
+			if i+1 >= len(raw) {
+				break
+			}
+			n := raw[i+1]
+			switch {
+			case n == '\\' || n == '{' || n == '}':
+				if !skipping() {
+					b.WriteByte(n)
+				}
+				i++
+			case n == '\'':
+				if i+3 < len(raw) {
+					if v, err := strconv.ParseUint(string(raw[i+2:i+4]), 16, 8); err == nil && !skipping() {
+						b.Write(decodeSingleByte([]byte{byte(v)}, "windows-1252"))
+					}
+				}
+				i += 3
+			case isASCIILetter(n):
+				j := i + 1
+				for j < len(raw) && isASCIILetter(raw[j]) {
+					j++
+				}
+				word := string(raw[i+1 : j])
+				k := j
+				if k < len(raw) && raw[k] == '-' {
+					k++
+				}
+				for k < len(raw) && raw[k] >= '0' && raw[k] <= '9' {
+					k++
+				}
+				param := string(raw[j:k])
+				if k < len(raw) && raw[k] == ' ' {
+					k++
+				}
+				i = k - 1
+				if rtfSkipDestinations[word] {
+					stack[len(stack)-1].skip = true
+				}
+				if skipping() {
+					continue
+				}
+				switch word {
+				case "par", "line", "sect", "page":
+					b.WriteByte('\n')
+				case "tab", "cell":
+					b.WriteByte('\t')
+				case "row":
+					b.WriteByte('\n')
+				case "uc":
+					ucSkip, _ = strconv.Atoi(param)
+				case "u":
+					if v, err := strconv.Atoi(param); err == nil {
+						if v < 0 {
+							v += 65536
+						}
+						b.WriteRune(rune(v))
+						i += ucSkip
+					}
+				}
+			default:
+				i++
+			}
+		default:
+			if !skipping() {
+				b.WriteByte(c)
+			}
+		}
+	}
+	text := collapseWhitespace(b.String())
+	warnings := []string{}
+	if strings.TrimSpace(text) == "" {
+		warnings = append(warnings, "rtf extraction produced no text")
+	}
+	return []byte(text), warnings, nil
+}
+
+func isASCIILetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
@@ -0,0 +1,300 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"contextsqueezer/pkg/format"
+)
+
+var (
+	rePDFInfoField = regexp.MustCompile(`/(Title|Author|CreationDate|Lang)\s*\(((?:[^()\\]|\\.)*)\)`)
+	reHTMLTitle    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	reHTMLLang     = regexp.MustCompile(`(?is)<html[^>]*\blang\s*=\s*["']?([A-Za-z0-9-]+)`)
+	reHTMLMeta     = regexp.MustCompile(`(?is)<meta\b[^>]*>`)
+	reHTMLAttr     = regexp.MustCompile(`(?is)\b(name|property|http-equiv|content)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+
+	metadataDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", time.RFC1123Z, time.RFC1123}
+)
+
+// normalizeDate converts the date spellings found in document properties to RFC 3339,
+// returning the input unchanged when no layout matches.
+func normalizeDate(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "D:") {
+		return pdfDate(s[2:])
+	}
+	for _, layout := range metadataDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	if t, err := mail.ParseDate(s); err == nil {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// pdfDate parses D:YYYYMMDDHHmmSSOHH'mm' where everything after the year is optional.
+func pdfDate(s string) string {
+	digits := s
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			digits = s[:i]
+			break
+		}
+	}
+	if len(digits) < 4 {
+		return "D:" + s
+	}
+	const template = "00000101000000"
+	if len(digits) > len(template) {
+		digits = digits[:len(template)]
+	}
+	t, err := time.Parse("20060102150405", digits+template[len(digits):])
+	if err != nil {
+		return "D:" + s
+	}
+	rest := s[len(digits):]
+	if len(rest) >= 3 && (rest[0] == '+' || rest[0] == '-') {
+		h, _ := strconv.Atoi(rest[1:3])
+		m := 0
+		if len(rest) >= 6 {
+			m, _ = strconv.Atoi(strings.Trim(rest[3:6], "'"))
+		}
+		offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+		if rest[0] == '+' {
+			t = t.Add(-offset)
+		} else {
+			t = t.Add(offset)
+		}
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func pdfMetadata(raw []byte, _ format.Budget) format.Metadata {
+	md := format.Metadata{Pages: len(rePDFPage.FindAllIndex(raw, -1))}
+	for _, m := range rePDFInfoField.FindAllSubmatch(raw, -1) {
+		v := strings.TrimSpace(pdfUnescape(m[2]))
+		switch string(m[1]) {
+		case "Title":
+			md.Title = v
+		case "Author":
+			md.Author = v
+		case "CreationDate":
+			md.Created = normalizeDate(v)
+		case "Lang":
+			md.Language = v
+		}
+	}
+	return md
+}
+
+func pdfUnescape(b []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			i++
+			switch b[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(b[i])
+			}
+			continue
+		}
+		sb.WriteByte(b[i])
+	}
+	return sb.String()
+}
+
+// ooxmlMetadata reads docProps/core.xml and the page or slide count from docProps/app.xml.
+func ooxmlMetadata(raw []byte, budget format.Budget) format.Metadata {
+	md := format.Metadata{}
+	byName, _, err := openContainer(raw, "ooxml", budget)
+	if err != nil {
+		return md
+	}
+	if f, ok := byName["docProps/core.xml"]; ok {
+		if data, err := readZipFile(budget, f); err == nil {
+			var core struct {
+				Title    string `xml:"title"`
+				Creator  string `xml:"creator"`
+				Created  string `xml:"created"`
+				Language string `xml:"language"`
+			}
+			if xml.Unmarshal(data, &core) == nil {
+				md.Title = strings.TrimSpace(core.Title)
+				md.Author = strings.TrimSpace(core.Creator)
+				if core.Created != "" {
+					md.Created = normalizeDate(core.Created)
+				}
+				md.Language = strings.TrimSpace(core.Language)
+			}
+		}
+	}
+	if f, ok := byName["docProps/app.xml"]; ok {
+		if data, err := readZipFile(budget, f); err == nil {
+			var app struct {
+				Pages  int `xml:"Pages"`
+				Slides int `xml:"Slides"`
+			}
+			if xml.Unmarshal(data, &app) == nil {
+				md.Pages = max(app.Pages, app.Slides)
+			}
+		}
+	}
+	return md
+}
+
+func odtMetadata(raw []byte, budget format.Budget) format.Metadata {
+	md := format.Metadata{}
+	byName, _, err := openContainer(raw, "odt", budget)
+	if err != nil {
+		return md
+	}
+	f, ok := byName["meta.xml"]
+	if !ok {
+		return md
+	}
+	data, err := readZipFile(budget, f)
+	if err != nil {
+		return md
+	}
+	var doc struct {
+		Meta struct {
+			Title    string `xml:"title"`
+			Creator  string `xml:"initial-creator"`
+			Created  string `xml:"creation-date"`
+			Language string `xml:"language"`
+			Stats    struct {
+				Pages int `xml:"page-count,attr"`
+			} `xml:"document-statistic"`
+		} `xml:"meta"`
+	}
+	if xml.Unmarshal(data, &doc) != nil {
+		return md
+	}
+	md = format.Metadata{
+		Title:    strings.TrimSpace(doc.Meta.Title),
+		Author:   strings.TrimSpace(doc.Meta.Creator),
+		Pages:    doc.Meta.Stats.Pages,
+		Language: strings.TrimSpace(doc.Meta.Language),
+	}
+	if doc.Meta.Created != "" {
+		md.Created = normalizeDate(doc.Meta.Created)
+	}
+	return md
+}
+
+func epubMetadata(raw []byte, budget format.Budget) format.Metadata {
+	md := format.Metadata{}
+	byName, _, err := openContainer(raw, "epub", budget)
+	if err != nil {
+		return md
+	}
+	opf := ""
+	if f, ok := byName["META-INF/container.xml"]; ok {
+		if data, err := readZipFile(budget, f); err == nil {
+			var c struct {
+				Rootfiles []struct {
+					FullPath string `xml:"full-path,attr"`
+				} `xml:"rootfiles>rootfile"`
+			}
+			if xml.Unmarshal(data, &c) == nil && len(c.Rootfiles) > 0 {
+				opf = c.Rootfiles[0].FullPath
+			}
+		}
+	}
+	f, ok := byName[opf]
+	if !ok {
+		return md
+	}
+	data, err := readZipFile(budget, f)
+	if err != nil {
+		return md
+	}
+	var pkg struct {
+		Title    string `xml:"metadata>title"`
+		Creator  string `xml:"metadata>creator"`
+		Date     string `xml:"metadata>date"`
+		Language string `xml:"metadata>language"`
+	}
+	if xml.Unmarshal(data, &pkg) != nil {
+		return md
+	}
+	md = format.Metadata{Title: strings.TrimSpace(pkg.Title), Author: strings.TrimSpace(pkg.Creator), Language: strings.TrimSpace(pkg.Language)}
+	if pkg.Date != "" {
+		md.Created = normalizeDate(pkg.Date)
+	}
+	return md
+}
+
+func htmlMetadata(raw []byte, _ format.Budget) format.Metadata {
+	md := format.Metadata{}
+	if m := reHTMLTitle.FindSubmatch(raw); m != nil {
+		md.Title = strings.Join(strings.Fields(html.UnescapeString(reTag.ReplaceAllString(string(m[1]), " "))), " ")
+	}
+	if m := reHTMLLang.FindSubmatch(raw); m != nil {
+		md.Language = string(m[1])
+	}
+	for _, tag := range reHTMLMeta.FindAll(raw, -1) {
+		attrs := map[string]string{}
+		for _, a := range reHTMLAttr.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(a[1]))] = html.UnescapeString(strings.Trim(string(a[2]), `"'`))
+		}
+		key := strings.ToLower(attrs["name"] + attrs["property"] + attrs["http-equiv"])
+		v := strings.TrimSpace(attrs["content"])
+		if v == "" {
+			continue
+		}
+		switch key {
+		case "author", "article:author", "dc.creator", "dcterms.creator":
+			if md.Author == "" {
+				md.Author = v
+			}
+		case "date", "article:published_time", "dc.date", "dcterms.created":
+			if md.Created == "" {
+				md.Created = normalizeDate(v)
+			}
+		case "og:title", "dc.title":
+			if md.Title == "" {
+				md.Title = v
+			}
+		case "content-language", "dc.language":
+			if md.Language == "" {
+				md.Language = v
+			}
+		}
+	}
+	return md
+}
+
+func emailMetadata(raw []byte, _ format.Budget) format.Metadata {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return format.Metadata{}
+	}
+	dec := new(mime.WordDecoder)
+	header := func(k string) string {
+		v := msg.Header.Get(k)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			return d
+		}
+		return v
+	}
+	md := format.Metadata{Title: header("Subject"), Author: header("From"), Language: msg.Header.Get("Content-Language")}
+	if t, err := msg.Header.Date(); err == nil {
+		md.Created = t.UTC().Format(time.RFC3339)
+	}
+	return md
+}
@@ -0,0 +1,311 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"contextsqueezer/pkg/format"
+)
+
+const odfTextNS = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+
+var slideNumber = strings.NewReplacer("ppt/slides/slide", "", ".xml", "")
+
+// openContainer opens a zip-based document under budget and indexes its members by name.
+func openContainer(raw []byte, kind string, budget format.Budget) (map[string]*zip.File, []*zip.File, error) {
+	r, err := openZip(budget, raw)
+	if err != nil {
+		var inputErr *InputError
+		if errors.As(err, &inputErr) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("parse %s container: %w", kind, err)
+	}
+	byName := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		byName[f.Name] = f
+	}
+	return byName, r.File, nil
+}
+
+func ParsePPTX(raw []byte) ([]byte, []string, error) {
+	return parsePPTX(raw, newDecompressBudget(int64(len(raw))))
+}
+
+func parsePPTX(raw []byte, budget format.Budget) ([]byte, []string, error) {
+	_, files, err := openContainer(raw, "pptx", budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	type slide struct {
+		n int
+		f *zip.File
+	}
+	slides := make([]slide, 0)
+	for _, f := range files {
+		if path.Dir(f.Name) != "ppt/slides" || path.Ext(f.Name) != ".xml" {
+			continue
+		}
+		if n, err := strconv.Atoi(slideNumber.Replace(f.Name)); err == nil {
+			slides = append(slides, slide{n: n, f: f})
+		}
+	}
+	if len(slides) == 0 {
+		return nil, nil, errors.New("pptx contains no slides")
+	}
+	sort.Slice(slides, func(i, j int) bool { return slides[i].n < slides[j].n })
+	var b strings.Builder
+	for _, s := range slides {
+		data, err := readZipFile(budget, s.f)
+		if err != nil {
+			return nil, nil, err
+		}
+		text := strings.TrimSpace(extractDocxXMLText(data))
+		if text == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "## Slide %d\n\n%s", s.n, text)
+	}
+	warnings := []string{}
+	if b.Len() == 0 {
+		warnings = append(warnings, "pptx slides contained no text")
+	}
+	return []byte(b.String()), warnings, nil
+}
+
+// ParseXLSX extracts the shared string table, which holds the text cells of a workbook;
+// numbers and formulas are not useful context and are skipped.
+func ParseXLSX(raw []byte) ([]byte, []string, error) {
+	return parseXLSX(raw, newDecompressBudget(int64(len(raw))))
+}
+
+func parseXLSX(raw []byte, budget format.Budget) ([]byte, []string, error) {
+	byName, _, err := openContainer(raw, "xlsx", budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, ok := byName["xl/sharedStrings.xml"]
+	if !ok {
+		return []byte{}, []string{"xlsx has no shared strings; nothing to extract"}, nil
+	}
+	data, err := readZipFile(budget, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	var root xmlNode
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, nil, fmt.Errorf("parse xlsx shared strings: %w", err)
+	}
+	lines := make([]string, 0, len(root.Nodes))
+	for _, si := range root.Nodes {
+		var sb strings.Builder
+		var gather func(xmlNode)
+		gather = func(x xmlNode) {
+			if x.XMLName.Local == "t" {
+				sb.WriteString(x.Content)
+			}
+			for _, c := range x.Nodes {
+				gather(c)
+			}
+		}
+		gather(si)
+		if t := strings.Join(strings.Fields(sb.String()), " "); t != "" {
+			lines = append(lines, t)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), []string{"xlsx extraction includes text cells only"}, nil
+}
+
+// ParseODT walks content.xml in document order, turning text:h into markdown headings and
+// text:p into paragraphs.
+func ParseODT(raw []byte) ([]byte, []string, error) {
+	return parseODT(raw, newDecompressBudget(int64(len(raw))))
+}
+
+func parseODT(raw []byte, budget format.Budget) ([]byte, []string, error) {
+	byName, _, err := openContainer(raw, "odt", budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, ok := byName["content.xml"]
+	if !ok {
+		return nil, nil, errors.New("odt missing content.xml")
+	}
+	data, err := readZipFile(budget, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	paras := make([]string, 0)
+	var cur strings.Builder
+	prefix := ""
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse odt content: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space != odfTextNS {
+				continue
+			}
+			switch t.Name.Local {
+			case "h", "p":
+				if depth == 0 {
+					cur.Reset()
+					prefix = ""
+					if t.Name.Local == "h" {
+						level := 1
+						for _, a := range t.Attr {
+							if a.Name.Local == "outline-level" {
+								if n, err := strconv.Atoi(a.Value); err == nil && n >= 1 && n <= 6 {
+									level = n
+								}
+							}
+						}
+						prefix = strings.Repeat("#", level) + " "
+					}
+				}
+				depth++
+			case "s", "tab", "line-break":
+				cur.WriteByte(' ')
+			}
+		case xml.EndElement:
+			if t.Name.Space != odfTextNS || (t.Name.Local != "h" && t.Name.Local != "p") || depth == 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				if p := strings.Join(strings.Fields(cur.String()), " "); p != "" {
+					paras = append(paras, prefix+p)
+				}
+			}
+		case xml.CharData:
+			if depth > 0 {
+				cur.Write(t)
+			}
+		}
+	}
+	if len(paras) == 0 {
+		return []byte{}, []string{"odt contained no text"}, nil
+	}
+	return []byte(strings.Join(paras, "\n\n") + "\n"), nil, nil
+}
+
+// ParseEPUB follows the package spine from META-INF/container.xml and extracts each chapter
+// as html. Books without a readable spine fall back to every xhtml member in zip order.
+func ParseEPUB(raw []byte) ([]byte, []string, error) {
+	return parseEPUB(raw, newDecompressBudget(int64(len(raw))))
+}
+
+func parseEPUB(raw []byte, budget format.Budget) ([]byte, []string, error) {
+	byName, files, err := openContainer(raw, "epub", budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings := []string{}
+	chapters, err := epubSpine(budget, byName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(chapters) == 0 {
+		warnings = append(warnings, "epub spine not found; using xhtml members in archive order")
+		for _, f := range files {
+			switch strings.ToLower(path.Ext(f.Name)) {
+			case ".xhtml", ".html", ".htm":
+				chapters = append(chapters, f)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, f := range chapters {
+		data, err := readZipFile(budget, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		text, _, _ := ParseHTML(data)
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.Write(text)
+	}
+	if b.Len() == 0 {
+		warnings = append(warnings, "epub contained no text")
+		return []byte{}, warnings, nil
+	}
+	b.WriteByte('\n')
+	return []byte(b.String()), warnings, nil
+}
+
+func epubSpine(budget format.Budget, byName map[string]*zip.File) ([]*zip.File, error) {
+	cf, ok := byName["META-INF/container.xml"]
+	if !ok {
+		return nil, nil
+	}
+	data, err := readZipFile(budget, cf)
+	if err != nil {
+		return nil, err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if xml.Unmarshal(data, &container) != nil || len(container.Rootfiles) == 0 {
+		return nil, nil
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	of, ok := byName[opfPath]
+	if !ok {
+		return nil, nil
+	}
+	if data, err = readZipFile(budget, of); err != nil {
+		return nil, err
+	}
+	var pkg struct {
+		Items []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Refs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if xml.Unmarshal(data, &pkg) != nil {
+		return nil, nil
+	}
+	hrefs := make(map[string]string, len(pkg.Items))
+	for _, it := range pkg.Items {
+		hrefs[it.ID] = it.Href
+	}
+	chapters := make([]*zip.File, 0, len(pkg.Refs))
+	for _, ref := range pkg.Refs {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		if f, ok := byName[path.Join(path.Dir(opfPath), href)]; ok {
+			chapters = append(chapters, f)
+		}
+	}
+	return chapters, nil
+}
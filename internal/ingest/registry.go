@@ -0,0 +1,145 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+
+	"contextsqueezer/pkg/format"
+)
+
+const scoreFallback = 1
+
+// builtinParser scores by content first and falls back to the file extension, so renamed or
+// extensionless uploads still reach the right parser.
+type builtinParser struct {
+	name string
+	exts []string
+	// container is the zip container kind that identifies the format, if any.
+	container string
+	sniff     func(data []byte) (int, string)
+	// parse and meta inflate containers from the input's budget.
+	parse func(raw []byte, budget format.Budget) ([]byte, []string, error)
+	// locate builds the source map for parsed text; nil leaves it to the line matcher.
+	locate func(raw, text []byte) []format.SourceSpan
+	meta   func(raw []byte, budget format.Budget) format.Metadata
+}
+
+// plain adapts a parser that inflates nothing.
+func plain(parse func(raw []byte) ([]byte, []string, error)) func([]byte, format.Budget) ([]byte, []string, error) {
+	return func(raw []byte, _ format.Budget) ([]byte, []string, error) { return parse(raw) }
+}
+
+func (p builtinParser) Name() string { return p.name }
+
+// kindSniffer is a parser that can reuse the zip container kind Detect found for data instead
+// of reading the central directory again.
+type kindSniffer interface {
+	sniffKind(path string, data []byte, zk zipKind) (int, string)
+}
+
+func (p builtinParser) Sniff(path string, data []byte) (int, string) {
+	return p.sniffKind(path, data, zipContainerKind(data))
+}
+
+func (p builtinParser) sniffKind(path string, data []byte, zk zipKind) (int, string) {
+	score, reason := format.ScoreNone, ""
+	switch {
+	case p.container != "" && zk.kind == p.container:
+		score, reason = format.ScoreMagic, zk.reason
+	case p.sniff != nil:
+		score, reason = p.sniff(data)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range p.exts {
+		if ext == e && score < format.ScoreExtension {
+			return format.ScoreExtension, "file extension " + ext
+		}
+	}
+	return score, reason
+}
+
+func (p builtinParser) Parse(_ context.Context, src format.Source) (format.Document, error) {
+	budget := budgetFor(src)
+	text, warnings, err := p.parse(src.Data, budget)
+	if err != nil {
+		return format.Document{}, err
+	}
+	doc := format.Document{Text: text, Warnings: warnings}
+	if p.locate != nil {
+		doc.SourceMap = p.locate(src.Data, text)
+	}
+	if p.meta != nil {
+		doc.Metadata = p.meta(src.Data, budget)
+	}
+	return doc, nil
+}
+
+type archiveParser struct{}
+
+func (archiveParser) Name() string { return "archive" }
+
+func (p archiveParser) Sniff(path string, data []byte) (int, string) {
+	return p.sniffKind(path, data, zipContainerKind(data))
+}
+
+func (archiveParser) sniffKind(path string, data []byte, zk zipKind) (int, string) {
+	switch {
+	case isGzip(data):
+		return format.ScoreMagic, "gzip signature"
+	case isTar(data):
+		return format.ScoreMagic, "tar ustar header"
+	case !hasZipMagic(data):
+		return format.ScoreNone, ""
+	}
+	if zk.kind != "" {
+		return format.ScoreNone, ""
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".zip" {
+		return format.ScoreMagic, "zip signature and .zip extension"
+	}
+	return format.ScoreStructure, "zip signature without a document manifest"
+}
+
+func (archiveParser) Parse(ctx context.Context, src format.Source) (format.Document, error) {
+	return parseArchive(ctx, src.Name, src.Data, budgetFor(src), src.Nested)
+}
+
+func hasZipMagic(data []byte) bool { return bytes.HasPrefix(data, []byte{'P', 'K', 0x03, 0x04}) }
+
+func sniffPrefix(prefix, reason string) func([]byte) (int, string) {
+	return func(data []byte) (int, string) {
+		if bytes.HasPrefix(sniffHead(data), []byte(prefix)) {
+			return format.ScoreMagic, reason
+		}
+		return format.ScoreNone, ""
+	}
+}
+
+func init() {
+	format.MustRegister(builtinParser{name: "pdf", exts: []string{".pdf"}, parse: plain(ParsePDF), locate: pdfSourceMap, meta: pdfMetadata, sniff: sniffPrefix("%PDF-", "pdf signature")})
+	format.MustRegister(builtinParser{name: "docx", exts: []string{".docx"}, parse: parseDOCX, locate: paragraphSourceMap, meta: ooxmlMetadata, container: "docx"})
+	format.MustRegister(builtinParser{name: "pptx", exts: []string{".pptx"}, parse: parsePPTX, locate: slideSourceMap, meta: ooxmlMetadata, container: "pptx"})
+	format.MustRegister(builtinParser{name: "xlsx", exts: []string{".xlsx"}, parse: parseXLSX, meta: ooxmlMetadata, container: "xlsx"})
+	format.MustRegister(builtinParser{name: "odt", exts: []string{".odt"}, parse: parseODT, locate: paragraphSourceMap, meta: odtMetadata, container: "odt"})
+	format.MustRegister(builtinParser{name: "epub", exts: []string{".epub"}, parse: parseEPUB, meta: epubMetadata, container: "epub"})
+	format.MustRegister(archiveParser{})
+	format.MustRegister(builtinParser{name: "transcript", exts: []string{".srt", ".vtt"}, parse: plain(ParseTranscript), sniff: func(data []byte) (int, string) {
+		if bytes.HasPrefix(sniffHead(data), []byte("WEBVTT")) {
+			return format.ScoreMagic, "WEBVTT signature"
+		}
+		if looksLikeTranscript(data) {
+			return format.ScoreStructure, "subtitle cue index and timing"
+		}
+		return format.ScoreNone, ""
+	}})
+	format.MustRegister(builtinParser{name: "rtf", exts: []string{".rtf"}, parse: plain(ParseRTF), sniff: sniffPrefix(`{\rtf`, "rtf signature")})
+	format.MustRegister(builtinParser{name: "email", exts: []string{".eml"}, parse: plain(ParseEmail), meta: emailMetadata, sniff: sniffEmail})
+	format.MustRegister(builtinParser{name: "html", exts: []string{".html", ".htm", ".xhtml"}, parse: plain(ParseHTML), locate: htmlSourceMap, meta: htmlMetadata, sniff: sniffHTML})
+	format.MustRegister(builtinParser{name: "json", exts: []string{".json"}, parse: plain(ParseJSON), sniff: sniffJSON})
+	format.MustRegister(builtinParser{name: "xml", exts: []string{".xml"}, parse: plain(ParseXML), sniff: sniffXML})
+	format.MustRegister(builtinParser{name: "text", exts: []string{".txt", ".md"}, parse: plain(ParseText), sniff: func([]byte) (int, string) {
+		return scoreFallback, "no other format matched"
+	}})
+}
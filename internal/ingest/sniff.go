@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+
+	"contextsqueezer/pkg/format"
+)
+
+const (
+	// sniffWindow bounds how much of a file the structural sniffers look at.
+	sniffWindow = 4096
+	// zipHeadWindow bounds how much of a zip member they inflate; [Content_Types].xml lists
+	// every part before the main one in large documents.
+	zipHeadWindow = 4 * sniffWindow
+)
+
+var (
+	odfMimetypes = map[string]string{
+		"application/vnd.oasis.opendocument.text": "odt",
+		"application/epub+zip":                    "epub",
+	}
+	ooxmlContentTypes = []struct{ marker, kind string }{
+		{"wordprocessingml.document.main+xml", "docx"},
+		{"wordprocessingml.template.main+xml", "docx"},
+		{"spreadsheetml.sheet.main+xml", "xlsx"},
+		{"spreadsheetml.template.main+xml", "xlsx"},
+		{"presentationml.presentation.main+xml", "pptx"},
+		{"presentationml.slideshow.main+xml", "pptx"},
+	}
+	containerMarkers = []struct{ member, kind string }{
+		{"word/document.xml", "docx"},
+		{"xl/workbook.xml", "xlsx"},
+		{"ppt/presentation.xml", "pptx"},
+		{"META-INF/container.xml", "epub"},
+	}
+
+	reEmailHeader = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*:[ \t]`)
+	emailHeaders  = map[string]bool{
+		"from": true, "to": true, "cc": true, "subject": true, "date": true, "received": true,
+		"message-id": true, "mime-version": true, "return-path": true, "reply-to": true,
+	}
+)
+
+// readZipHead reads at most zipHeadWindow bytes of a member, so sniffing never inflates a bomb.
+func readZipHead(f *zip.File) []byte {
+	rc, err := f.Open()
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	head, _ := io.ReadAll(io.LimitReader(rc, zipHeadWindow))
+	return head
+}
+
+// zipKind is the container kind of a zip-based document and why; both are empty for a plain
+// zip archive or data that is not a zip.
+type zipKind struct{ kind, reason string }
+
+// zipContainerKind identifies a zip-based document from its manifest members: the ODF/EPUB
+// mimetype entry, the OOXML [Content_Types].xml overrides and finally well-known part names.
+// Detect calls it once per input and hands the result to every sniffer.
+func zipContainerKind(data []byte) zipKind {
+	if !hasZipMagic(data) {
+		return zipKind{}
+	}
+	kind, reason := readContainerKind(data)
+	return zipKind{kind: kind, reason: reason}
+}
+
+func readContainerKind(data []byte) (string, string) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", ""
+	}
+	byName := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		byName[f.Name] = f
+	}
+	if f, ok := byName["mimetype"]; ok {
+		mt := strings.TrimSpace(string(readZipHead(f)))
+		if kind, ok := odfMimetypes[mt]; ok {
+			return kind, "zip mimetype member is " + mt
+		}
+		if strings.HasPrefix(mt, "application/vnd.oasis.opendocument.") {
+			return "odf", "zip mimetype member is " + mt
+		}
+	}
+	if f, ok := byName["[Content_Types].xml"]; ok {
+		head := string(readZipHead(f))
+		for _, ct := range ooxmlContentTypes {
+			if strings.Contains(head, ct.marker) {
+				return ct.kind, "zip [Content_Types].xml declares " + ct.marker
+			}
+		}
+	}
+	for _, m := range containerMarkers {
+		if _, ok := byName[m.member]; ok {
+			return m.kind, "zip contains " + m.member
+		}
+	}
+	return "", ""
+}
+
+func sniffHead(data []byte) []byte {
+	if len(data) > sniffWindow {
+		data = data[:sniffWindow]
+	}
+	return bytes.TrimLeft(bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF}), " \t\r\n")
+}
+
+func sniffHTML(data []byte) (int, string) {
+	head := bytes.ToLower(sniffHead(data))
+	switch {
+	case bytes.HasPrefix(head, []byte("<!doctype html")):
+		return format.ScoreMagic, "html doctype"
+	case bytes.HasPrefix(head, []byte("<html")):
+		return format.ScoreMagic, "leading <html> element"
+	case (bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<!doctype"))) && bytes.Contains(head, []byte("<html")):
+		return format.ScoreMagic, "xhtml root element"
+	case bytes.HasPrefix(head, []byte("<")) && (bytes.Contains(head, []byte("<body")) || bytes.Contains(head, []byte("<head"))):
+		return format.ScoreStructure, "html head/body elements"
+	case bytes.Contains(bytes.ToLower(data), []byte("<html")):
+		return format.ScoreContent, "contains <html> tag"
+	}
+	return format.ScoreNone, ""
+}
+
+func sniffXML(data []byte) (int, string) {
+	head := sniffHead(data)
+	if bytes.HasPrefix(head, []byte("<?xml")) {
+		return format.ScoreStructure, "xml declaration"
+	}
+	return format.ScoreNone, ""
+}
+
+func sniffJSON(data []byte) (int, string) {
+	head := sniffHead(data)
+	if len(head) == 0 || (head[0] != '{' && head[0] != '[') {
+		return format.ScoreNone, ""
+	}
+	if json.Valid(data) {
+		return format.ScoreStructure, "parses as json"
+	}
+	return format.ScoreNone, ""
+}
+
+// sniffEmail accepts an RFC 5322 header block: the first line must be a header and at least
+// two of the common message headers must appear before the blank line.
+func sniffEmail(data []byte) (int, string) {
+	sc := bufio.NewScanner(bytes.NewReader(sniffHead(data)))
+	known := 0
+	for line := 0; sc.Scan(); line++ {
+		l := sc.Text()
+		if strings.TrimSpace(l) == "" {
+			break
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			continue
+		}
+		if !reEmailHeader.MatchString(l) {
+			if line == 0 {
+				return format.ScoreNone, ""
+			}
+			break
+		}
+		if emailHeaders[strings.ToLower(l[:strings.IndexByte(l, ':')])] {
+			known++
+		}
+	}
+	if known >= 2 {
+		return format.ScoreStructure, "rfc 5322 header block"
+	}
+	return format.ScoreNone, ""
+}
@@ -0,0 +1,295 @@
+package ingest
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"contextsqueezer/internal/textnorm"
+	"contextsqueezer/pkg/format"
+)
+
+var (
+	rePDFPage    = regexp.MustCompile(`/Type\s*/Page\b`)
+	reHTMLTag    = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)[^>]*?(/?)>`)
+	reSlideTitle = regexp.MustCompile(`^## Slide (\d+)$`)
+	htmlVoid     = map[string]bool{
+		"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+		"link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+	}
+)
+
+// matchKeyLen bounds how much of an extracted line is searched for in the source.
+const matchKeyLen = 48
+
+// lineSpans yields the non-blank lines of text as byte ranges.
+func lineSpans(text []byte, fn func(start, end int)) {
+	start := 0
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && text[i] != '\n' {
+			continue
+		}
+		if len(bytes.TrimSpace(text[start:i])) > 0 {
+			fn(start, i)
+		}
+		start = i + 1
+	}
+}
+
+// blockSpans yields the blank-line separated blocks of text as byte ranges.
+func blockSpans(text []byte, fn func(start, end int)) {
+	start := 0
+	for start < len(text) {
+		end := bytes.Index(text[start:], []byte("\n\n"))
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		if len(bytes.TrimSpace(text[start:end])) > 0 {
+			fn(start, end)
+		}
+		start = end + 2
+	}
+}
+
+func matchKey(line []byte) []byte {
+	key := bytes.TrimSpace(line)
+	if len(key) > matchKeyLen {
+		key = key[:matchKeyLen]
+	}
+	return key
+}
+
+// lineSourceMap locates each extracted line in the decoded source, in order, and records its
+// source line, ignoring heading markers. Lines the parser synthesised are left unmapped.
+func lineSourceMap(raw, text []byte) []format.SourceSpan {
+	spans := make([]format.SourceSpan, 0)
+	cursor, line := 0, 1
+	lineSpans(text, func(start, end int) {
+		key := matchKey(text[start:end])
+		at := bytes.Index(raw[cursor:], key)
+		if at < 0 && len(key) > 0 && key[0] == '#' {
+			key = bytes.TrimLeft(key, "# ")
+			at = bytes.Index(raw[cursor:], key)
+		}
+		if at < 0 {
+			if i := bytes.Index(key, []byte(": ")); i >= 0 {
+				key = key[i+2:]
+				at = bytes.Index(raw[cursor:], key)
+			}
+		}
+		if at < 0 || len(key) == 0 {
+			return
+		}
+		line += bytes.Count(raw[cursor:cursor+at], []byte("\n"))
+		cursor += at
+		spans = append(spans, format.SourceSpan{Start: start, End: end, Location: format.Location{Line: line}})
+	})
+	return spans
+}
+
+func paragraphSourceMap(_, text []byte) []format.SourceSpan {
+	spans := make([]format.SourceSpan, 0)
+	blockSpans(text, func(start, end int) {
+		spans = append(spans, format.SourceSpan{Start: start, End: end, Location: format.Location{Paragraph: len(spans) + 1}})
+	})
+	return spans
+}
+
+// pdfSourceMap pairs each extracted line with its Tj operator and counts the page objects that
+// precede it, which matches the page order of simply structured files.
+func pdfSourceMap(raw, text []byte) []format.SourceSpan {
+	pages := make([]int, 0)
+	page, last := 0, 0
+	for _, m := range rePDFText.FindAllSubmatchIndex(raw, -1) {
+		page += len(rePDFPage.FindAllIndex(raw[last:m[0]], -1))
+		last = m[0]
+		if len(bytes.TrimSpace(raw[m[2]:m[3]])) == 0 && len(pages) == 0 {
+			continue
+		}
+		pages = append(pages, max(page, 1))
+	}
+	spans := make([]format.SourceSpan, 0, len(pages))
+	i := 0
+	start := 0
+	for pos := 0; pos <= len(text) && i < len(pages); pos++ {
+		if pos < len(text) && text[pos] != '\n' {
+			continue
+		}
+		if n := len(spans); n > 0 && spans[n-1].Page == pages[i] && spans[n-1].End+1 == start {
+			spans[n-1].End = pos
+		} else if pos > start {
+			spans = append(spans, format.SourceSpan{Start: start, End: pos, Location: format.Location{Page: pages[i]}})
+		}
+		i++
+		start = pos + 1
+	}
+	return spans
+}
+
+// slideSourceMap attributes each "## Slide N" block of pptx output to page N.
+func slideSourceMap(_, text []byte) []format.SourceSpan {
+	spans := make([]format.SourceSpan, 0)
+	blockSpans(text, func(start, end int) {
+		if m := reSlideTitle.FindSubmatch(text[start:end]); m != nil {
+			n, _ := strconv.Atoi(string(m[1]))
+			spans = append(spans, format.SourceSpan{Start: start, End: end, Location: format.Location{Page: n}})
+			return
+		}
+		if n := len(spans); n > 0 {
+			spans[n-1].End = end
+		}
+	})
+	return spans
+}
+
+type htmlRun struct {
+	path string
+	line int
+	text string
+}
+
+// htmlRuns lists the visible text runs of an html document with the element path enclosing
+// each one, in the /html/body/div[2]/p[1] form.
+func htmlRuns(raw []byte) []htmlRun {
+	type frame struct {
+		name   string
+		path   string
+		counts map[string]int
+	}
+	stack := []frame{{counts: map[string]int{}}}
+	runs := make([]htmlRun, 0)
+	skip := ""
+	last := 0
+	for _, m := range reHTMLTag.FindAllSubmatchIndex(raw, -1) {
+		if skip == "" {
+			if t := strings.Join(strings.Fields(string(raw[last:m[0]])), " "); t != "" {
+				runs = append(runs, htmlRun{path: stack[len(stack)-1].path, line: 1 + bytes.Count(raw[:last], []byte("\n")), text: t})
+			}
+		}
+		last = m[1]
+		closing := m[3] > m[2]
+		name := strings.ToLower(string(raw[m[4]:m[5]]))
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+		if closing {
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].name == name {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+		if name == "script" || name == "style" {
+			skip = name
+			continue
+		}
+		if htmlVoid[name] || m[7] > m[6] {
+			continue
+		}
+		if top := stack[len(stack)-1]; (name == "p" || name == "li") && top.name == name {
+			stack = stack[:len(stack)-1]
+		}
+		parent := &stack[len(stack)-1]
+		parent.counts[name]++
+		stack = append(stack, frame{name: name, path: parent.path + "/" + name + "[" + strconv.Itoa(parent.counts[name]) + "]", counts: map[string]int{}})
+	}
+	return runs
+}
+
+// htmlSourceMap matches the document's text runs, in order, against the extracted lines.
+// Several block elements can share an extracted line, so each run opens a span at the point
+// it is found unless it sits inside the element of the span before it.
+func htmlSourceMap(raw, text []byte) []format.SourceSpan {
+	runs := htmlRuns(raw)
+	spans := make([]format.SourceSpan, 0)
+	k := 0
+	lineSpans(text, func(start, end int) {
+		line := string(text[start:end])
+		pos := 0
+		open := -1
+		for j := k; j < len(runs) && j < k+64; j++ {
+			key := runs[j].text
+			if len(key) > matchKeyLen {
+				key = key[:matchKeyLen]
+			}
+			at := strings.Index(line[pos:], key)
+			if at < 0 {
+				if open >= 0 {
+					break
+				}
+				continue
+			}
+			at += pos
+			pos = at + len(key)
+			k = j + 1
+			if open >= 0 && strings.HasPrefix(runs[j].path, spans[open].Element+"/") {
+				continue
+			}
+			if open >= 0 {
+				spans[open].End = start + at
+			}
+			spans = append(spans, format.SourceSpan{Start: start + at, End: end, Location: format.Location{Line: runs[j].line, Element: runs[j].path}})
+			open = len(spans) - 1
+		}
+		if open >= 0 {
+			spans[open].End = end
+		}
+	})
+	return spans
+}
+
+// shiftSpans moves spans by delta bytes and tags them with the archive member they came from.
+func shiftSpans(spans []format.SourceSpan, delta int, member string) []format.SourceSpan {
+	out := make([]format.SourceSpan, 0, len(spans))
+	for _, sp := range spans {
+		sp.Start += delta
+		sp.End += delta
+		if sp.File == "" {
+			sp.File = member
+		} else {
+			sp.File = member + "/" + sp.File
+		}
+		out = append(out, sp)
+	}
+	return out
+}
+
+// normalizeMapped runs textnorm over each mapped span and the gaps between them separately so
+// that span offsets stay valid after characters are removed or composed.
+func normalizeMapped(text []byte, spans []format.SourceSpan) ([]byte, []format.SourceSpan, textnorm.Report) {
+	if len(spans) == 0 {
+		out, rep := textnorm.Normalize(text)
+		return out, spans, rep
+	}
+	var rep textnorm.Report
+	out := make([]byte, 0, len(text))
+	add := func(b []byte) {
+		n, r := textnorm.Normalize(b)
+		rep.Add(r)
+		out = append(out, n...)
+	}
+	mapped := make([]format.SourceSpan, 0, len(spans))
+	pos := 0
+	for _, sp := range spans {
+		if sp.Start < pos || sp.End > len(text) || sp.Start > sp.End {
+			continue
+		}
+		add(text[pos:sp.Start])
+		from, to := sp.Start, sp.End
+		sp.Start = len(out)
+		add(text[from:to])
+		sp.End = len(out)
+		pos = to
+		mapped = append(mapped, sp)
+	}
+	add(text[pos:])
+	return out, mapped, rep
+}
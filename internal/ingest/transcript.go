@@ -0,0 +1,217 @@
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const transcriptHeadingIntervalSec = 5 * 60
+
+var (
+	reCueTiming  = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{2}[.,]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{2}[.,]\d{1,3})`)
+	reCueIndex   = regexp.MustCompile(`^\s*\d+\s*$`)
+	reVoiceTag   = regexp.MustCompile(`(?i)<v(?:\.[^\s>]*)?\s+([^>]+)>`)
+	reCueTag     = regexp.MustCompile(`<[^>]*>`)
+	reSpeakerPfx = regexp.MustCompile(`^-?\s*([A-Z][\w .'-]{0,40}?):\s+(.*)$`)
+	reFillerWord = regexp.MustCompile(`(?i)^(?:u+h*m*|u+m+|e+r+m*|a+h+|h+m+|mm+-?hm+|uh-?huh)[.,!?…]*$`)
+	reFillerTag  = regexp.MustCompile(`^[\[(♪][^\])♪]*[\])♪]$`)
+)
+
+type transcriptCue struct {
+	start   int
+	speaker string
+	text    string
+}
+
+func parseCueTime(s string) (int, bool) {
+	s = strings.Replace(s, ",", ".", 1)
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		s = s[:dot]
+	}
+	parts := strings.Split(s, ":")
+	total := 0
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, false
+		}
+		total = total*60 + n
+	}
+	return total, true
+}
+
+func formatCueTime(sec int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", sec/3600, (sec/60)%60, sec%60)
+}
+
+func isFillerLine(s string) bool {
+	t := strings.TrimSpace(s)
+	if t == "" {
+		return true
+	}
+	if reFillerTag.MatchString(t) {
+		return true
+	}
+	for _, w := range strings.Fields(strings.ReplaceAll(t, ",", " ")) {
+		if !reFillerWord.MatchString(w) {
+			return false
+		}
+	}
+	return true
+}
+
+func looksLikeTranscript(data []byte) bool {
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	if bytes.HasPrefix(head, []byte("WEBVTT")) {
+		return true
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	nonEmpty := make([]string, 0, 2)
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		nonEmpty = append(nonEmpty, l)
+		if len(nonEmpty) == 2 {
+			break
+		}
+	}
+	return len(nonEmpty) == 2 && reCueIndex.MatchString(nonEmpty[0]) && reCueTiming.MatchString(nonEmpty[1])
+}
+
+// speakerPrefixes counts the "Name: " prefixes of the cue lines in s.
+func speakerPrefixes(s string) map[string]int {
+	counts := map[string]int{}
+	for _, l := range strings.Split(s, "\n") {
+		if sp := reSpeakerPfx.FindStringSubmatch(strings.TrimSpace(reCueTag.ReplaceAllString(l, ""))); sp != nil {
+			counts[strings.TrimSpace(sp[1])]++
+		}
+	}
+	return counts
+}
+
+// isSpeaker reports whether a "Name: " prefix names a speaker rather than starting prose such
+// as "Note: ...": the name must be in capitals, as captions write speakers, or recur.
+func isSpeaker(name string, counts map[string]int) bool {
+	if counts[name] > 1 {
+		return true
+	}
+	upper := false
+	for _, r := range name {
+		if unicode.IsLower(r) {
+			return false
+		}
+		upper = upper || unicode.IsUpper(r)
+	}
+	return upper
+}
+
+func parseTranscriptCues(raw []byte) []transcriptCue {
+	s := strings.ReplaceAll(string(bytes.TrimPrefix(raw, []byte("\xef\xbb\xbf"))), "\r\n", "\n")
+	blocks := strings.Split(s, "\n\n")
+	prefixes := speakerPrefixes(s)
+	cues := make([]transcriptCue, 0, len(blocks))
+	for _, blk := range blocks {
+		lines := strings.Split(strings.Trim(blk, "\n"), "\n")
+		timing := -1
+		for i, l := range lines {
+			if reCueTiming.MatchString(l) {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			// WEBVTT header, NOTE, STYLE and REGION blocks carry no cue text.
+			continue
+		}
+		m := reCueTiming.FindStringSubmatch(lines[timing])
+		start, ok := parseCueTime(m[1])
+		if !ok {
+			continue
+		}
+		speaker := ""
+		parts := make([]string, 0, len(lines)-timing-1)
+		for _, l := range lines[timing+1:] {
+			if v := reVoiceTag.FindStringSubmatch(l); v != nil {
+				speaker = strings.TrimSpace(v[1])
+			}
+			l = strings.TrimSpace(reCueTag.ReplaceAllString(l, ""))
+			if sp := reSpeakerPfx.FindStringSubmatch(l); sp != nil && isSpeaker(strings.TrimSpace(sp[1]), prefixes) {
+				speaker = strings.TrimSpace(sp[1])
+				l = sp[2]
+			}
+			l = strings.TrimSpace(strings.TrimPrefix(l, "- "))
+			if isFillerLine(l) {
+				continue
+			}
+			parts = append(parts, l)
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		cues = append(cues, transcriptCue{start: start, speaker: speaker, text: strings.Join(parts, " ")})
+	}
+	return cues
+}
+
+func ParseTranscript(raw []byte) ([]byte, []string, error) {
+	warnings := []string{}
+	cues := parseTranscriptCues(raw)
+	if len(cues) == 0 {
+		warnings = append(warnings, "transcript contained no cue text")
+		return []byte{}, warnings, nil
+	}
+
+	var b strings.Builder
+	nextHeading := 0
+	speaker := ""
+	lastText := ""
+	para := make([]string, 0)
+	dups := 0
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		if speaker != "" {
+			b.WriteString(speaker)
+			b.WriteString(": ")
+		}
+		b.WriteString(strings.Join(para, " "))
+		b.WriteString("\n\n")
+		para = para[:0]
+	}
+	for _, c := range cues {
+		if c.start >= nextHeading {
+			flush()
+			bucket := c.start - c.start%transcriptHeadingIntervalSec
+			b.WriteString("## ")
+			b.WriteString(formatCueTime(bucket))
+			b.WriteString("\n\n")
+			nextHeading = bucket + transcriptHeadingIntervalSec
+		}
+		// Rolling captions repeat the previous cue verbatim; keep the first copy.
+		if c.text == lastText {
+			dups++
+			continue
+		}
+		lastText = c.text
+		if c.speaker != "" && c.speaker != speaker {
+			flush()
+			speaker = c.speaker
+		}
+		para = append(para, c.text)
+	}
+	flush()
+	if dups > 0 {
+		warnings = append(warnings, fmt.Sprintf("transcript dropped %d repeated cues", dups))
+	}
+	return []byte(strings.TrimRight(b.String(), "\n") + "\n"), warnings, nil
+}
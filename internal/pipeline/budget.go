@@ -2,7 +2,8 @@ package pipeline
 
 import (
 	"bytes"
-	"errors"
+
+	"contextsqueezer/pkg/api"
 )
 
 type span struct{ s, e int }
@@ -56,47 +57,80 @@ func isAnchorSentence(s []byte) bool {
 	return len(trim) > 0 && trim[0] == '#'
 }
 
-func joinChunks(chunks [][]byte) []byte { return bytes.Join(chunks, nil) }
+// unit is a sentence of squeezed text that the budget solver may keep or drop. Its score is
+// the engine's, so only units from the same engine run are comparable. Relevance is the
+// highest query relevance of the engine sentences it overlaps, and section is the index of
+// the section it came from.
+type unit struct {
+	s, e      int
+	score     float64
+	anchor    bool
+	relevance float64
+	section   int
+}
 
-func joinedWith(chunks [][]byte, extra []byte) []byte {
-	all := make([][]byte, 0, len(chunks)+1)
-	all = append(all, chunks...)
-	all = append(all, extra)
-	return joinChunks(all)
+// scoreFrom gives u the scores of the engine sentences overlapping sp, a range of the same
+// text, each in proportion to the overlap, and returns where the next search may start.
+func (u *unit) scoreFrom(scored []scoredSpan, from int, sp span) int {
+	for from < len(scored) && scored[from].e <= sp.s {
+		from++
+	}
+	for i := from; i < len(scored) && scored[i].s < sp.e; i++ {
+		sc := scored[i]
+		overlap := min(sc.e, sp.e) - max(sc.s, sp.s)
+		u.score += sc.score * float64(overlap) / float64(sc.e-sc.s)
+		u.anchor = u.anchor || sc.anchor
+		u.relevance = max(u.relevance, sc.relevance)
+	}
+	return from
 }
 
-func truncateToBudget(in []byte, maxTokens int) ([]byte, error) {
-	if maxTokens <= 0 {
-		return in, nil
+// maxRelevance returns the highest relevance among units, or only those kept when kept is
+// set, and nil when there are none.
+func maxRelevance(units []unit, kept []bool) *float64 {
+	var best *float64
+	for i, u := range units {
+		if (kept == nil || kept[i]) && (best == nil || u.relevance > *best) {
+			rel := u.relevance
+			best = &rel
+		}
 	}
-	spans := segmentSentences(in)
-	if len(spans) == 0 {
-		return []byte{}, nil
+	return best
+}
+
+// fitBudget fits text to limit with api.Analysis.FitKept, with units as its candidate
+// sentences and tokens counted with t, and reports which units it keeps. Bytes between
+// units, such as chunk joins, go with the unit before them like blank-line separators. With a
+// query, the units are focused on it together first, since the chunks they came from were
+// scored alone, and each unit's relevance is updated to match.
+func fitBudget(text []byte, units []unit, limit api.Size, t api.Tokenizer, query string) ([]byte, []bool, bool) {
+	a := api.Analysis{Text: text, Sentences: make([]api.Sentence, len(units))}
+	for i, u := range units {
+		a.Sentences[i] = api.Sentence{Start: u.s, End: u.e, Score: u.score, Anchor: u.anchor}
 	}
-	kept := make([][]byte, 0, len(spans))
-	for _, sp := range spans {
-		s := append([]byte{}, in[sp.s:sp.e]...)
-		trial := joinedWith(kept, s)
-		if approxTokens(trial) <= maxTokens {
-			kept = append(kept, s)
-			continue
+	if query != "" {
+		a.Focus(query, 0)
+		for i, s := range a.Sentences {
+			units[i].relevance = s.Relevance
 		}
-		if isAnchorSentence(s) {
-			for len(kept) > 0 && approxTokens(joinedWith(kept, s)) > maxTokens {
-				if !isAnchorSentence(kept[len(kept)-1]) {
-					kept = kept[:len(kept)-1]
-				} else {
-					break
-				}
-			}
-			if approxTokens(joinedWith(kept, s)) <= maxTokens {
-				kept = append(kept, s)
-			}
+	}
+	return a.FitKept(limit, api.Options{Tokenizer: t})
+}
+
+// protectContinuity marks as anchors the units holding the first sentence after each
+// heading of in, which ensureHeadingContinuity would otherwise add back over budget.
+func protectContinuity(in, text []byte, units []unit) {
+	follow := map[string]bool{}
+	spans := segmentSentences(in)
+	for i := 0; i+1 < len(spans); i++ {
+		s := bytes.TrimSpace(in[spans[i].s:spans[i].e])
+		if len(s) > 0 && s[0] == '#' {
+			follow[string(bytes.TrimSpace(in[spans[i+1].s:spans[i+1].e]))] = true
 		}
-		break
 	}
-	if len(kept) == 0 {
-		return nil, errors.New("budget too small to keep any sentence")
+	for i, u := range units {
+		if follow[string(bytes.TrimSpace(text[u.s:u.e]))] {
+			units[i].anchor = true
+		}
 	}
-	return joinChunks(kept), nil
 }
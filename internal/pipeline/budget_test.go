@@ -2,7 +2,10 @@ package pipeline
 
 import (
 	"bytes"
+	"context"
 	"contextsqueezer/pkg/api"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -43,3 +46,141 @@ func TestAnchorRetentionNonTruncation(t *testing.T) {
 		t.Fatal("anchors must be retained in non-truncation case")
 	}
 }
+
+func TestFitBudgetPrefersValuePerToken(t *testing.T) {
+	text := []byte("# Head\nCheap filler here. Dense unique fact. Long rambling sentence that says little of note.")
+	units := []unit{
+		{s: 0, e: 7, anchor: true},
+		{s: 7, e: 26, score: 1},
+		{s: 26, e: 45, score: 9},
+		{s: 45, e: len(text), score: 3},
+	}
+	out, _, fits := fitBudget(text, units, api.Size{Tokens: 14}, nil, "")
+	if !fits || string(out) != "# Head\nDense unique fact. " {
+		t.Fatalf("unexpected selection %q (fits %v)", out, fits)
+	}
+	if out, _, fits := fitBudget(text, units, api.Size{Tokens: 2}, nil, ""); fits || len(out) > 0 {
+		t.Fatalf("anchor cannot fit in 2 tokens, got %q", out)
+	}
+	if out, _, _ := fitBudget(text, units, api.Size{Tokens: 100, Words: 5}, nil, ""); string(out) != "# Head\nDense unique fact. " {
+		t.Fatalf("word limit ignored: %q", out)
+	}
+}
+
+func TestFitBudgetDropsEmptyChunkJoins(t *testing.T) {
+	// Three chunks joined by "\n"; a separator is only written between two kept units.
+	text := []byte("Alpha kept here.\n\nFiller one.\nFiller two.\nOmega kept too.")
+	units := []unit{
+		{s: 0, e: 16, score: 12},
+		{s: 16, e: 18},
+		{s: 18, e: 29, score: 1},
+		{s: 30, e: 41, score: 1},
+		{s: 42, e: len(text), score: 9},
+	}
+	if out, _, _ := fitBudget(text, units, api.Size{Bytes: 40}, nil, ""); string(out) != "Alpha kept here.\n\nOmega kept too." {
+		t.Fatalf("unexpected joins %q", out)
+	}
+	if out, _, _ := fitBudget(text, units, api.Size{Bytes: 20}, nil, ""); string(out) != "Alpha kept here." {
+		t.Fatalf("separator left after the last kept unit: %q", out)
+	}
+}
+
+// partsDoc is four headed parts of 100 distinct one-sentence paragraphs.
+func partsDoc() []byte {
+	word := func(n int) string { return string([]byte{byte('a' + n%26), byte('a' + n/26%26)}) }
+	var b strings.Builder
+	for i := 0; i < 400; i++ {
+		if i%100 == 0 {
+			fmt.Fprintf(&b, "# Part %c\n\n", 'A'+i/100)
+		}
+		fmt.Fprintf(&b, "Entry %s%s reports %s%s near %s%s.\n\n", word(i), word(i*3), word(i*7+3), word(i*11), word(i*13+5), word(i*17+1))
+	}
+	return []byte(b.String())
+}
+
+func TestBudgetSinglePassCoversDocument(t *testing.T) {
+	in := partsDoc()
+	full, err := RunResult(in, api.Options{Aggressiveness: 4}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	budget := full.TokensOutApprox / 3
+	res, err := RunResult(in, api.Options{Aggressiveness: 4, MaxTokens: budget}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	if res.TokensOutApprox > budget || res.TokensOutApprox < budget*9/10 || res.Truncated || res.Aggressiveness != 4 {
+		t.Fatalf("unexpected result: %d of %d tokens, truncated %v, aggr %d", res.TokensOutApprox, budget, res.Truncated, res.Aggressiveness)
+	}
+	if !bytes.Contains(res.Text, []byte("# Part D")) || bytes.Count(res.Text, []byte("Entry ")) < 20 {
+		t.Fatalf("budgeted output does not span the document: %q", res.Text)
+	}
+}
+
+func TestSizeLimitTargets(t *testing.T) {
+	in := partsDoc()
+	res, err := RunResult(in, api.Options{Aggressiveness: 9, TargetRatio: 0.3}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	if len(res.Targets) != 1 || res.Targets[0].Name != "ratio" || res.Targets[0].Achieved > 0.3 || res.Targets[0].Achieved < 0.25 {
+		t.Fatalf("unexpected targets %+v", res.Targets)
+	}
+	if !bytes.Contains(res.Text, []byte("# Part D")) || res.Truncated {
+		t.Fatalf("ratio output does not span the document: %q", res.Text)
+	}
+
+	res, err = RunResult(in, api.Options{Aggressiveness: 4, MaxBytes: 2000, MaxWords: 250}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	if got := api.Measure(res.Text, nil); got.Bytes > 2000 || got.Words > 250 || len(res.Targets) != 2 || res.Targets[0].Name != "bytes" {
+		t.Fatalf("limits not met: %+v, targets %+v", got, res.Targets)
+	}
+
+	var out bytes.Buffer
+	res, err = RunStream(context.Background(), bytes.NewReader(in), &out, api.Options{Aggressiveness: 4, TargetRatio: 0.3}, RunConfig{WindowBytes: 4096})
+	if err != nil {
+		t.Fatalf("RunStream: %v", err)
+	}
+	if len(res.Targets) != 1 || res.Targets[0].Achieved > 0.3 || res.Targets[0].Achieved < 0.2 {
+		t.Fatalf("unexpected stream targets %+v", res.Targets)
+	}
+	if _, err := RunResult(in, api.Options{TargetRatio: -1}, "text", nil); err == nil {
+		t.Fatal("expected error for negative target ratio")
+	}
+}
+
+func TestBudgetQueryAcrossSections(t *testing.T) {
+	word := func(n int) string { return string([]byte{byte('b' + n%19), "aeiou"[n/19%5], byte('k' + n/95%10)}) }
+	var b strings.Builder
+	matches := 0
+	for sec := 0; sec < 6; sec++ {
+		fmt.Fprintf(&b, "# Section %d\n\n", sec+1)
+		for i := 0; i < 40; i++ {
+			n := 5 + (i*7+sec)%10
+			words := make([]string, n)
+			for j := range words {
+				words[j] = word((sec*40+i)*31 + j*17)
+			}
+			if (sec == 1 || sec == 4) && i%4 == 1 {
+				words[n/2] = "zebra"
+				matches++
+			}
+			b.WriteString(strings.ToUpper(words[0][:1]) + strings.Join(words, " ")[1:] + ". ")
+			if i%5 == 4 {
+				b.WriteString("\n\n")
+			}
+		}
+	}
+	in := []byte(b.String())
+	// The limit has room for about a sixth of the document, so only the query keeps the
+	// matching sentences of two sections in it.
+	res, err := RunResult(in, api.Options{MaxTokens: 784, Query: "zebra"}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	if got := bytes.Count(res.Text, []byte("zebra")); got != matches {
+		t.Fatalf("kept %d of %d matching sentences", got, matches)
+	}
+}
@@ -1,53 +1,68 @@
 package pipeline
 
 import (
+	"context"
 	"contextsqueezer/internal/metrics"
 	"contextsqueezer/internal/runtime"
 	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/format"
 	"errors"
-	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Result struct {
-	Text            []byte               `json:"-"`
-	BytesIn         int                  `json:"bytes_in"`
-	BytesOut        int                  `json:"bytes_out"`
-	TokensInApprox  int                  `json:"tokens_in_approx"`
-	TokensOutApprox int                  `json:"tokens_out_approx"`
-	ReductionPct    float64              `json:"reduction_pct"`
-	Aggressiveness  int                  `json:"aggressiveness"`
-	Profile         string               `json:"profile"`
-	BudgetApplied   bool                 `json:"budget_applied"`
-	Truncated       bool                 `json:"truncated"`
-	SourceType      string               `json:"source_type"`
-	Warnings        []string             `json:"warnings"`
-	Metrics         metrics.StageMetrics `json:"metrics"`
+	Text            []byte `json:"-"`
+	BytesIn         int    `json:"bytes_in"`
+	BytesOut        int    `json:"bytes_out"`
+	TokensInApprox  int    `json:"tokens_in_approx"`
+	TokensOutApprox int    `json:"tokens_out_approx"`
+	// Tokenizer names opt.Tokenizer when one was given; the token counts are then its own.
+	Tokenizer      string               `json:"tokenizer,omitempty"`
+	ReductionPct   float64              `json:"reduction_pct"`
+	Aggressiveness int                  `json:"aggressiveness"`
+	Profile        string               `json:"profile"`
+	BudgetApplied  bool                 `json:"budget_applied"`
+	Truncated      bool                 `json:"truncated"`
+	SourceType     string               `json:"source_type"`
+	Warnings       []string             `json:"warnings"`
+	Metrics        metrics.StageMetrics `json:"metrics"`
+	Metadata       format.Metadata      `json:"metadata"`
+	Sections       []Section            `json:"sections"`
+	Provenance     []Provenance         `json:"provenance,omitempty"`
+	Targets        []Target             `json:"targets,omitempty"`
 }
 
-func fastWordCount(in []byte) int {
-	inWord := false
-	count := 0
-	for _, b := range in {
-		ws := b == ' ' || b == '\n' || b == '\t' || b == '\r'
-		if ws {
-			inWord = false
-			continue
-		}
-		if !inWord {
-			count++
-			inWord = true
-		}
-	}
-	return count
+// Target pairs a size limit with what the output achieved. Name is
+// "tokens", "ratio", "bytes" or "words"; a ratio is of approximate tokens.
+type Target struct {
+	Name     string  `json:"name"`
+	Target   float64 `json:"target"`
+	Achieved float64 `json:"achieved"`
 }
 
-func approxTokens(in []byte) int {
-	if len(in) == 0 {
-		return 0
+// targets reports each limit set in opt against got, the size of a squeeze of an input of
+// tokensIn approximate tokens.
+func targets(opt api.Options, tokensIn int, got api.Size) []Target {
+	var ts []Target
+	if opt.MaxTokens > 0 {
+		ts = append(ts, Target{Name: "tokens", Target: float64(opt.MaxTokens), Achieved: float64(got.Tokens)})
+	}
+	if opt.TargetRatio > 0 && opt.TargetRatio < 1 {
+		ratio := 0.0
+		if tokensIn > 0 {
+			ratio = float64(got.Tokens) / float64(tokensIn)
+		}
+		ts = append(ts, Target{Name: "ratio", Target: opt.TargetRatio, Achieved: ratio})
+	}
+	if opt.MaxBytes > 0 {
+		ts = append(ts, Target{Name: "bytes", Target: float64(opt.MaxBytes), Achieved: float64(got.Bytes)})
+	}
+	if opt.MaxWords > 0 {
+		ts = append(ts, Target{Name: "words", Target: float64(opt.MaxWords), Achieved: float64(got.Words)})
 	}
-	words := fastWordCount(in)
-	return int(math.Ceil(float64(len(in))/4.0)) + words
+	return ts
 }
 
 func reductionPct(in, out int) float64 {
@@ -70,6 +85,50 @@ func normalizeAggr(opt api.Options) int {
 	return 4
 }
 
+func tokenizerName(t api.Tokenizer) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name()
+}
+
+// shrink takes used off every limit set in limit. The result is zero when used does not
+// leave room in all of them.
+func shrink(limit, used api.Size) api.Size {
+	ok := true
+	sub := func(l, u int) int {
+		if l <= 0 {
+			return 0
+		}
+		ok = ok && u < l
+		return l - u
+	}
+	rest := api.Size{Tokens: sub(limit.Tokens, used.Tokens), Bytes: sub(limit.Bytes, used.Bytes), Words: sub(limit.Words, used.Words)}
+	if !ok {
+		return api.Size{}
+	}
+	return rest
+}
+
+// metadataHeader renders metadata as one bracketed line, e.g.
+// "[title: Q3 Report | author: Ann | pages: 12]", followed by a blank line.
+func metadataHeader(m format.Metadata) []byte {
+	parts := make([]string, 0, 5)
+	add := func(k, v string) {
+		if v = strings.Join(strings.Fields(v), " "); v != "" {
+			parts = append(parts, k+": "+v)
+		}
+	}
+	add("title", m.Title)
+	add("author", m.Author)
+	add("created", m.Created)
+	if m.Pages > 0 {
+		add("pages", strconv.Itoa(m.Pages))
+	}
+	add("language", m.Language)
+	return []byte("[" + strings.Join(parts, " | ") + "]\n\n")
+}
+
 func Run(in []byte, opt api.Options) ([]byte, error) {
 	res, err := RunResult(in, opt, "text", nil)
 	if err != nil {
@@ -79,79 +138,115 @@ func Run(in []byte, opt api.Options) ([]byte, error) {
 }
 
 func RunResult(in []byte, opt api.Options, sourceType string, warnings []string) (Result, error) {
-	return RunResultWithConfig(in, opt, sourceType, warnings, RunConfig{MaxMemoryMB: 1024})
+	return RunResultWithConfig(context.Background(), in, opt, sourceType, warnings, RunConfig{MaxMemoryMB: 1024})
 }
 
-func RunResultWithConfig(in []byte, opt api.Options, sourceType string, warnings []string, cfg RunConfig) (Result, error) {
+// RunResultWithConfig squeezes every chunk once. Over a size limit, the lowest-value sentences
+// per share of it are then dropped across the whole document, keeping anchors unless they
+// alone do not fit, in which case Truncated is set. A target ratio keeps sentences the
+// aggressiveness would cut for their score as candidates. It stops between chunks, and
+// inside the engine, once ctx is done; the error then wraps ctx.Err().
+func RunResultWithConfig(ctx context.Context, in []byte, opt api.Options, sourceType string, warnings []string, cfg RunConfig) (Result, error) {
 	if sourceType == "" {
 		sourceType = "text"
 	}
 	if cfg.MaxMemoryMB <= 0 {
 		cfg.MaxMemoryMB = 1024
 	}
-	budgetApplied := opt.MaxTokens > 0
-	attempts := 0
-	best := in
+	budgetApplied := opt.Limited()
+	limit, err := opt.Limit(in)
+	if err != nil {
+		return Result{}, err
+	}
+	tokensIn := api.Measure(in, opt.Tokenizer).Tokens
 	current := normalizeAggr(opt)
 	tracker := runtime.NewMemoryTracker(cfg.MaxMemoryMB)
 	allWarnings := append([]string{}, warnings...)
+	var header []byte
+	if cfg.MetadataHeader && !cfg.Metadata.IsZero() {
+		header = metadataHeader(cfg.Metadata)
+		hs := api.Measure(header, opt.Tokenizer)
+		if rest := shrink(limit, hs); !limit.IsZero() && rest.IsZero() {
+			allWarnings = append(allWarnings, "metadata header does not fit the size limits; omitted")
+			header = nil
+		} else {
+			limit = rest
+		}
+	}
 	m := metrics.StageMetrics{}
+	segStart := time.Now()
+	chunks, sections := splitChunks(in)
+	m.SegmentationMS = time.Since(segStart).Milliseconds()
 	budgetStart := time.Now()
 
-	for {
-		attempts++
-		if attempts > 10 {
-			break
-		}
-		out, stage, usedAggr, err := squeezeStreamed(in, api.Options{Aggressiveness: current, Profile: opt.Profile, MaxTokens: opt.MaxTokens}, cfg, tracker, &allWarnings)
-		if err != nil {
-			return Result{}, err
-		}
-		best = out
-		current = usedAggr
-		if opt.MaxTokens > 0 {
-			runtime.Debugf("budget loop: attempt %d, tokens approx %d", attempts, approxTokens(out))
-		}
-		m.SegmentationMS += stage.SegmentationMS
-		m.TokenizationMS += stage.TokenizationMS
-		m.CandidateFilterMS += stage.CandidateFilterMS
-		m.SimilarityMS += stage.SimilarityMS
-		m.PruneMS += stage.PruneMS
-		m.AssemblyMS += stage.AssemblyMS
-		m.CrossChunkRegistryMS += stage.CrossChunkRegistryMS
-		m.SimilarityCandidates += stage.SimilarityCandidates
-		m.SimilarityPairs += stage.SimilarityPairs
-		m.TokensParsed += stage.TokensParsed
-		m.SentencesTotal += stage.SentencesTotal
-		if opt.MaxTokens <= 0 || approxTokens(out) <= opt.MaxTokens || current >= 9 {
-			break
-		}
-		current++
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	best, units, stage, usedAggr, err := squeezeStreamed(ctx, chunks, sections, api.Options{Aggressiveness: current, Profile: opt.Profile, MaxTokens: limit.Tokens, MaxBytes: limit.Bytes, MaxWords: limit.Words, TargetRatio: opt.TargetRatio, Tokenizer: opt.Tokenizer, Query: opt.Query}, cfg, tracker, &allWarnings)
+	if err != nil {
+		return Result{}, err
 	}
+	current = usedAggr
+	m.TokenizationMS += stage.TokenizationMS
+	m.CandidateFilterMS += stage.CandidateFilterMS
+	m.SimilarityMS += stage.SimilarityMS
+	m.PruneMS += stage.PruneMS
+	m.AssemblyMS += stage.AssemblyMS
+	m.CrossChunkRegistryMS += stage.CrossChunkRegistryMS
+	m.SimilarityCandidates += stage.SimilarityCandidates
+	m.SimilarityPairs += stage.SimilarityPairs
+	m.TokensParsed += stage.TokensParsed
+	m.SentencesTotal += stage.SentencesTotal
 
 	truncated := false
-	if opt.MaxTokens > 0 && approxTokens(best) > opt.MaxTokens {
-		runtime.Infof("budget loop failed to satisfy %d tokens; forcing truncation", opt.MaxTokens)
-		var err error
-		best, err = truncateToBudget(best, opt.MaxTokens)
-		if err != nil {
-			return Result{}, err
+	size := api.Measure(best, opt.Tokenizer)
+	if !limit.IsZero() && !size.Within(limit) {
+		protectContinuity(in, best, units)
+		var kept []bool
+		var fits bool
+		best, kept, fits = fitBudget(best, units, limit, opt.Tokenizer, opt.Query)
+		if opt.Query != "" {
+			setRelevance(sections, units, kept)
+		}
+		size = api.Measure(best, opt.Tokenizer)
+		runtime.Debugf("budget: kept %+v of %+v", size, limit)
+		if !fits {
+			runtime.Infof("anchors alone exceed %+v; dropping the lowest-value ones", limit)
+			truncated = true
 		}
-		truncated = true
 	}
-	best = ensureHeadingContinuity(in, best, truncated)
-	if opt.MaxTokens > 0 && approxTokens(best) > opt.MaxTokens {
-		return Result{}, errors.New("unable to satisfy max token budget")
+	// Repair may add back sentences that were never candidates; skip it if that breaks a limit.
+	// It only appends, so the text needs measuring again only when it grew.
+	if repaired := ensureHeadingContinuity(in, best, truncated); len(repaired) > len(best) {
+		if rs := api.Measure(repaired, opt.Tokenizer); rs.Within(limit) {
+			best, size = repaired, rs
+		}
+	}
+	if !size.Within(limit) {
+		return Result{}, errors.New("unable to satisfy size limits")
 	}
 	m.BudgetLoopMS = time.Since(budgetStart).Milliseconds()
 	m.PeakMemoryEstimateB = tracker.Peak
+	var prov []Provenance
+	if cfg.Provenance {
+		prov = traceProvenance(in, best, cfg.SourceMap)
+		for i := range prov {
+			prov[i].OutStart += len(header)
+			prov[i].OutEnd += len(header)
+		}
+	}
+	if len(header) > 0 {
+		best = append(header, best...)
+		size = api.Measure(best, opt.Tokenizer)
+	}
 
 	return Result{
 		Text:            best,
 		BytesIn:         len(in),
 		BytesOut:        len(best),
-		TokensInApprox:  approxTokens(in),
-		TokensOutApprox: approxTokens(best),
+		TokensInApprox:  tokensIn,
+		TokensOutApprox: size.Tokens,
+		Tokenizer:       tokenizerName(opt.Tokenizer),
 		ReductionPct:    reductionPct(len(in), len(best)),
 		Aggressiveness:  current,
 		Profile:         opt.Profile,
@@ -160,5 +255,9 @@ func RunResultWithConfig(in []byte, opt api.Options, sourceType string, warnings
 		SourceType:      sourceType,
 		Warnings:        allWarnings,
 		Metrics:         m,
+		Metadata:        cfg.Metadata,
+		Sections:        sections,
+		Provenance:      prov,
+		Targets:         targets(opt, tokensIn, size),
 	}, nil
 }
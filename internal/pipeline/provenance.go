@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"bytes"
+
+	"contextsqueezer/pkg/format"
+)
+
+// Provenance ties a byte range of the squeezed output to the input range it was copied from
+// and, when the ingester supplied a source map, to the page, paragraph, line or element.
+type Provenance struct {
+	OutStart int `json:"out_start"`
+	OutEnd   int `json:"out_end"`
+	InStart  int `json:"in_start"`
+	InEnd    int `json:"in_end"`
+	format.Location
+}
+
+func onlySpace(b []byte) bool { return len(bytes.TrimSpace(b)) == 0 }
+
+// traceProvenance finds every output sentence in the input. Sentences are kept in input order,
+// so the search resumes where the previous one matched and only restarts from the beginning
+// for text moved by heading continuity. Adjacent sentences from one location are merged.
+func traceProvenance(in, out []byte, sourceMap []format.SourceSpan) []Provenance {
+	prov := make([]Provenance, 0)
+	cursor := 0
+	for _, sp := range segmentSentences(out) {
+		sent := bytes.TrimSpace(out[sp.s:sp.e])
+		if len(sent) == 0 {
+			continue
+		}
+		outStart := sp.s + bytes.Index(out[sp.s:sp.e], sent)
+		at := bytes.Index(in[cursor:], sent)
+		if at >= 0 {
+			at += cursor
+		} else if at = bytes.Index(in, sent); at < 0 {
+			continue
+		}
+		cursor = at + len(sent)
+		loc, _ := format.Locate(sourceMap, at)
+		if n := len(prov); n > 0 {
+			last := &prov[n-1]
+			if last.Location == loc && outStart >= last.OutEnd && onlySpace(out[last.OutEnd:outStart]) &&
+				at >= last.InEnd && onlySpace(in[last.InEnd:at]) {
+				last.OutEnd = outStart + len(sent)
+				last.InEnd = at + len(sent)
+				continue
+			}
+		}
+		prov = append(prov, Provenance{OutStart: outStart, OutEnd: outStart + len(sent), InStart: at, InEnd: at + len(sent), Location: loc})
+	}
+	return prov
+}
@@ -0,0 +1,60 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/format"
+)
+
+func TestTraceProvenance(t *testing.T) {
+	in := []byte("Intro sentence. Dropped filler. Kept one. Kept two.\n\nLast part here.")
+	out := []byte("Intro sentence. Kept one. Kept two.\n\nLast part here.")
+	sm := []format.SourceSpan{
+		{Start: 0, End: 51, Location: format.Location{Page: 1}},
+		{Start: 53, End: 68, Location: format.Location{Page: 2}},
+	}
+	prov := traceProvenance(in, out, sm)
+	want := []Provenance{
+		{OutStart: 0, OutEnd: 15, InStart: 0, InEnd: 15, Location: format.Location{Page: 1}},
+		{OutStart: 16, OutEnd: 35, InStart: 32, InEnd: 51, Location: format.Location{Page: 1}},
+		{OutStart: 37, OutEnd: 52, InStart: 53, InEnd: 68, Location: format.Location{Page: 2}},
+	}
+	if len(prov) != len(want) {
+		t.Fatalf("unexpected provenance: %+v", prov)
+	}
+	for i := range want {
+		if prov[i] != want[i] {
+			t.Fatalf("span %d: got %+v want %+v", i, prov[i], want[i])
+		}
+		if string(out[prov[i].OutStart:prov[i].OutEnd]) != string(in[prov[i].InStart:prov[i].InEnd]) {
+			t.Fatalf("span %d does not match input", i)
+		}
+	}
+}
+
+func TestMetadataHeader(t *testing.T) {
+	in := []byte("Kept sentence here.\n")
+	cfg := RunConfig{Provenance: true, Metadata: format.Metadata{Title: "Q3  Report", Pages: 4}, MetadataHeader: true}
+	res, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 0}, "text", nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "[title: Q3 Report | pages: 4]\n\n"
+	if !strings.HasPrefix(string(res.Text), header) {
+		t.Fatalf("missing header: %q", res.Text)
+	}
+	if len(res.Provenance) == 0 || res.Provenance[0].OutStart != len(header) {
+		t.Fatalf("provenance not shifted past header: %+v", res.Provenance)
+	}
+
+	res, err = RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 0, MaxTokens: 12}, "text", nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(string(res.Text), "[") || res.TokensOutApprox > 12 {
+		t.Fatalf("header should be dropped when it does not fit: %q", res.Text)
+	}
+}
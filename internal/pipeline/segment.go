@@ -0,0 +1,225 @@
+package pipeline
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// topicBlockSentences is the TextTiling block size: the number of sentences compared on
+	// each side of a candidate gap. It is also the minimum topic section length.
+	topicBlockSentences = 10
+	topicKeywords       = 3
+)
+
+// Section is a byte range of the input that was squeezed as one chunk. Heading is set when the
+// section starts at a Markdown heading; Keywords when it was found by topic segmentation.
+// Relevance, with a query, is the highest BM25 relevance among the sentences the engine kept
+// from it, and is unset when none are.
+type Section struct {
+	Start     int      `json:"start"`
+	End       int      `json:"end"`
+	Heading   string   `json:"heading,omitempty"`
+	Keywords  []string `json:"keywords,omitempty"`
+	Relevance *float64 `json:"relevance,omitempty"`
+}
+
+func roundRelevance(r *float64) *float64 {
+	if r == nil {
+		return nil
+	}
+	v := math.Round(*r*1e4) / 1e4
+	return &v
+}
+
+var topicStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true, "you": true, "all": true,
+	"any": true, "can": true, "had": true, "her": true, "was": true, "one": true, "our": true, "out": true,
+	"has": true, "him": true, "his": true, "how": true, "its": true, "may": true, "new": true, "now": true,
+	"see": true, "who": true, "did": true, "get": true, "let": true, "say": true, "she": true, "too": true,
+	"use": true, "that": true, "with": true, "have": true, "this": true, "will": true, "your": true,
+	"from": true, "they": true, "been": true, "were": true, "said": true, "each": true, "which": true,
+	"their": true, "there": true, "what": true, "about": true, "would": true, "these": true, "other": true,
+	"into": true, "than": true, "then": true, "them": true, "some": true, "could": true, "when": true,
+	"just": true, "like": true, "also": true, "only": true, "more": true, "very": true, "well": true,
+	"yeah": true, "okay": true, "know": true, "think": true, "going": true, "really": true, "right": true,
+}
+
+// topicTerms lowercases the words of s and drops stopwords and words shorter than three bytes.
+func topicTerms(s []byte) []string {
+	terms := make([]string, 0)
+	for _, w := range bytes.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		t := strings.ToLower(string(w))
+		if len(t) >= 3 && !topicStopwords[t] {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// topicBoundaries returns the sentence indexes that start a new topic, using TextTiling: the
+// lexical similarity of the blocks either side of each gap is smoothed, every local minimum
+// is scored by how deep it sits between the surrounding peaks, and gaps deeper than
+// mean - stddev/2 become boundaries, keeping sections at least one block long.
+func topicBoundaries(sentences [][]string) []int {
+	n := len(sentences)
+	w := topicBlockSentences
+	if n < 3*w {
+		return nil
+	}
+	ids := map[string]int{}
+	seqs := make([][]int, n)
+	for i, terms := range sentences {
+		for _, t := range terms {
+			id, ok := ids[t]
+			if !ok {
+				id = len(ids)
+				ids[t] = id
+			}
+			seqs[i] = append(seqs[i], id)
+		}
+	}
+	left, right := make([]int, len(ids)), make([]int, len(ids))
+	var dot, sqL, sqR int
+	addL := func(s int, d int) {
+		for _, id := range seqs[s] {
+			if d > 0 {
+				sqL += 2*left[id] + 1
+			} else {
+				sqL -= 2*left[id] - 1
+			}
+			left[id] += d
+			dot += d * right[id]
+		}
+	}
+	addR := func(s int, d int) {
+		for _, id := range seqs[s] {
+			if d > 0 {
+				sqR += 2*right[id] + 1
+			} else {
+				sqR -= 2*right[id] - 1
+			}
+			right[id] += d
+			dot += d * left[id]
+		}
+	}
+	// gap g sits before sentence g; score[g] compares sentences [g-w, g) with [g, g+w).
+	for s := 0; s < w; s++ {
+		addR(s, 1)
+	}
+	score := make([]float64, n)
+	for g := 1; g < n; g++ {
+		addR(g-1, -1)
+		addL(g-1, 1)
+		if g-1-w >= 0 {
+			addL(g-1-w, -1)
+		}
+		if g+w-1 < n {
+			addR(g+w-1, 1)
+		}
+		if sqL > 0 && sqR > 0 {
+			score[g] = float64(dot) / math.Sqrt(float64(sqL)*float64(sqR))
+		}
+	}
+	smooth := make([]float64, n)
+	for g := 1; g < n; g++ {
+		lo, hi := max(g-1, 1), min(g+1, n-1)
+		sum := 0.0
+		for k := lo; k <= hi; k++ {
+			sum += score[k]
+		}
+		smooth[g] = sum / float64(hi-lo+1)
+	}
+
+	type gap struct {
+		at    int
+		depth float64
+	}
+	gaps := make([]gap, 0)
+	for g := w; g <= n-w; g++ {
+		if smooth[g] > smooth[g-1] || smooth[g] > smooth[g+1] {
+			continue
+		}
+		lp, rp := smooth[g], smooth[g]
+		for k := g - 1; k >= 1 && smooth[k] >= lp; k-- {
+			lp = smooth[k]
+		}
+		for k := g + 1; k < n && smooth[k] >= rp; k++ {
+			rp = smooth[k]
+		}
+		if d := (lp - smooth[g]) + (rp - smooth[g]); d > 0 {
+			gaps = append(gaps, gap{at: g, depth: d})
+		}
+	}
+	if len(gaps) == 0 {
+		return nil
+	}
+	mean, sd := 0.0, 0.0
+	for _, gp := range gaps {
+		mean += gp.depth
+	}
+	mean /= float64(len(gaps))
+	for _, gp := range gaps {
+		sd += (gp.depth - mean) * (gp.depth - mean)
+	}
+	sd = math.Sqrt(sd / float64(len(gaps)))
+	cutoff := mean - sd/2
+
+	sort.SliceStable(gaps, func(i, j int) bool { return gaps[i].depth > gaps[j].depth })
+	cuts := make([]int, 0)
+	for _, gp := range gaps {
+		if gp.depth <= cutoff {
+			break
+		}
+		ok := true
+		for _, c := range cuts {
+			if gp.at-c < w && c-gp.at < w {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			cuts = append(cuts, gp.at)
+		}
+	}
+	sort.Ints(cuts)
+	return cuts
+}
+
+// sectionKeywords labels each section with its highest tf-idf terms, treating sections as the
+// documents, so words common to the whole input do not crowd out what sets a section apart.
+func sectionKeywords(sections [][][]string) [][]string {
+	tfs := make([]map[string]int, len(sections))
+	df := map[string]int{}
+	for i, sentences := range sections {
+		tfs[i] = map[string]int{}
+		for _, terms := range sentences {
+			for _, t := range terms {
+				if tfs[i][t] == 0 {
+					df[t]++
+				}
+				tfs[i][t]++
+			}
+		}
+	}
+	out := make([][]string, len(sections))
+	for i, tf := range tfs {
+		weight := make(map[string]float64, len(tf))
+		words := make([]string, 0, len(tf))
+		for t, n := range tf {
+			weight[t] = float64(n) * math.Log(float64(1+len(sections))/float64(df[t]))
+			words = append(words, t)
+		}
+		sort.Slice(words, func(a, b int) bool {
+			if weight[words[a]] != weight[words[b]] {
+				return weight[words[a]] > weight[words[b]]
+			}
+			return words[a] < words[b]
+		})
+		out[i] = append([]string(nil), words[:min(len(words), topicKeywords)]...)
+	}
+	return out
+}
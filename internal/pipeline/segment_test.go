@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"contextsqueezer/pkg/api"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTopicSegmentation(t *testing.T) {
+	var b strings.Builder
+	cooking := []string{"flour", "butter", "oven", "dough", "sugar", "bake"}
+	space := []string{"orbit", "rocket", "planet", "telescope", "galaxy", "launch"}
+	for i := 0; i < 24; i++ {
+		fmt.Fprintf(&b, "We discussed the %s and the %s before the %s on day %d. ", cooking[i%6], cooking[(i+1)%6], cooking[(i+3)%6], i)
+	}
+	shift := b.Len()
+	for i := 0; i < 24; i++ {
+		fmt.Fprintf(&b, "We discussed the %s and the %s before the %s on day %d. ", space[i%6], space[(i+2)%6], space[(i+4)%6], i)
+	}
+	in := []byte(b.String())
+
+	chunks, sections := splitChunks(in)
+	if len(chunks) != 2 || len(sections) != 2 {
+		t.Fatalf("expected two topic sections, got %+v", sections)
+	}
+	if sections[1].Start != shift {
+		t.Fatalf("boundary at %d, want %d", sections[1].Start, shift)
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), in) {
+		t.Fatal("chunks do not cover the input")
+	}
+	if kw := strings.Join(sections[1].Keywords, ","); kw != "galaxy,launch,orbit" || sections[0].Heading != "" {
+		t.Fatalf("unexpected section labels: %+v", sections)
+	}
+
+	_, sections = splitChunks([]byte("# Intro\nFirst part.\n# Next\nSecond part.\n"))
+	if len(sections) != 2 || sections[1].Heading != "Next" || sections[1].Keywords != nil {
+		t.Fatalf("unexpected heading sections: %+v", sections)
+	}
+}
+
+func TestSectionRelevance(t *testing.T) {
+	in := partsDoc()
+	in = bytes.Replace(in, []byte("# Part C\n\n"), []byte("# Part C\n\nEntry zz reports the glacier. The glacier retreats.\n\n"), 1)
+	res, err := RunResult(in, api.Options{Aggressiveness: 6, Query: "glacier"}, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	if len(res.Sections) != 4 || !bytes.Contains(res.Text, []byte("The glacier retreats.")) {
+		t.Fatalf("unexpected result: %+v", res.Sections)
+	}
+	for i, s := range res.Sections {
+		if s.Relevance == nil || (*s.Relevance > 0) != (i == 2) {
+			t.Fatalf("section %d relevance %v", i, s.Relevance)
+		}
+	}
+	var out bytes.Buffer
+	res, err = RunStream(context.Background(), bytes.NewReader(in), &out, api.Options{Aggressiveness: 6, Query: "glacier"}, RunConfig{})
+	if err != nil {
+		t.Fatalf("RunStream: %v", err)
+	}
+	if s := res.Sections[2]; s.Relevance == nil || *s.Relevance <= 0 {
+		t.Fatalf("stream section relevance %v", s.Relevance)
+	}
+	res, _ = RunResult(in, api.Options{Aggressiveness: 6}, "text", nil)
+	if res.Sections[2].Relevance != nil {
+		t.Fatal("relevance reported without a query")
+	}
+}
+
+func TestSectionRelevanceAfterFit(t *testing.T) {
+	in := partsDoc()
+	in = bytes.Replace(in, []byte("# Part C\n\n"), []byte("# Part C\n\nEntry zz reports the glacier. The glacier retreats.\n\n"), 1)
+	opt := api.Options{Aggressiveness: 2, MaxTokens: 40, Query: "glacier"}
+	res, err := RunResult(in, opt, "text", nil)
+	if err != nil {
+		t.Fatalf("RunResult: %v", err)
+	}
+	var out bytes.Buffer
+	streamed, err := RunStream(context.Background(), bytes.NewReader(in), &out, opt, RunConfig{StreamSize: int64(len(in))})
+	if err != nil {
+		t.Fatalf("RunStream: %v", err)
+	}
+	for name, r := range map[string]struct {
+		sections []Section
+		text     []byte
+	}{"run": {res.Sections, res.Text}, "stream": {streamed.Sections, out.Bytes()}} {
+		relevant := 0
+		for i, s := range r.sections {
+			if s.Relevance == nil {
+				continue
+			}
+			relevant++
+			kept := false
+			for _, sp := range segmentSentences(in[s.Start:s.End]) {
+				sent := bytes.TrimSpace(in[s.Start+sp.s : s.Start+sp.e])
+				kept = kept || (len(sent) > 0 && sent[0] != '#' && bytes.Contains(r.text, sent))
+			}
+			if !kept {
+				t.Fatalf("%s: section %d reports relevance %v but kept nothing", name, i, *s.Relevance)
+			}
+		}
+		if relevant == 0 || relevant == len(r.sections) || !bytes.Contains(r.text, []byte("glacier")) {
+			t.Fatalf("%s: %d of %d sections relevant in %q", name, relevant, len(r.sections), r.text)
+		}
+	}
+}
@@ -1,23 +1,50 @@
 package pipeline
 
 import (
+	"bufio"
 	"bytes"
 	"container/list"
+	"context"
 	"contextsqueezer/internal/metrics"
 	"contextsqueezer/internal/runtime"
+	"contextsqueezer/internal/textnorm"
 	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/format"
+	"errors"
 	"hash/fnv"
+	"io"
+	goruntime "runtime"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	defaultChunkSentences = 500
 	defaultRegistryCap    = 100000
+	defaultWindowBytes    = 1 << 20
 )
 
 type RunConfig struct {
 	MaxMemoryMB int
+	// Provenance traces kept output spans back to the input; SourceMap, when present, resolves
+	// them further to locations in the original document.
+	Provenance bool
+	SourceMap  []format.SourceSpan
+	// Metadata is reported on the result; MetadataHeader also prepends it to the output.
+	Metadata       format.Metadata
+	MetadataHeader bool
+	// Engine compresses each chunk; nil selects api.DefaultEngine.
+	Engine api.Engine
+	// Workers bounds how many chunks are compressed concurrently; 0 means GOMAXPROCS. The
+	// output does not depend on it.
+	Workers int
+	// WindowBytes is how much RunStream reads at a time; 0 means 1 MiB.
+	WindowBytes int
+	// StreamSize is the input length RunStream should expect, or 0 when unknown.
+	StreamSize int64
+	// Prepare, when set, turns each raw RunStream window into text, returning warnings.
+	Prepare func([]byte) ([]byte, []string)
 }
 
 type sigRegistry struct {
@@ -60,7 +87,9 @@ func (r *sigRegistry) add(h uint64) {
 }
 
 // Complexity: O(n log n) over token sorting per sentence; no full pairwise document comparisons.
+// Typographic quotes, dashes and ellipses are folded first, so they never tell sentences apart.
 func sentenceSignature(in []byte) uint64 {
+	in = textnorm.Fold(in)
 	toks := strings.FieldsFunc(strings.ToLower(string(in)), func(r rune) bool {
 		return !((r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'))
 	})
@@ -109,26 +138,80 @@ func sentenceSignature(in []byte) uint64 {
 	return h.Sum64()
 }
 
-func splitChunks(in []byte) [][]byte {
+// splitChunks cuts the input at Markdown headings or, when it has none, at topic shifts, and
+// at least every defaultChunkSentences sentences.
+func splitChunks(in []byte) ([][]byte, []Section) {
 	spans := segmentSentences(in)
 	if len(spans) == 0 {
-		return [][]byte{in}
+		return [][]byte{in}, []Section{{Start: 0, End: len(in)}}
+	}
+	isHeading := func(sp span) bool {
+		s := bytes.TrimSpace(in[sp.s:sp.e])
+		return len(s) > 0 && s[0] == '#'
+	}
+	headed := false
+	for _, sp := range spans {
+		if isHeading(sp) {
+			headed = true
+			break
+		}
+	}
+	var terms [][]string
+	topic := map[int]bool{}
+	if !headed {
+		terms = make([][]string, len(spans))
+		idx := make([]int, 0, len(spans))
+		sentences := make([][]string, 0, len(spans))
+		for i, sp := range spans {
+			if onlySpace(in[sp.s:sp.e]) {
+				continue
+			}
+			terms[i] = topicTerms(in[sp.s:sp.e])
+			idx = append(idx, i)
+			sentences = append(sentences, terms[i])
+		}
+		for _, c := range topicBoundaries(sentences) {
+			topic[idx[c]] = true
+		}
 	}
 	chunks := make([][]byte, 0)
+	sections := make([]Section, 0)
+	sectionTerms := make([][][]string, 0)
+	closeChunk := func(first, last int) {
+		chunks = append(chunks, append([]byte{}, in[spans[first].s:spans[last].e]...))
+		sec := Section{Start: spans[first].s, End: spans[last].e}
+		for i := first; i <= last; i++ {
+			if onlySpace(in[spans[i].s:spans[i].e]) {
+				continue
+			}
+			if isHeading(spans[i]) {
+				line, _, _ := bytes.Cut(bytes.TrimSpace(in[spans[i].s:spans[i].e]), []byte("\n"))
+				sec.Heading = string(bytes.TrimSpace(bytes.TrimLeft(line, "#")))
+			}
+			break
+		}
+		sections = append(sections, sec)
+		if !headed {
+			sectionTerms = append(sectionTerms, terms[first:last+1])
+		}
+	}
 	start := 0
 	count := 0
 	for i, sp := range spans {
-		s := bytes.TrimSpace(in[sp.s:sp.e])
-		isHeading := len(s) > 0 && s[0] == '#'
-		if i > start && (isHeading || count >= defaultChunkSentences) {
-			chunks = append(chunks, append([]byte{}, in[spans[start].s:spans[i-1].e]...))
+		if i > start && (isHeading(sp) || topic[i] || count >= defaultChunkSentences) {
+			closeChunk(start, i-1)
 			start = i
 			count = 0
 		}
 		count++
 	}
-	chunks = append(chunks, append([]byte{}, in[spans[start].s:spans[len(spans)-1].e]...))
-	return chunks
+	closeChunk(start, len(spans)-1)
+	if !headed {
+		for i, kw := range sectionKeywords(sectionTerms) {
+			sections[i].Keywords = kw
+		}
+	}
+	return chunks, sections
 }
 
 func ensureHeadingContinuity(in []byte, out []byte, truncated bool) []byte {
@@ -164,62 +247,511 @@ func ensureHeadingContinuity(in []byte, out []byte, truncated bool) []byte {
 	return out
 }
 
-func squeezeStreamed(in []byte, opt api.Options, _ RunConfig, tracker *runtime.MemoryTracker, warnings *[]string) ([]byte, metrics.StageMetrics, int, error) {
-	m := metrics.StageMetrics{}
-	segStart := time.Now()
-	chunks := splitChunks(in)
-	m.SegmentationMS = time.Since(segStart).Milliseconds()
-	reg := newSigRegistry(defaultRegistryCap)
-	keptChunks := make([][]byte, 0, len(chunks))
-	currentAggr := normalizeAggr(opt)
+// chunkSqueezer compresses chunks and drops sentences that an earlier chunk already produced,
+// so callers can emit each chunk as soon as it is done. Only compress may run concurrently;
+// everything else must see chunks in input order.
+type chunkSqueezer struct {
+	ctx      context.Context
+	engine   api.Engine
+	opt      api.Options
+	aggr     int
+	reg      *sigRegistry
+	tracker  *runtime.MemoryTracker
+	warnings *[]string
+	m        metrics.StageMetrics
+}
+
+type compressed struct {
+	out []byte
+	// scored holds the engine's kept sentences as ranges of out; it is only filled when
+	// there are size limits to solve or a query to score.
+	scored []scoredSpan
+	nm     api.NativeMetrics
+	ms     int64
+}
+
+// squeezed is a chunk after dedup.
+type squeezed struct {
+	kept []byte
+	// sigs are the signatures to commit once the caller accepts kept; tracked is what kept
+	// added to the memory tracker.
+	sigs    []uint64
+	tracked int64
+	// units are the kept sentences for the budget solver when the chunk was scored.
+	units []unit
+	// relevance is the highest relevance to the query among units, or nil without a query
+	// or when none are kept.
+	relevance *float64
+}
+
+type scoredSpan struct {
+	s, e      int
+	score     float64
+	anchor    bool
+	relevance float64
+}
+
+func newChunkSqueezer(ctx context.Context, opt api.Options, cfg RunConfig, tracker *runtime.MemoryTracker, warnings *[]string) *chunkSqueezer {
+	engine := cfg.Engine
+	if engine == nil {
+		engine = api.DefaultEngine()
+	}
+	return &chunkSqueezer{ctx: ctx, engine: engine, opt: opt, aggr: normalizeAggr(opt), reg: newSigRegistry(defaultRegistryCap), tracker: tracker, warnings: warnings}
+}
+
+// admit charges ch to the memory tracker and returns the aggressiveness to squeeze it at,
+// raising it while the soft limit is exceeded. The caller releases len(ch) when done.
+func (c *chunkSqueezer) admit(ch []byte) int {
+	c.tracker.Add(int64(len(ch)))
+	if c.tracker.Current > c.tracker.Limit {
+		if c.aggr < 9 {
+			c.aggr++
+			runtime.Warnf("memory limit approached (%d MiB > %d MiB); increasing aggressiveness to %d",
+				c.tracker.Current/1024/1024, c.tracker.Limit/1024/1024, c.aggr)
+			*c.warnings = append(*c.warnings, "memory soft limit exceeded; reducing aggressiveness")
+		}
+	}
+	return c.aggr
+}
+
+// compress squeezes ch at aggr. With size limits it asks the engine for an analysis instead,
+// so they can later be met by dropping the lowest-value sentences. A target ratio replaces
+// the score cut, so sentences dropped for their score stay candidates. A query also needs the
+// analysis, for the relevance of the kept sentences. With both, the query still picks the
+// candidates, but they keep the engine's own scores for fitBudget to focus across chunks.
+func (c *chunkSqueezer) compress(ctx context.Context, ch []byte, aggr int) (compressed, error) {
+	start := time.Now()
+	opt := api.Options{Aggressiveness: aggr, Profile: c.opt.Profile, Query: c.opt.Query}
+	if !c.opt.Limited() && c.opt.Query == "" {
+		out, nm, err := c.engine.Squeeze(ctx, ch, opt)
+		return compressed{out: out, nm: nm, ms: time.Since(start).Milliseconds()}, err
+	}
+	var scores []float64
+	if c.opt.Limited() {
+		opt.Query = ""
+	}
+	a, nm, err := c.engine.Analyze(ctx, ch, opt)
+	if err != nil {
+		return compressed{}, err
+	}
+	if c.opt.Limited() && c.opt.Query != "" {
+		scores = make([]float64, len(a.Sentences))
+		for i, s := range a.Sentences {
+			scores[i] = s.Score
+		}
+		a.Focus(c.opt.Query, aggr)
+	}
+	r := compressed{out: a.Text, nm: nm}
+	r.scored = make([]scoredSpan, 0, len(a.Sentences))
+	if len(a.Sentences) > 0 {
+		r.out = make([]byte, 0, len(a.Text))
+		for i, s := range a.Sentences {
+			if s.Reason != api.Keep && (c.opt.TargetRatio <= 0 || s.Reason != api.DropLowScore) {
+				continue
+			}
+			if scores != nil {
+				s.Score = scores[i]
+			}
+			r.scored = append(r.scored, scoredSpan{s: len(r.out), e: len(r.out) + s.End - s.Start, score: s.Score, anchor: s.Anchor, relevance: s.Relevance})
+			r.out = append(r.out, a.Text[s.Start:s.End]...)
+		}
+	}
+	r.ms = time.Since(start).Milliseconds()
+	return r, nil
+}
+
+// dedup keeps the sentences of r not produced before.
+func (c *chunkSqueezer) dedup(r compressed) squeezed {
+	c.m.PruneMS += r.ms
+	c.m.TokensParsed += r.nm.TokensParsed
+	c.m.SentencesTotal += r.nm.SentencesTotal
+	c.m.SimilarityCandidates += r.nm.SimilarityCandidates
+	c.m.SimilarityPairs += r.nm.SimilarityPairs
+
+	dedStart := time.Now()
+	var b bytes.Buffer
+	var tracked int64
+	var units []unit
+	if r.scored != nil {
+		units = make([]unit, 0)
+	}
+	sigs := make([]uint64, 0)
+	seen := map[uint64]bool{}
+	next := 0
+	for _, s := range segmentSentences(r.out) {
+		sent := r.out[s.s:s.e]
+		h := sentenceSignature(sent)
+		if seen[h] || c.reg.has(h) {
+			continue
+		}
+		if units != nil {
+			u := unit{s: b.Len(), e: b.Len() + len(sent), anchor: isAnchorSentence(sent)}
+			next = u.scoreFrom(r.scored, next, s)
+			units = append(units, u)
+		}
+		seen[h] = true
+		sigs = append(sigs, h)
+		_, _ = b.Write(sent)
+		c.tracker.Add(int64(len(sent)) + 64)
+		tracked += int64(len(sent)) + 64
+	}
+	c.m.CrossChunkRegistryMS += time.Since(dedStart).Milliseconds()
+	d := squeezed{kept: b.Bytes(), sigs: sigs, tracked: tracked, units: units}
+	if c.opt.Query != "" {
+		d.relevance = maxRelevance(units, nil)
+	}
+	return d
+}
 
+// errStreamDone stops squeezeAll once RunStream has spent its limits.
+var errStreamDone = errors.New("stream limits exhausted")
+
+// squeezeAll compresses up to workers chunks at once (0 means GOMAXPROCS) but admits, dedups
+// and commits them in input order, handing each to fn, so the output is byte-identical to a
+// serial run. A chunk is compressed ahead at the aggressiveness current when it was started;
+// if memory pressure raised it by the time the chunk's turn comes, the chunk is compressed
+// again at the serial value. An error from fn stops the run and is returned.
+func (c *chunkSqueezer) squeezeAll(chunks [][]byte, workers int, fn func(i int, d squeezed) error) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	if workers <= 0 {
+		workers = goruntime.GOMAXPROCS(0)
+	}
+	type job struct {
+		aggr int
+		done chan struct{}
+		res  compressed
+		err  error
+	}
+	jobs := make([]*job, len(chunks))
+	// On an early return, stop and wait for chunks still in flight so none outlive the call.
+	defer func() {
+		cancel()
+		for _, j := range jobs {
+			if j != nil {
+				<-j.done
+			}
+		}
+	}()
+	// Chunks before i are done, so starting up to i+workers keeps at most workers in flight.
+	started := 0
 	for i, ch := range chunks {
-		tracker.Add(int64(len(ch)))
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for ; started < len(chunks) && started < i+workers; started++ {
+			j := &job{aggr: c.aggr, done: make(chan struct{})}
+			jobs[started] = j
+			go func(ch []byte) {
+				defer close(j.done)
+				j.res, j.err = c.compress(ctx, ch, j.aggr)
+			}(chunks[started])
+		}
 		runtime.Debugf("processing chunk %d/%d (size=%d)", i+1, len(chunks), len(ch))
-		if tracker.Current > tracker.Limit {
-			if currentAggr < 9 {
-				currentAggr++
-				runtime.Warnf("memory limit approached (%d MiB > %d MiB); increasing aggressiveness to %d",
-					tracker.Current/1024/1024, tracker.Limit/1024/1024, currentAggr)
-				*warnings = append(*warnings, "memory soft limit exceeded; reducing aggressiveness")
-			}
+		aggr := c.admit(ch)
+		j := jobs[i]
+		jobs[i] = nil
+		<-j.done
+		r, err := j.res, j.err
+		if err == nil && j.aggr != aggr {
+			r, err = c.compress(ctx, ch, aggr)
 		}
-		pruneStart := time.Now()
-		out, err := api.SqueezeBytes(ch, api.Options{Aggressiveness: currentAggr, Profile: opt.Profile, MaxTokens: opt.MaxTokens})
-		m.PruneMS += time.Since(pruneStart).Milliseconds()
 		if err != nil {
-			return nil, m, currentAggr, err
-		}
-		// The following metrics are from the last native squeeze call
-		nm := api.LastNativeMetrics()
-		m.TokensParsed += nm.TokensParsed
-		m.SentencesTotal += nm.SentencesTotal
-		m.SimilarityCandidates += nm.SimilarityCandidates
-		m.SimilarityPairs += nm.SimilarityPairs
-
-		dedStart := time.Now()
-		sp := segmentSentences(out)
-		var b bytes.Buffer
-		for _, s := range sp {
-			sent := out[s.s:s.e]
-			h := sentenceSignature(sent)
-			if reg.has(h) {
-				continue
+			return err
+		}
+		d := c.dedup(r)
+		c.commit(d.sigs)
+		c.tracker.Release(int64(len(ch))) // Done with original chunk
+		if err := fn(i, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chunkSqueezer) commit(sigs []uint64) {
+	for _, h := range sigs {
+		c.reg.add(h)
+	}
+}
+
+// squeezeStreamed compresses chunks with up to cfg.Workers at once; see squeezeAll. With size
+// limits it also returns the output's sentences as units for fitBudget. With a query it sets
+// the relevance of the section of each chunk that kept anything; a fit that drops units
+// should set them again with setRelevance.
+func squeezeStreamed(ctx context.Context, chunks [][]byte, sections []Section, opt api.Options, cfg RunConfig, tracker *runtime.MemoryTracker, warnings *[]string) ([]byte, []unit, metrics.StageMetrics, int, error) {
+	cs := newChunkSqueezer(ctx, opt, cfg, tracker, warnings)
+	keptChunks := make([][]byte, 0, len(chunks))
+	unitsPerChunk := make([][]unit, 0, len(chunks))
+	err := cs.squeezeAll(chunks, cfg.Workers, func(i int, d squeezed) error {
+		sections[i].Relevance = roundRelevance(d.relevance)
+		// A chunk that kept nothing gets no join, so it leaves no blank line behind.
+		if len(d.kept) > 0 {
+			for j := range d.units {
+				d.units[j].section = i
 			}
-			reg.add(h)
-			_, _ = b.Write(sent)
-			_ = tracker.Add(int64(len(sent)) + 64)
+			keptChunks = append(keptChunks, d.kept)
+			unitsPerChunk = append(unitsPerChunk, d.units)
 		}
-		m.CrossChunkRegistryMS += time.Since(dedStart).Milliseconds()
-		keptChunks = append(keptChunks, b.Bytes())
-		tracker.Release(int64(len(ch))) // Done with original chunk
+		return nil
+	})
+	if err != nil {
+		return nil, nil, cs.m, cs.aggr, err
 	}
 
 	reStart := time.Now()
 	out := bytes.Join(keptChunks, []byte("\n"))
-	m.AssemblyMS = time.Since(reStart).Milliseconds()
-	m.PeakMemoryEstimateB = tracker.Peak
+	var units []unit
+	if opt.Limited() {
+		units = make([]unit, 0)
+		offset := 0
+		for i, cu := range unitsPerChunk {
+			for _, u := range cu {
+				u.s += offset
+				u.e += offset
+				units = append(units, u)
+			}
+			offset += len(keptChunks[i]) + 1
+		}
+	}
+	cs.m.AssemblyMS = time.Since(reStart).Milliseconds()
+	cs.m.PeakMemoryEstimateB = tracker.Peak
 	runtime.Infof("squeeze complete: chunks=%d, sentences=%d, tokens=%d",
-		len(chunks), m.SentencesTotal, m.TokensParsed)
-	return out, m, currentAggr, nil
+		len(chunks), cs.m.SentencesTotal, cs.m.TokensParsed)
+	return out, units, cs.m, cs.aggr, nil
+}
+
+// setRelevance sets the relevance of each section to the highest among its units that kept
+// marks, and omits it for sections that kept none.
+func setRelevance(sections []Section, units []unit, kept []bool) {
+	for i := range sections {
+		sections[i].Relevance = nil
+	}
+	for i, u := range units {
+		if kept[i] && (sections[u.section].Relevance == nil || u.relevance > *sections[u.section].Relevance) {
+			sections[u.section].Relevance = roundRelevance(&u.relevance)
+		}
+	}
+}
+
+// windowReader yields pieces of about size bytes, cut after a blank line when one comes
+// before 2*size, otherwise after the last newline or space so sentences and UTF-8 sequences
+// stay whole where possible.
+type windowReader struct {
+	br    *bufio.Reader
+	size  int
+	carry []byte
+}
+
+func (wr *windowReader) next() ([]byte, error) {
+	buf := wr.carry
+	wr.carry = nil
+	for {
+		line, err := wr.br.ReadSlice('\n')
+		buf = append(buf, line...)
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(buf) < wr.size {
+			continue
+		}
+		if err == nil && len(bytes.TrimSpace(line)) == 0 {
+			return buf, nil
+		}
+		if len(buf) < 2*wr.size {
+			continue
+		}
+		cut := bytes.LastIndexByte(buf, '\n') + 1
+		if cut < wr.size {
+			cut = bytes.LastIndexByte(buf, ' ') + 1
+		}
+		if cut < wr.size {
+			cut = len(buf)
+			if i := lastRuneStart(buf); !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+		}
+		wr.carry = append([]byte{}, buf[cut:]...)
+		return buf[:cut], nil
+	}
+}
+
+func lastRuneStart(b []byte) int {
+	i := len(b) - 1
+	for i > 0 && len(b)-i < utf8.UTFMax && !utf8.RuneStart(b[i]) {
+		i--
+	}
+	return max(i, 0)
+}
+
+// RunStream squeezes r into w window by window, so memory stays proportional to
+// cfg.WindowBytes rather than to the input. Each window is chunked like a whole document by
+// RunResultWithConfig and every chunk is written as soon as it is squeezed; the cross-chunk
+// registry still drops sentences repeated anywhere earlier in the stream. Up to cfg.Workers
+// chunks of a window are compressed at once, and the output does not depend on it.
+//
+// With size limits, output cannot be revisited, so each chunk gets a share of what is left.
+// When cfg.StreamSize is known the share is proportional to the chunk's size, so the output
+// covers the whole input: a chunk over its share keeps its highest-value sentences, dropping
+// anchors only if they alone do not fit. Room a chunk leaves unused carries over. When the
+// size is unknown, chunks are written until one no longer fits what is left. A target ratio
+// applies to each chunk on its own.
+//
+// The result has no Text, and provenance, the metadata header and heading continuity repair
+// are not applied. Section offsets refer to the prepared stream text.
+func RunStream(ctx context.Context, r io.Reader, w io.Writer, opt api.Options, cfg RunConfig) (Result, error) {
+	if cfg.MaxMemoryMB <= 0 {
+		cfg.MaxMemoryMB = 1024
+	}
+	window := cfg.WindowBytes
+	if window <= 0 {
+		window = defaultWindowBytes
+	}
+	tracker := runtime.NewMemoryTracker(cfg.MaxMemoryMB)
+	warnings := make([]string, 0)
+	seenWarning := map[string]bool{}
+	cs := newChunkSqueezer(ctx, opt, cfg, tracker, &warnings)
+	wr := &windowReader{br: bufio.NewReaderSize(r, 64*1024), size: window}
+
+	total, err := opt.Limit(nil)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Profile: opt.Profile, BudgetApplied: opt.Limited(), Tokenizer: tokenizerName(opt.Tokenizer), SourceType: "text", Metadata: cfg.Metadata, Sections: make([]Section, 0)}
+	remaining := total
+	var written api.Size
+	var consumed int64
+	offset := 0
+	wroteChunk := false
+	start := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		raw, err := wr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		consumed += int64(len(raw))
+		text := raw
+		if cfg.Prepare != nil {
+			var ws []string
+			text, ws = cfg.Prepare(raw)
+			for _, wn := range ws {
+				if !seenWarning[wn] {
+					seenWarning[wn] = true
+					warnings = append(warnings, wn)
+				}
+			}
+		}
+		res.BytesIn += len(text)
+		res.TokensInApprox += api.Measure(text, opt.Tokenizer).Tokens
+
+		segStart := time.Now()
+		chunks, sections := splitChunks(text)
+		res.Metrics.SegmentationMS += time.Since(segStart).Milliseconds()
+		for i := range sections {
+			sections[i].Start += offset
+			sections[i].End += offset
+		}
+		res.Sections = append(res.Sections, sections...)
+		offset += len(text)
+
+		chunkIn := 0
+		err = cs.squeezeAll(chunks, cfg.Workers, func(ci int, d squeezed) error {
+			ch := chunks[ci]
+			chunkIn += len(ch)
+			kept := d.kept
+			sep := 0
+			if wroteChunk && len(kept) > 0 {
+				sep = 1
+			}
+			exhausted := false
+			if opt.Limited() {
+				left := max(cfg.StreamSize-consumed+int64(len(text)-chunkIn+len(ch)), int64(len(ch)))
+				room := true
+				share := func(set, rest int) int {
+					if set <= 0 {
+						return 0
+					}
+					if cfg.StreamSize > 0 {
+						rest = int(int64(rest) * int64(len(ch)) / left)
+					}
+					room = room && rest > 0
+					return rest
+				}
+				limit := api.Size{Tokens: share(total.Tokens, remaining.Tokens), Bytes: share(total.Bytes, remaining.Bytes), Words: share(total.Words, remaining.Words)}
+				need := api.Measure(kept, opt.Tokenizer).Add(api.Size{Tokens: sep, Bytes: sep})
+				exhausted = cfg.StreamSize <= 0 && (!room || !need.Within(limit))
+				if r, _ := (api.Options{TargetRatio: opt.TargetRatio, Tokenizer: opt.Tokenizer}).Limit(ch); r.Tokens > 0 && (limit.Tokens <= 0 || r.Tokens < limit.Tokens) {
+					limit.Tokens = r.Tokens
+				}
+				if !room || !need.Within(limit) {
+					runtime.Debugf("stream budget: chunk over its %+v share", limit)
+					var fitted []byte
+					keptUnits := make([]bool, len(d.units))
+					fits := false
+					if budget := shrink(limit, api.Size{Tokens: sep, Bytes: sep}); room && !budget.IsZero() {
+						fitted, keptUnits, fits = fitBudget(kept, d.units, budget, opt.Tokenizer, opt.Query)
+					}
+					kept = fitted
+					if opt.Query != "" {
+						d.relevance = maxRelevance(d.units, keptUnits)
+					}
+					res.Truncated = res.Truncated || !fits || exhausted
+				}
+			}
+			if len(kept) > 0 {
+				res.Sections[len(res.Sections)-len(chunks)+ci].Relevance = roundRelevance(d.relevance)
+			}
+			piece := kept
+			if sep > 0 && len(kept) > 0 {
+				piece = append([]byte("\n"), kept...)
+			}
+			got := api.Measure(piece, opt.Tokenizer)
+			written = written.Add(got)
+			remaining = api.Size{Tokens: remaining.Tokens - got.Tokens, Bytes: remaining.Bytes - got.Bytes, Words: remaining.Words - got.Words}
+			asmStart := time.Now()
+			if len(piece) > 0 {
+				if _, err := w.Write(piece); err != nil {
+					return err
+				}
+				wroteChunk = true
+			}
+			res.Metrics.AssemblyMS += time.Since(asmStart).Milliseconds()
+			cs.tracker.Release(d.tracked)
+			res.BytesOut += len(piece)
+			res.TokensOutApprox += got.Tokens
+			if exhausted {
+				runtime.Infof("stream limits %+v exhausted; stopping", total)
+				return errStreamDone
+			}
+			return nil
+		})
+		if errors.Is(err, errStreamDone) {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	m := cs.m
+	m.SegmentationMS = res.Metrics.SegmentationMS
+	m.AssemblyMS = res.Metrics.AssemblyMS
+	m.BudgetLoopMS = time.Since(start).Milliseconds()
+	m.PeakMemoryEstimateB = tracker.Peak
+	res.Metrics = m
+	res.Aggressiveness = cs.aggr
+	res.ReductionPct = reductionPct(res.BytesIn, res.BytesOut)
+	res.Warnings = warnings
+	res.Targets = targets(opt, res.TokensInApprox, written)
+	return res, nil
 }
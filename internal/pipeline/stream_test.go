@@ -1,12 +1,18 @@
 package pipeline
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"contextsqueezer/pkg/api"
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func makeLargeDoc(sentences int) []byte {
@@ -28,11 +34,11 @@ func makeLargeDoc(sentences int) []byte {
 func TestLargeDocDeterministicAndFast(t *testing.T) {
 	in := makeLargeDoc(200000)
 	start := time.Now()
-	r1, err := RunResultWithConfig(in, api.Options{Aggressiveness: 0, Profile: "api"}, "text", nil, RunConfig{MaxMemoryMB: 1024})
+	r1, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 0, Profile: "api"}, "text", nil, RunConfig{MaxMemoryMB: 1024})
 	if err != nil {
 		t.Fatalf("run1: %v", err)
 	}
-	r2, err := RunResultWithConfig(in, api.Options{Aggressiveness: 0, Profile: "api"}, "text", nil, RunConfig{MaxMemoryMB: 1024})
+	r2, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 0, Profile: "api"}, "text", nil, RunConfig{MaxMemoryMB: 1024})
 	if err != nil {
 		t.Fatalf("run2: %v", err)
 	}
@@ -49,7 +55,7 @@ func TestLargeDocDeterministicAndFast(t *testing.T) {
 
 func TestHeadingContinuity(t *testing.T) {
 	in := []byte("# A\nkeep sentence after heading.\nnoise.\n# B\nanother keep sentence.\n")
-	res, err := RunResultWithConfig(in, api.Options{Aggressiveness: 9}, "text", nil, RunConfig{MaxMemoryMB: 32})
+	res, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 9}, "text", nil, RunConfig{MaxMemoryMB: 32})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,3 +66,173 @@ func TestHeadingContinuity(t *testing.T) {
 		t.Fatal("missing continuity sentence after heading B")
 	}
 }
+
+type cancellingEngine struct {
+	calls  int
+	cancel context.CancelFunc
+}
+
+func (e *cancellingEngine) Name() string { return "cancelling" }
+
+func (e *cancellingEngine) Squeeze(ctx context.Context, in []byte, opt api.Options) ([]byte, api.NativeMetrics, error) {
+	e.calls++
+	e.cancel()
+	return api.GoEngine().Squeeze(context.Background(), in, opt)
+}
+
+func (e *cancellingEngine) Analyze(ctx context.Context, in []byte, opt api.Options) (api.Analysis, api.NativeMetrics, error) {
+	e.calls++
+	e.cancel()
+	return api.GoEngine().Analyze(context.Background(), in, opt)
+}
+
+func TestRunCancelledBetweenChunks(t *testing.T) {
+	in := makeLargeDoc(5000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine := &cancellingEngine{cancel: cancel}
+	_, err := RunResultWithConfig(ctx, in, api.Options{Aggressiveness: 4}, "text", nil, RunConfig{Engine: engine, Workers: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if engine.calls != 1 {
+		t.Fatalf("expected the run to stop after the first chunk, engine ran %d times", engine.calls)
+	}
+}
+
+func TestWorkersDeterministic(t *testing.T) {
+	in := makeLargeDoc(30000)
+	engines := []api.Engine{api.GoEngine()}
+	if e, err := api.NativeEngine(); err == nil {
+		engines = append(engines, e)
+	}
+	for _, engine := range engines {
+		for _, mb := range []int{1024, 1} {
+			var base Result
+			for _, workers := range []int{1, 3, 8} {
+				res, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 4}, "text", nil, RunConfig{MaxMemoryMB: mb, Engine: engine, Workers: workers})
+				if err != nil {
+					t.Fatalf("%s workers=%d: %v", engine.Name(), workers, err)
+				}
+				if workers == 1 {
+					base = res
+					continue
+				}
+				if !bytes.Equal(res.Text, base.Text) || res.Aggressiveness != base.Aggressiveness || strings.Join(res.Warnings, "|") != strings.Join(base.Warnings, "|") {
+					t.Fatalf("%s max-memory-mb=%d: output with %d workers differs from serial", engine.Name(), mb, workers)
+				}
+			}
+		}
+		for _, opt := range []api.Options{{Aggressiveness: 4}, {Aggressiveness: 4, MaxTokens: 20000}} {
+			var base []byte
+			for _, workers := range []int{1, 3, 8} {
+				var out bytes.Buffer
+				if _, err := RunStream(context.Background(), bytes.NewReader(in), &out, opt, RunConfig{Engine: engine, Workers: workers}); err != nil {
+					t.Fatalf("%s stream workers=%d: %v", engine.Name(), workers, err)
+				}
+				if workers == 1 {
+					base = out.Bytes()
+				} else if !bytes.Equal(out.Bytes(), base) {
+					t.Fatalf("%s %+v: stream output with %d workers differs from serial", engine.Name(), opt, workers)
+				}
+			}
+		}
+	}
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWindowReaderKeepsInput(t *testing.T) {
+	in := []byte(strings.Repeat("para one. para two.\n\n", 300) + strings.Repeat("é", 5000) + strings.Repeat("word ", 2000))
+	wr := &windowReader{br: bufio.NewReaderSize(bytes.NewReader(in), 16), size: 1000}
+	var got []byte
+	for {
+		w, err := wr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w) > 2*1000+16 || !utf8.Valid(w) {
+			t.Fatalf("bad window of %d bytes", len(w))
+		}
+		got = append(got, w...)
+	}
+	if !bytes.Equal(got, in) {
+		t.Fatal("windows do not reassemble the input")
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&b, "Entry %c%c reports the sensor reading as stable today. Operators logged shift %c handover.\n\n", 'a'+i%26, 'a'+i/26%26, 'a'+i%7)
+	}
+	in := []byte(b.String())
+
+	// One window: the same chunks as a whole-document run.
+	var out countingWriter
+	res, err := RunStream(context.Background(), bytes.NewReader(in), &out, api.Options{Aggressiveness: 6}, RunConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := RunResultWithConfig(context.Background(), in, api.Options{Aggressiveness: 6}, "text", nil, RunConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), batch.Text) || res.BytesOut != out.Len() || len(res.Sections) != len(batch.Sections) {
+		t.Fatalf("stream output differs from batch: %d vs %d bytes", out.Len(), len(batch.Text))
+	}
+
+	// Small windows: output is written incrementally and repeats across windows are dropped.
+	repeated := append(append([]byte{}, in...), in...)
+	out = countingWriter{}
+	res, err = RunStream(context.Background(), bytes.NewReader(repeated), &out, api.Options{Aggressiveness: 0}, RunConfig{WindowBytes: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.writes < 10 || res.BytesIn != len(repeated) || res.Metrics.PeakMemoryEstimateB > 64*1024 {
+		t.Fatalf("expected incremental bounded writes, got %d writes, peak %d", out.writes, res.Metrics.PeakMemoryEstimateB)
+	}
+	if n := strings.Count(out.String(), "Entry aa reports"); n != 1 {
+		t.Fatalf("sentence repeated across windows kept %d times", n)
+	}
+
+	// Budgets hold with and without a known size. A known size spreads output to the end by
+	// dropping low-value sentences, so only an unknown size cuts the stream short.
+	for _, size := range []int64{0, int64(len(in))} {
+		out = countingWriter{}
+		res, err = RunStream(context.Background(), bytes.NewReader(in), &out, api.Options{Aggressiveness: 2, MaxTokens: 600}, RunConfig{WindowBytes: 2048, StreamSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if api.Measure(out.Bytes(), nil).Tokens > 600 || res.Truncated != (size == 0) {
+			t.Fatalf("size %d: budget not honored: %d tokens, truncated %v", size, api.Measure(out.Bytes(), nil).Tokens, res.Truncated)
+		}
+		reachedEnd := false
+		for i := 360; i < 400; i++ {
+			reachedEnd = reachedEnd || strings.Contains(out.String(), fmt.Sprintf("Entry %c%c ", 'a'+i%26, 'a'+i/26%26))
+		}
+		if reachedEnd != (size > 0) {
+			t.Fatalf("size %d: unexpected coverage of the input tail: %v", size, reachedEnd)
+		}
+	}
+}
+
+func TestSentenceSignatureFoldsPunctuation(t *testing.T) {
+	if sentenceSignature([]byte("“—…”")) != sentenceSignature([]byte(`"-..."`)) {
+		t.Fatal("typographic punctuation changed the signature")
+	}
+	if sentenceSignature([]byte("It’s done – ok.")) != sentenceSignature([]byte("It's done - ok.")) {
+		t.Fatal("typographic punctuation changed the signature")
+	}
+}
@@ -0,0 +1,228 @@
+package textnorm
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+type Report struct {
+	Composed  int
+	Invisible int
+	Bidi      int
+	Tags      int
+	Spaces    int
+}
+
+func (r *Report) Add(o Report) {
+	r.Composed += o.Composed
+	r.Invisible += o.Invisible
+	r.Bidi += o.Bidi
+	r.Tags += o.Tags
+	r.Spaces += o.Spaces
+}
+
+func (r Report) Warnings() []string {
+	warnings := []string{}
+	if r.Invisible > 0 {
+		warnings = append(warnings, fmt.Sprintf("normalize: removed %d invisible characters", r.Invisible))
+	}
+	if r.Bidi > 0 {
+		warnings = append(warnings, fmt.Sprintf("normalize: removed %d bidi control characters (possible hidden text)", r.Bidi))
+	}
+	if r.Tags > 0 {
+		warnings = append(warnings, fmt.Sprintf("normalize: removed %d unicode tag characters (possible hidden prompt text)", r.Tags))
+	}
+	return warnings
+}
+
+func isInvisible(r rune) bool {
+	switch r {
+	case 0x00AD, 0x034F, 0x061C, 0x115F, 0x1160, 0x17B4, 0x17B5, 0x180E, 0x200B, 0x2060, 0x2061, 0x2062, 0x2063, 0x2064, 0x3164, 0xFEFF, 0xFFA0:
+		return true
+	}
+	return false
+}
+
+func isBidiControl(r rune) bool {
+	return r == 0x200E || r == 0x200F || (r >= 0x202A && r <= 0x202E) || (r >= 0x2066 && r <= 0x2069)
+}
+
+func isTagChar(r rune) bool { return r >= 0xE0000 && r <= 0xE007F }
+
+func isOddSpace(r rune) bool {
+	return r == 0x00A0 || r == 0x1680 || (r >= 0x2000 && r <= 0x200A) || r == 0x202F || r == 0x205F || r == 0x3000
+}
+
+func compose(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	}
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 && b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + (b - hangulTBase), true
+	}
+	c, ok := composePairs[[2]rune{a, b}]
+	return c, ok
+}
+
+// decompose appends the full canonical decomposition of r to buf and returns it with the
+// number of characters r grew by.
+func decompose(buf []rune, r rune) ([]rune, int) {
+	if r >= hangulSBase && r < hangulSBase+hangulSCount {
+		s := r - hangulSBase
+		buf = append(buf, hangulLBase+s/hangulNCount, hangulVBase+(s%hangulNCount)/hangulTCount)
+		if t := s % hangulTCount; t != 0 {
+			return append(buf, hangulTBase+t), 2
+		}
+		return buf, 1
+	}
+	if d, ok := decompositions[r]; ok {
+		return append(buf, d...), len(d) - 1
+	}
+	return append(buf, r), 0
+}
+
+// recompose puts the combining marks of seg in canonical order and composes it as NFC does,
+// in place. It returns the result and the number of compositions.
+func recompose(seg []rune) ([]rune, int) {
+	for i := 1; i < len(seg); i++ {
+		c := combiningClasses[seg[i]]
+		if c == 0 {
+			continue
+		}
+		for j := i; j > 0 && combiningClasses[seg[j-1]] > c; j-- {
+			seg[j], seg[j-1] = seg[j-1], seg[j]
+		}
+	}
+	composed := 0
+	starter := -1
+	var last uint8
+	w := 0
+	for _, r := range seg {
+		c := combiningClasses[r]
+		if starter >= 0 && (w-1 == starter || (last != 0 && last < c)) {
+			if comp, ok := compose(seg[starter], r); ok {
+				seg[starter] = comp
+				composed++
+				continue
+			}
+		}
+		if c == 0 {
+			starter = w
+		}
+		last = c
+		seg[w] = r
+		w++
+	}
+	return seg[:w], composed
+}
+
+// Normalize converts to NFC, maps exotic spaces to ASCII space and strips zero-width,
+// bidi-control and tag characters. Composed counts the characters merged away by composition.
+// Invalid UTF-8 bytes are passed through untouched.
+func Normalize(in []byte) ([]byte, Report) {
+	rep := Report{}
+	ascii := true
+	for _, c := range in {
+		if c >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return in, rep
+	}
+
+	out := make([]byte, 0, len(in))
+	// seg holds the decomposed characters since the last ASCII one. No character composes
+	// with a following ASCII character, so segments can be composed independently.
+	seg := make([]rune, 0, 16)
+	grown := 0
+	flush := func() {
+		var composed int
+		seg, composed = recompose(seg)
+		rep.Composed += composed
+		for _, r := range seg {
+			out = utf8.AppendRune(out, r)
+		}
+		seg = seg[:0]
+	}
+	for i := 0; i < len(in); {
+		r, size := utf8.DecodeRune(in[i:])
+		if r == utf8.RuneError && size <= 1 {
+			flush()
+			out = append(out, in[i])
+			i++
+			continue
+		}
+		i += size
+		switch {
+		case isBidiControl(r):
+			rep.Bidi++
+			continue
+		case isTagChar(r):
+			rep.Tags++
+			continue
+		case isInvisible(r):
+			rep.Invisible++
+			continue
+		case isOddSpace(r):
+			rep.Spaces++
+			r = ' '
+		}
+		if r < utf8.RuneSelf {
+			flush()
+			seg = append(seg, r)
+			continue
+		}
+		var n int
+		seg, n = decompose(seg, r)
+		grown += n
+	}
+	flush()
+	rep.Composed -= grown
+	return out, rep
+}
+
+// Fold maps typographic quotes, dashes and ellipses to ASCII so that visually identical
+// sentences share a dedup key. It is only used for signatures, never for emitted text.
+func Fold(in []byte) []byte {
+	if bytes.IndexFunc(in, func(r rune) bool { return r >= 0x2010 && r <= 0x2212 }) < 0 {
+		return in
+	}
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		r, size := utf8.DecodeRune(in[i:])
+		if r == utf8.RuneError && size <= 1 {
+			out = append(out, in[i])
+			i++
+			continue
+		}
+		i += size
+		switch r {
+		case 0x2018, 0x2019, 0x201A, 0x201B, 0x2032:
+			out = append(out, '\'')
+		case 0x201C, 0x201D, 0x201E, 0x201F, 0x2033:
+			out = append(out, '"')
+		case 0x2010, 0x2011, 0x2012, 0x2013, 0x2014, 0x2015, 0x2212:
+			out = append(out, '-')
+		case 0x2026:
+			out = append(out, '.', '.', '.')
+		default:
+			out = utf8.AppendRune(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package textnorm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeComposesAndScrubs(t *testing.T) {
+	in := []byte("cafe\u0301 Vie\u0323\u0302t\u00a0Nam zero\u200bwidth soft\u00adhyphen \u1100\u1161")
+	out, rep := Normalize(in)
+	want := "caf\u00e9 Vi\u1ec7t Nam zerowidth softhyphen \uac00"
+	if string(out) != want {
+		t.Fatalf("got %q want %q", out, want)
+	}
+	if rep.Composed != 4 || rep.Invisible != 2 || rep.Spaces != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if len(rep.Warnings()) != 1 {
+		t.Fatalf("expected one warning, got %v", rep.Warnings())
+	}
+}
+
+func TestNormalizeCanonical(t *testing.T) {
+	cases := map[string]string{
+		"e\u0302\u0323":      "\u1ec7",
+		"a\u0316\u0301":      "\u00e1\u0316",
+		"\u2126 ohm":         "\u03a9 ohm",
+		"\u1ec7 \u00e9":      "\u1ec7 \u00e9",
+		"\u0344":             "\u0308\u0301",
+		"\ud55c\u1100\u1161": "\ud55c\uac00",
+	}
+	for in, want := range cases {
+		if out, _ := Normalize([]byte(in)); string(out) != want {
+			t.Errorf("Normalize(%+q) = %+q, want %+q", in, out, want)
+		}
+	}
+}
+
+func TestNormalizeReportsHiddenText(t *testing.T) {
+	in := []byte("approve\u202e\u2066 invoice \U000E0069\U000E0067\U000E006E")
+	out, rep := Normalize(in)
+	if string(out) != "approve invoice " {
+		t.Fatalf("unexpected output %q", out)
+	}
+	w := strings.Join(rep.Warnings(), "; ")
+	if !strings.Contains(w, "2 bidi control") || !strings.Contains(w, "3 unicode tag") {
+		t.Fatalf("unexpected warnings: %s", w)
+	}
+}
+
+func TestNormalizePassesInvalidUTF8(t *testing.T) {
+	in := []byte{'a', 0xff, 0xfe, 'b'}
+	out, _ := Normalize(in)
+	if string(out) != string(in) {
+		t.Fatalf("invalid bytes must pass through, got %q", out)
+	}
+}
+
+func TestFold(t *testing.T) {
+	got := string(Fold([]byte("\u201cIt\u2019s\u201d \u2013 done\u2026")))
+	if got != `"It's" - done...` {
+		t.Fatalf("unexpected fold: %q", got)
+	}
+}
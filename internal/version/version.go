@@ -10,3 +10,9 @@ func Current() string {
 	}
 	return api.Version()
 }
+
+// CGO reports "enabled" when the binary was built with cgo, and so with the native engine,
+// and "disabled" otherwise.
+func CGO() string {
+	return cgo
+}
@@ -3,6 +3,8 @@
 
 #include <stddef.h>
 
+#include "metrics.h"
+
 #ifdef __cplusplus
 extern "C" {
 #endif
@@ -22,16 +24,52 @@ typedef enum {
   CSQ_ERR_INVALID_ARG = 1,
   CSQ_ERR_MALLOC = 2,
   CSQ_ERR_INTERNAL = 3,
-  CSQ_ERR_INVALID_DATA = 4
+  CSQ_ERR_INVALID_DATA = 4,
+  CSQ_ERR_ABORTED = 5
 } csq_error;
 
+typedef enum {
+  CSQ_KEEP = 0,
+  CSQ_DROP_NEAR_DUPLICATE = 1,
+  CSQ_DROP_LOW_SCORE = 2
+} csq_drop_reason;
+
+typedef struct {
+  size_t start;
+  size_t end;
+  double score;
+  int anchor;
+  int reason;
+} csq_sentence;
+
+typedef struct {
+  csq_buf text;
+  csq_sentence* sentences;
+  size_t count;
+} csq_analysis;
+
 typedef void (*csq_progress_cb)(float percentage, void* user_data);
+/* Returning non-zero stops the squeeze; the call then fails with CSQ_ERR_ABORTED. */
+typedef int (*csq_progress_abort_cb)(float percentage, void* user_data);
 
 int csq_squeeze(csq_view in, csq_buf* out);
 int csq_squeeze_ex(csq_view in, int aggressiveness, csq_buf* out);
 int csq_squeeze_progress(csq_view in, int aggressiveness, csq_progress_cb cb, void* user_data, csq_buf* out);
+/* Like csq_squeeze_progress, but the callback may abort the call, and this call's counters are
+   stored in *metrics when it is not NULL. Unlike csq_metrics_get, the result is not shared
+   between concurrent calls. */
+int csq_squeeze_metrics(csq_view in, int aggressiveness, csq_progress_abort_cb cb, void* user_data, csq_buf* out,
+                        csq_metrics_snapshot* metrics);
+
+/* Scores every sentence once. text is the input without repeated and low-entropy blocks, and
+   sentence offsets index into it; the sentences with reason CSQ_KEEP, concatenated, are what
+   csq_squeeze_metrics returns for the same arguments. At aggressiveness 0 nothing is removed,
+   but sentences are still scored. Free the result with csq_analysis_free. */
+int csq_analyze(csq_view in, int aggressiveness, csq_progress_abort_cb cb, void* user_data, csq_analysis* out,
+                csq_metrics_snapshot* metrics);
 
 void csq_free(csq_buf* buf);
+void csq_analysis_free(csq_analysis* analysis);
 const char* csq_version(void);
 const char* csq_last_error(void);
 
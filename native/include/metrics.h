@@ -19,6 +19,9 @@ void csq_metrics_add_tokens(uint64_t n);
 void csq_metrics_add_sentences(uint64_t n);
 void csq_metrics_add_candidates(uint64_t n);
 void csq_metrics_add_pairs(uint64_t n);
+/* Counters of the most recent squeeze in the process made without a metrics out-parameter
+   (csq_squeeze, csq_squeeze_ex, csq_squeeze_progress, or NULL metrics); under concurrent calls
+   it is one of them. Prefer the metrics out-parameter of csq_squeeze_metrics. */
 csq_metrics_snapshot csq_metrics_get(void);
 
 #ifdef __cplusplus
@@ -15,6 +15,9 @@
 #include <utility>
 #include <vector>
 
+// Defined in metrics.cpp: replaces the snapshot behind csq_metrics_get in one step.
+void csq_metrics_store(const csq_metrics_snapshot& m);
+
 namespace {
 
 constexpr const char* kVersion = "1.0.0";
@@ -25,6 +28,28 @@ void set_last_error(const std::string& msg) {
   g_last_error = msg;
 }
 
+struct Aborted {};
+
+// Progress forwards percentages to the caller's callbacks; an abort callback returning
+// non-zero unwinds the squeeze with Aborted.
+class Progress {
+ public:
+  Progress(csq_progress_cb cb, csq_progress_abort_cb abort_cb, void* user_data)
+      : cb_(cb), abort_cb_(abort_cb), user_data_(user_data) {}
+
+  bool enabled() const { return cb_ != nullptr || abort_cb_ != nullptr; }
+
+  void report(float pct) const {
+    if (cb_) cb_(pct, user_data_);
+    if (abort_cb_ && abort_cb_(pct, user_data_) != 0) throw Aborted{};
+  }
+
+ private:
+  csq_progress_cb cb_;
+  csq_progress_abort_cb abort_cb_;
+  void* user_data_;
+};
+
 struct Span {
   size_t start;
   size_t end;
@@ -36,7 +61,14 @@ struct SentenceInfo {
   std::vector<std::string> uniq_tokens;
   bool anchor{false};
   double score{0.0};
-  bool drop{false};
+  int reason{CSQ_KEEP};
+
+  bool dropped() const { return reason != CSQ_KEEP; }
+};
+
+struct Analysis {
+  std::string text;
+  std::vector<SentenceInfo> sentences;
 };
 
 bool is_ascii_alpha_num(unsigned char c) {
@@ -48,11 +80,43 @@ unsigned char lower_ascii(unsigned char c) {
   return c;
 }
 
-uint64_t fnv1a(std::string_view s) {
+// Hashes the block with typographic quotes, dashes and ellipses folded to ASCII so that
+// copies differing only in "smart" punctuation still collapse.
+uint64_t fnv1a_folded(std::string_view s) {
   uint64_t h = 1469598103934665603ULL;
-  for (unsigned char c : s) {
+  auto mix = [&h](unsigned char c) {
     h ^= c;
     h *= 1099511628211ULL;
+  };
+  for (size_t i = 0; i < s.size(); ++i) {
+    unsigned char c = static_cast<unsigned char>(s[i]);
+    if (c == 0xE2 && i + 2 < s.size()) {
+      unsigned char b1 = static_cast<unsigned char>(s[i + 1]);
+      unsigned char b2 = static_cast<unsigned char>(s[i + 2]);
+      if (b1 == 0x80 && ((b2 >= 0x98 && b2 <= 0x9B) || b2 == 0xB2)) {
+        mix('\'');
+        i += 2;
+        continue;
+      }
+      if (b1 == 0x80 && ((b2 >= 0x9C && b2 <= 0x9F) || b2 == 0xB3)) {
+        mix('"');
+        i += 2;
+        continue;
+      }
+      if ((b1 == 0x80 && b2 >= 0x90 && b2 <= 0x95) || (b1 == 0x88 && b2 == 0x92)) {
+        mix('-');
+        i += 2;
+        continue;
+      }
+      if (b1 == 0x80 && b2 == 0xA6) {
+        mix('.');
+        mix('.');
+        mix('.');
+        i += 2;
+        continue;
+      }
+    }
+    mix(c);
   }
   return h;
 }
@@ -188,6 +252,34 @@ double cosine_tf(const std::unordered_map<std::string, int>& a, const std::unord
   return dot / (std::sqrt(na) * std::sqrt(nb));
 }
 
+// Natural log from IEEE basic operations only. Library log() implementations may differ in
+// the last bit, and the Go engine must reproduce every score exactly.
+double portable_log(double x) {
+  constexpr double kLn2 = 0.6931471805599453;
+  constexpr double kSqrtHalf = 0.7071067811865476;
+  int e = 0;
+  double m = std::frexp(x, &e);
+  if (m < kSqrtHalf) {
+    m *= 2.0;
+    --e;
+  }
+  const double s = (m - 1.0) / (m + 1.0);
+  const double s2 = s * s;
+  double term = s;
+  double sum = 0.0;
+  for (int k = 0; k < 14; ++k) {
+    sum += term / static_cast<double>(2 * k + 1);
+    term *= s2;
+  }
+  const double mant = 2.0 * sum;
+  const double exp = static_cast<double>(e) * kLn2;
+  return mant + exp;
+}
+
+double idf_weight(int n, int df) {
+  return portable_log(1.0 + static_cast<double>(n) / (1.0 + static_cast<double>(df)));
+}
+
 double dup_threshold(int aggr) {
   if (aggr <= 3) return 0.95;
   if (aggr <= 6) return 0.90;
@@ -201,14 +293,7 @@ double drop_ratio(int aggr) {
   return k[static_cast<size_t>(aggr)];
 }
 
-std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void* user_data) {
-  if (aggr <= 0 || input.empty()) {
-    if (cb) cb(100.0f, user_data);
-    return input;
-  }
-
-  if (cb) cb(5.0f, user_data);
-
+std::string filter_blocks(const std::string& input, const Progress& progress) {
   std::vector<Span> blocks;
   size_t pstart = 0;
   for (size_t i = 0; i < input.size();) {
@@ -232,7 +317,7 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
     std::string_view sv(input.data() + b.start, b.end - b.start);
     if (sv == "\n\n") continue;
     if (sv.size() >= 120) {
-      uint64_t h = fnv1a(sv);
+      uint64_t h = fnv1a_folded(sv);
       if (first_seen.find(h) == first_seen.end()) {
         first_seen[h] = i;
       } else {
@@ -253,14 +338,12 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
     }
 
     float current_pct = 5.0f + 10.0f * (float)i / (float)blocks.size();
-    if (cb && (int)current_pct != (int)last_pct) {
-      cb(current_pct, user_data);
+    if (progress.enabled() && (int)current_pct != (int)last_pct) {
+      progress.report(current_pct);
       last_pct = current_pct;
     }
   }
 
-  if (cb) cb(20.0f, user_data);
-
   std::string filtered;
   filtered.reserve(input.size());
   for (size_t i = 0; i < blocks.size(); ++i) {
@@ -268,37 +351,10 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
       filtered.append(input.data() + blocks[i].start, blocks[i].end - blocks[i].start);
     }
   }
+  return filtered;
+}
 
-  auto spans = segment_sentences(filtered);
-  if (spans.empty()) {
-    if (cb) cb(100.0f, user_data);
-    return filtered;
-  }
-
-  const auto sw = stopwords();
-  std::vector<SentenceInfo> sentences;
-  csq_metrics_add_sentences(static_cast<uint64_t>(spans.size()));
-  last_pct = -1.0f;
-  for (size_t i = 0; i < spans.size(); ++i) {
-    const auto& sp = spans[i];
-    std::string_view sv(filtered.data() + sp.start, sp.end - sp.start);
-    SentenceInfo info;
-    info.span = sp;
-    info.anchor = is_anchor(sv);
-    auto tokens = tokenize(sv, sw);
-    csq_metrics_add_tokens(static_cast<uint64_t>(tokens.size()));
-    for (const auto& t : tokens) info.tf[t] += 1;
-    for (const auto& kv : info.tf) info.uniq_tokens.push_back(kv.first);
-    std::sort(info.uniq_tokens.begin(), info.uniq_tokens.end());
-    sentences.push_back(std::move(info));
-
-    float current_pct = 20.0f + 30.0f * (float)i / (float)spans.size();
-    if (cb && (int)current_pct != (int)last_pct) {
-      cb(current_pct, user_data);
-      last_pct = current_pct;
-    }
-  }
-
+void drop_near_duplicates(std::vector<SentenceInfo>& sentences, int aggr, const Progress& progress, csq_metrics_snapshot& m) {
   auto token_signature = [](const SentenceInfo& s) {
     std::vector<std::string> v;
     for (const auto& t : s.uniq_tokens) v.push_back(t.substr(0, std::min<size_t>(4, t.size())));
@@ -312,7 +368,7 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
   };
 
   std::unordered_map<std::string, std::vector<size_t>> buckets;
-  last_pct = -1.0f;
+  float last_pct = -1.0f;
   for (size_t i = 0; i < sentences.size(); ++i) {
     if (sentences[i].anchor) continue;
     std::string key = std::to_string((sentences[i].span.end - sentences[i].span.start) / 20) + "|" + token_signature(sentences[i]);
@@ -320,51 +376,104 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
     bool dup = false;
     size_t begin = cand.size() > 64 ? cand.size() - 64 : 0;
     size_t checked = cand.size() - begin;
-    csq_metrics_add_candidates(static_cast<uint64_t>(checked));
+    m.similarity_candidates_checked += static_cast<uint64_t>(checked);
     float current_pct = 50.0f + 20.0f * (float)i / (float)sentences.size();
-    if (cb && (int)current_pct != (int)last_pct) {
-      cb(current_pct, user_data);
+    if (progress.enabled() && (int)current_pct != (int)last_pct) {
+      progress.report(current_pct);
       last_pct = current_pct;
     }
     for (size_t j = begin; j < cand.size(); ++j) {
       size_t prev = cand[j];
-      csq_metrics_add_pairs(1);
+      m.similarity_pairs_compared += 1;
       if (cosine_tf(sentences[prev].tf, sentences[i].tf) >= dup_threshold(aggr)) {
         dup = true;
         break;
       }
     }
     if (dup) {
-      sentences[i].drop = true;
+      sentences[i].reason = CSQ_DROP_NEAR_DUPLICATE;
     } else {
       cand.push_back(i);
     }
   }
+}
+
+// analyze_impl scores every sentence and marks the ones squeeze_impl drops at aggr. At aggr 0
+// the block filter and near-duplicate pass are skipped, so the text is the input unchanged.
+Analysis analyze_impl(std::string input, int aggr, const Progress& progress, csq_metrics_snapshot& m) {
+  if (input.empty()) {
+    progress.report(100.0f);
+    return {};
+  }
+
+  progress.report(5.0f);
+
+  Analysis a;
+  if (aggr > 0) {
+    a.text = filter_blocks(input, progress);
+  } else {
+    a.text = std::move(input);
+  }
+
+  progress.report(20.0f);
+
+  const std::string& filtered = a.text;
+  auto spans = segment_sentences(filtered);
+  if (spans.empty()) {
+    progress.report(100.0f);
+    return a;
+  }
+
+  const auto sw = stopwords();
+  std::vector<SentenceInfo>& sentences = a.sentences;
+  m.sentences_total += static_cast<uint64_t>(spans.size());
+  float last_pct = -1.0f;
+  for (size_t i = 0; i < spans.size(); ++i) {
+    const auto& sp = spans[i];
+    std::string_view sv(filtered.data() + sp.start, sp.end - sp.start);
+    SentenceInfo info;
+    info.span = sp;
+    info.anchor = is_anchor(sv);
+    auto tokens = tokenize(sv, sw);
+    m.tokens_parsed += static_cast<uint64_t>(tokens.size());
+    for (const auto& t : tokens) info.tf[t] += 1;
+    for (const auto& kv : info.tf) info.uniq_tokens.push_back(kv.first);
+    std::sort(info.uniq_tokens.begin(), info.uniq_tokens.end());
+    sentences.push_back(std::move(info));
+
+    float current_pct = 20.0f + 30.0f * (float)i / (float)spans.size();
+    if (progress.enabled() && (int)current_pct != (int)last_pct) {
+      progress.report(current_pct);
+      last_pct = current_pct;
+    }
+  }
 
-  if (cb) cb(70.0f, user_data);
+  if (aggr > 0) drop_near_duplicates(sentences, aggr, progress, m);
+
+  progress.report(70.0f);
 
   std::unordered_map<std::string, int> df;
   int n = 0;
   for (const auto& s : sentences) {
-    if (s.drop) continue;
+    if (s.dropped()) continue;
     ++n;
     for (const auto& kv : s.tf) df[kv.first] += 1;
   }
 
-  if (cb) cb(80.0f, user_data);
+  progress.report(80.0f);
 
+  // Scores are summed in sorted token order so the result does not depend on hash map layout.
   for (auto& s : sentences) {
-    if (s.drop) continue;
-    for (const auto& kv : s.tf) {
-      double idf = std::log(1.0 + static_cast<double>(n) / (1.0 + static_cast<double>(df[kv.first])));
-      s.score += static_cast<double>(kv.second) * idf;
+    if (s.dropped()) continue;
+    for (const auto& t : s.uniq_tokens) {
+      const double w = static_cast<double>(s.tf[t]) * idf_weight(n, df[t]);
+      s.score += w;
     }
     size_t slen = s.span.end - s.span.start;
     if (slen < 25) {
       bool rare = false;
-      for (const auto& kv : s.tf) {
-        double idf = std::log(1.0 + static_cast<double>(n) / (1.0 + static_cast<double>(df[kv.first])));
-        if (idf > 1.5) {
+      for (const auto& t : s.uniq_tokens) {
+        if (idf_weight(n, df[t]) > 1.5) {
           rare = true;
           break;
         }
@@ -373,11 +482,11 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
     }
   }
 
-  if (cb) cb(90.0f, user_data);
+  progress.report(90.0f);
 
   std::vector<std::pair<double, size_t>> candidates;
   for (size_t i = 0; i < sentences.size(); ++i) {
-    if (!sentences[i].drop && !sentences[i].anchor) candidates.push_back({sentences[i].score, i});
+    if (!sentences[i].dropped() && !sentences[i].anchor) candidates.push_back({sentences[i].score, i});
   }
 
   size_t to_drop = static_cast<size_t>(std::floor(drop_ratio(aggr) * static_cast<double>(sentences.size())));
@@ -386,14 +495,25 @@ std::string squeeze_impl(std::string input, int aggr, csq_progress_cb cb, void*
     if (a.first == b.first) return a.second < b.second;
     return a.first < b.first;
   });
-  for (size_t i = 0; i < to_drop; ++i) sentences[candidates[i].second].drop = true;
+  for (size_t i = 0; i < to_drop; ++i) sentences[candidates[i].second].reason = CSQ_DROP_LOW_SCORE;
+
+  progress.report(100.0f);
+  return a;
+}
 
+std::string squeeze_impl(std::string input, int aggr, const Progress& progress, csq_metrics_snapshot& m) {
+  if (aggr <= 0 || input.empty()) {
+    progress.report(100.0f);
+    return input;
+  }
+
+  Analysis a = analyze_impl(std::move(input), aggr, progress, m);
+  if (a.sentences.empty()) return std::move(a.text);
   std::string out;
-  out.reserve(filtered.size());
-  for (const auto& s : sentences) {
-    if (!s.drop) out.append(filtered.data() + s.span.start, s.span.end - s.span.start);
+  out.reserve(a.text.size());
+  for (const auto& s : a.sentences) {
+    if (!s.dropped()) out.append(a.text.data() + s.span.start, s.span.end - s.span.start);
   }
-  if (cb) cb(100.0f, user_data);
   return out;
 }
 
@@ -412,15 +532,36 @@ int copy_to_cbuf(const std::string& s, csq_buf* out) {
   return CSQ_OK;
 }
 
-}  // namespace
-
-extern "C" int csq_squeeze(csq_view in, csq_buf* out) { return csq_squeeze_progress(in, 0, nullptr, nullptr, out); }
-
-extern "C" int csq_squeeze_ex(csq_view in, int aggressiveness, csq_buf* out) {
-  return csq_squeeze_progress(in, aggressiveness, nullptr, nullptr, out);
+// guarded runs fn, which fills metrics, and turns exceptions into status codes.
+template <typename Fn>
+int guarded(csq_metrics_snapshot* metrics, Fn fn) {
+  try {
+    csq_metrics_snapshot m = {0, 0, 0, 0};
+    int rc = fn(m);
+    if (metrics != nullptr) {
+      *metrics = m;
+    } else {
+      // Only calls without their own counters keep the process-wide snapshot behind
+      // csq_metrics_get, replacing it in one step.
+      csq_metrics_store(m);
+    }
+    return rc;
+  } catch (const Aborted&) {
+    set_last_error("squeeze aborted by progress callback");
+    return CSQ_ERR_ABORTED;
+  } catch (const std::exception& e) {
+    set_last_error(std::string("internal error: ") + e.what());
+    return CSQ_ERR_INTERNAL;
+  } catch (...) {
+    set_last_error("unknown internal error");
+    return CSQ_ERR_INTERNAL;
+  }
 }
 
-extern "C" int csq_squeeze_progress(csq_view in, int aggressiveness, csq_progress_cb cb, void* user_data, csq_buf* out) {
+int clamp_aggr(int aggressiveness) { return std::min(std::max(aggressiveness, 0), 9); }
+
+int squeeze_with(csq_view in, int aggressiveness, const Progress& progress, csq_buf* out, csq_metrics_snapshot* metrics) {
+  if (metrics != nullptr) *metrics = {0, 0, 0, 0};
   if (out == nullptr) {
     set_last_error("output buffer pointer is null");
     return CSQ_ERR_INVALID_ARG;
@@ -433,19 +574,77 @@ extern "C" int csq_squeeze_progress(csq_view in, int aggressiveness, csq_progres
     return CSQ_ERR_INVALID_DATA;
   }
 
-  try {
-    csq_metrics_reset();
-    if (aggressiveness < 0) aggressiveness = 0;
-    if (aggressiveness > 9) aggressiveness = 9;
+  return guarded(metrics, [&](csq_metrics_snapshot& m) {
     std::string input(in.data, in.len);
-    return copy_to_cbuf(squeeze_impl(std::move(input), aggressiveness, cb, user_data), out);
-  } catch (const std::exception& e) {
-    set_last_error(std::string("internal error: ") + e.what());
-    return CSQ_ERR_INTERNAL;
-  } catch (...) {
-    set_last_error("unknown internal error");
-    return CSQ_ERR_INTERNAL;
+    return copy_to_cbuf(squeeze_impl(std::move(input), clamp_aggr(aggressiveness), progress, m), out);
+  });
+}
+
+int analyze_with(csq_view in, int aggressiveness, const Progress& progress, csq_analysis* out, csq_metrics_snapshot* metrics) {
+  if (metrics != nullptr) *metrics = {0, 0, 0, 0};
+  if (out == nullptr) {
+    set_last_error("output analysis pointer is null");
+    return CSQ_ERR_INVALID_ARG;
   }
+  *out = {{nullptr, 0}, nullptr, 0};
+  if (in.len == 0) return CSQ_OK;
+  if (in.data == nullptr) {
+    set_last_error("input data pointer is null");
+    return CSQ_ERR_INVALID_DATA;
+  }
+
+  return guarded(metrics, [&](csq_metrics_snapshot& m) {
+    Analysis a = analyze_impl(std::string(in.data, in.len), clamp_aggr(aggressiveness), progress, m);
+    if (!a.sentences.empty()) {
+      void* raw = std::malloc(a.sentences.size() * sizeof(csq_sentence));
+      if (raw == nullptr) {
+        set_last_error("failed to allocate memory for sentences");
+        return static_cast<int>(CSQ_ERR_MALLOC);
+      }
+      out->sentences = static_cast<csq_sentence*>(raw);
+      out->count = a.sentences.size();
+      for (size_t i = 0; i < a.sentences.size(); ++i) {
+        const SentenceInfo& s = a.sentences[i];
+        out->sentences[i] = {s.span.start, s.span.end, s.score, s.anchor ? 1 : 0, s.reason};
+      }
+    }
+    int rc = copy_to_cbuf(a.text, &out->text);
+    if (rc != CSQ_OK) {
+      std::free(out->sentences);
+      *out = {{nullptr, 0}, nullptr, 0};
+    }
+    return rc;
+  });
+}
+
+}  // namespace
+
+extern "C" int csq_squeeze(csq_view in, csq_buf* out) { return csq_squeeze_progress(in, 0, nullptr, nullptr, out); }
+
+extern "C" int csq_squeeze_ex(csq_view in, int aggressiveness, csq_buf* out) {
+  return csq_squeeze_progress(in, aggressiveness, nullptr, nullptr, out);
+}
+
+extern "C" int csq_squeeze_progress(csq_view in, int aggressiveness, csq_progress_cb cb, void* user_data, csq_buf* out) {
+  return squeeze_with(in, aggressiveness, Progress(cb, nullptr, user_data), out, nullptr);
+}
+
+extern "C" int csq_squeeze_metrics(csq_view in, int aggressiveness, csq_progress_abort_cb cb, void* user_data, csq_buf* out,
+                                   csq_metrics_snapshot* metrics) {
+  return squeeze_with(in, aggressiveness, Progress(nullptr, cb, user_data), out, metrics);
+}
+
+extern "C" int csq_analyze(csq_view in, int aggressiveness, csq_progress_abort_cb cb, void* user_data, csq_analysis* out,
+                           csq_metrics_snapshot* metrics) {
+  return analyze_with(in, aggressiveness, Progress(nullptr, cb, user_data), out, metrics);
+}
+
+extern "C" void csq_analysis_free(csq_analysis* analysis) {
+  if (analysis == nullptr) return;
+  csq_free(&analysis->text);
+  std::free(analysis->sentences);
+  analysis->sentences = nullptr;
+  analysis->count = 0;
 }
 
 extern "C" void csq_free(csq_buf* buf) {
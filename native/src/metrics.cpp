@@ -1,12 +1,38 @@
 #include "metrics.h"
 
+#include <mutex>
+
 namespace {
+// Squeezes may run on several threads at once; the lock keeps the legacy global well defined.
+std::mutex g_metrics_mu;
 csq_metrics_snapshot g_metrics = {0, 0, 0, 0};
-}
+}  // namespace
 
-extern "C" void csq_metrics_reset(void) { g_metrics = {0, 0, 0, 0}; }
-extern "C" void csq_metrics_add_tokens(uint64_t n) { g_metrics.tokens_parsed += n; }
-extern "C" void csq_metrics_add_sentences(uint64_t n) { g_metrics.sentences_total += n; }
-extern "C" void csq_metrics_add_candidates(uint64_t n) { g_metrics.similarity_candidates_checked += n; }
-extern "C" void csq_metrics_add_pairs(uint64_t n) { g_metrics.similarity_pairs_compared += n; }
-extern "C" csq_metrics_snapshot csq_metrics_get(void) { return g_metrics; }
+extern "C" void csq_metrics_reset(void) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics = {0, 0, 0, 0};
+}
+extern "C" void csq_metrics_add_tokens(uint64_t n) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics.tokens_parsed += n;
+}
+extern "C" void csq_metrics_add_sentences(uint64_t n) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics.sentences_total += n;
+}
+extern "C" void csq_metrics_add_candidates(uint64_t n) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics.similarity_candidates_checked += n;
+}
+extern "C" void csq_metrics_add_pairs(uint64_t n) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics.similarity_pairs_compared += n;
+}
+void csq_metrics_store(const csq_metrics_snapshot& m) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  g_metrics = m;
+}
+extern "C" csq_metrics_snapshot csq_metrics_get(void) {
+  std::lock_guard<std::mutex> lock(g_metrics_mu);
+  return g_metrics;
+}
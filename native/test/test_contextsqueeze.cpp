@@ -58,6 +58,16 @@ int test_boilerplate_preserve_first_drop_repeats() {
   return 0;
 }
 
+int test_boilerplate_folds_typographic_punctuation() {
+  const std::string plain = "Notice: the vendor's \"standard\" terms apply - see section 4 for the full list of obligations and exclusions that follow.\n";
+  const std::string smart = "Notice: the vendor\xE2\x80\x99s \xE2\x80\x9Cstandard\xE2\x80\x9D terms apply \xE2\x80\x93 see section 4 for the full list of obligations and exclusions that follow.\n";
+  const std::string in = plain + "\n" + "Unique content here.\n\n" + smart;
+  const std::string out = squeeze_ex(in, 7);
+  if (out.find("Notice:") == std::string::npos) return 1;
+  if (out.find("\xE2\x80\x9Cstandard") != std::string::npos) return 1;
+  return 0;
+}
+
 int test_duplicate_removal() {
   const std::string in =
       "The cache layer reduces latency for requests. "
@@ -110,8 +120,70 @@ int test_performance_sanity() {
   return ms < 8000 ? 0 : 1;
 }
 
+int test_per_call_metrics() {
+  const std::string a = "One sentence here. Another sentence there. One sentence here.";
+  const std::string b = "Short.";
+  csq_metrics_snapshot ma{}, mb{};
+  csq_buf out{nullptr, 0};
+  if (csq_squeeze_metrics(csq_view{a.data(), a.size()}, 6, nullptr, nullptr, &out, &ma) != 0) return 1;
+  csq_free(&out);
+  if (csq_squeeze_metrics(csq_view{b.data(), b.size()}, 6, nullptr, nullptr, &out, &mb) != 0) return 1;
+  csq_free(&out);
+  if (ma.sentences_total != 3 || ma.similarity_pairs_compared == 0) return 1;
+  if (mb.sentences_total != 1 || mb.tokens_parsed != 1) return 1;
+  if (csq_squeeze_ex(csq_view{a.data(), a.size()}, 6, &out) != 0) return 1;
+  csq_free(&out);
+  if (csq_metrics_get().sentences_total != ma.sentences_total) return 1;
+  if (csq_squeeze_metrics(csq_view{b.data(), b.size()}, 6, nullptr, nullptr, &out, &mb) != 0) return 1;
+  csq_free(&out);
+  return csq_metrics_get().sentences_total == ma.sentences_total ? 0 : 1;
+}
+
+int abort_after_first(float, void* user_data) {
+  int* calls = static_cast<int*>(user_data);
+  return (*calls)++ > 0 ? 1 : 0;
+}
+
+int test_progress_abort() {
+  const std::string a = "One sentence here. Another sentence there. One sentence here.";
+  int calls = 0;
+  csq_buf out{nullptr, 0};
+  if (csq_squeeze_metrics(csq_view{a.data(), a.size()}, 6, abort_after_first, &calls, &out, nullptr) != CSQ_ERR_ABORTED) return 1;
+  if (out.data != nullptr || calls != 2) return 1;
+  return std::string(csq_last_error()).find("aborted") != std::string::npos ? 0 : 1;
+}
+
 }  // namespace
 
+int test_analyze_matches_squeeze() {
+  const std::string a =
+      "# Title\nShort one. Alpha beta gamma delta. Alpha beta gamma delta. "
+      "The quick brown fox jumps over 2024 logs. Lorem ipsum dolor sit amet.\n\n"
+      "Another paragraph with distinct words entirely. Filler text here.";
+  csq_buf out{nullptr, 0};
+  csq_analysis an{};
+  if (csq_squeeze_ex(csq_view{a.data(), a.size()}, 6, &out) != CSQ_OK) return 1;
+  if (csq_analyze(csq_view{a.data(), a.size()}, 6, nullptr, nullptr, &an, nullptr) != CSQ_OK) return 1;
+  std::string kept;
+  bool near_dup = false;
+  for (size_t i = 0; i < an.count; ++i) {
+    const csq_sentence& s = an.sentences[i];
+    if (s.reason == CSQ_KEEP) kept.append(an.text.data + s.start, s.end - s.start);
+    near_dup = near_dup || s.reason == CSQ_DROP_NEAR_DUPLICATE;
+  }
+  int rc = (kept == std::string(out.data, out.len) && near_dup) ? 0 : 1;
+  csq_free(&out);
+  csq_analysis_free(&an);
+
+  if (csq_analyze(csq_view{a.data(), a.size()}, 0, nullptr, nullptr, &an, nullptr) != CSQ_OK) return 1;
+  if (std::string(an.text.data, an.text.len) != a || an.count == 0) rc = 1;
+  for (size_t i = 0; i < an.count; ++i) {
+    if (an.sentences[i].reason != CSQ_KEEP) rc = 1;
+  }
+  csq_analysis_free(&an);
+  return rc;
+}
+
 int main() {
   int rc = 0;
   auto run = [&](const char* name, int (*fn)()) {
@@ -123,10 +195,14 @@ int main() {
   run("identity", test_squeeze_identity_binary);
   run("segment", test_segmentation_abbrev_and_newlines);
   run("boilerplate", test_boilerplate_preserve_first_drop_repeats);
+  run("boilerplate_fold", test_boilerplate_folds_typographic_punctuation);
   run("duplicate", test_duplicate_removal);
   run("anchors", test_pruning_respects_anchors);
   run("determinism", test_determinism);
   run("performance", test_performance_sanity);
+  run("per_call_metrics", test_per_call_metrics);
+  run("progress_abort", test_progress_abort);
+  run("analyze", test_analyze_matches_squeeze);
   if (rc != 0) std::cerr << "native tests failed\n";
   return rc;
 }
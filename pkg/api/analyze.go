@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// DropReason says why an engine removes a sentence.
+type DropReason int
+
+const (
+	Keep DropReason = iota
+	// DropNearDuplicate marks a sentence too similar to an earlier one. It is not scored.
+	DropNearDuplicate
+	// DropLowScore marks the lowest-scoring sentences cut at the chosen aggressiveness.
+	DropLowScore
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case Keep:
+		return "keep"
+	case DropNearDuplicate:
+		return "near_duplicate"
+	case DropLowScore:
+		return "low_score"
+	}
+	return fmt.Sprintf("DropReason(%d)", int(r))
+}
+
+// Sentence is a scored byte range of Analysis.Text. Score is the sum of the tf-idf weights
+// of its terms, so it grows with length; anchors are never dropped for their score. With
+// Options.Query, Relevance is the sentence's BM25 score against it and Score blends it in.
+type Sentence struct {
+	Start     int
+	End       int
+	Score     float64
+	Anchor    bool
+	Reason    DropReason
+	Relevance float64
+}
+
+// Analysis is what an engine makes of one input at a given aggressiveness. Text is the input
+// without repeated and low-entropy blocks, and the sentences cover it in order. At
+// aggressiveness 0 Text is the input and every sentence is kept, but still scored.
+type Analysis struct {
+	Text      []byte
+	Sentences []Sentence
+}
+
+// Kept returns the sentences whose Reason is Keep, which is the Squeeze output for the same
+// input and options.
+func (a Analysis) Kept() []byte {
+	out := make([]byte, 0, len(a.Text))
+	for _, s := range a.Sentences {
+		if s.Reason == Keep {
+			out = append(out, a.Text[s.Start:s.End]...)
+		}
+	}
+	return out
+}
+
+// AnalyzeContext runs the default engine's analysis; see Engine.Analyze.
+func AnalyzeContext(ctx context.Context, in []byte, opt Options) (Analysis, error) {
+	a, _, err := DefaultEngine().Analyze(ctx, in, opt)
+	return a, err
+}
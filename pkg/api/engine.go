@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Engine is a compression backend. Implementations must be deterministic and produce the
+// same bytes for the same input and options. The returned metrics belong to this call only.
+type Engine interface {
+	Name() string
+	Squeeze(ctx context.Context, in []byte, opt Options) ([]byte, NativeMetrics, error)
+	// Analyze scores every sentence once instead of returning the squeezed text, so a caller
+	// can choose sentences itself; without size limits, Analysis.Kept is what Squeeze returns.
+	Analyze(ctx context.Context, in []byte, opt Options) (Analysis, NativeMetrics, error)
+}
+
+var (
+	lastMetricsMu sync.Mutex
+	lastMetrics   NativeMetrics
+)
+
+func recordMetrics(m NativeMetrics) {
+	lastMetricsMu.Lock()
+	lastMetrics = m
+	lastMetricsMu.Unlock()
+}
+
+type nativeEngine struct{}
+
+func (nativeEngine) Name() string { return "native" }
+
+func (nativeEngine) Squeeze(ctx context.Context, in []byte, opt Options) ([]byte, NativeMetrics, error) {
+	return squeeze(ctx, in, opt, nil)
+}
+
+func (nativeEngine) Analyze(ctx context.Context, in []byte, opt Options) (Analysis, NativeMetrics, error) {
+	if err := ctx.Err(); err != nil {
+		return Analysis{}, NativeMetrics{}, fmt.Errorf("analyze failed: %w", err)
+	}
+	aggr := normalizeAggressiveness(opt)
+	a, m, err := csqAnalyze(ctx, in, aggr)
+	if err != nil {
+		return Analysis{}, NativeMetrics{}, fmt.Errorf("analyze failed: %w", err)
+	}
+	a.Focus(opt.Query, aggr)
+	recordMetrics(m)
+	return a, m, nil
+}
+
+type goEngine struct{}
+
+func (goEngine) Name() string { return "go" }
+
+func (goEngine) Squeeze(ctx context.Context, in []byte, opt Options) ([]byte, NativeMetrics, error) {
+	var m NativeMetrics
+	limit, err := opt.Limit(in)
+	if err != nil {
+		return nil, NativeMetrics{}, fmt.Errorf("squeeze failed: %w", err)
+	}
+	var out []byte
+	aggr := normalizeAggressiveness(opt)
+	if limit.IsZero() && opt.Query == "" {
+		out, err = goSqueeze(ctx, in, aggr, nil, &m)
+	} else {
+		var a Analysis
+		if a, err = goAnalyze(goProgress{ctx: ctx}, append([]byte{}, in...), aggr, &m); err == nil {
+			out = a.choose(limit, opt, aggr)
+		}
+	}
+	if err != nil {
+		return nil, NativeMetrics{}, fmt.Errorf("squeeze failed: %w", err)
+	}
+	recordMetrics(m)
+	return out, m, nil
+}
+
+func (goEngine) Analyze(ctx context.Context, in []byte, opt Options) (Analysis, NativeMetrics, error) {
+	var m NativeMetrics
+	aggr := normalizeAggressiveness(opt)
+	a, err := goAnalyze(goProgress{ctx: ctx}, append([]byte{}, in...), aggr, &m)
+	if err != nil {
+		return Analysis{}, NativeMetrics{}, fmt.Errorf("analyze failed: %w", err)
+	}
+	a.Focus(opt.Query, aggr)
+	recordMetrics(m)
+	return a, m, nil
+}
+
+// GoEngine is the pure-Go port of the native engine. It is always available.
+func GoEngine() Engine { return goEngine{} }
+
+// NativeEngine is the C++ engine, which requires a cgo build.
+func NativeEngine() (Engine, error) {
+	if !nativeAvailable {
+		return nil, fmt.Errorf("native engine not available: built without cgo")
+	}
+	return nativeEngine{}, nil
+}
+
+// DefaultEngine is the native engine when available and the Go engine otherwise.
+func DefaultEngine() Engine {
+	if nativeAvailable {
+		return nativeEngine{}
+	}
+	return goEngine{}
+}
+
+// EngineByName resolves "native" or "go"; an empty name selects DefaultEngine.
+func EngineByName(name string) (Engine, error) {
+	switch name {
+	case "":
+		return DefaultEngine(), nil
+	case "native":
+		return NativeEngine()
+	case "go":
+		return GoEngine(), nil
+	}
+	return nil, fmt.Errorf("unknown engine %q (want native or go)", name)
+}
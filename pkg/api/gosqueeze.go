@@ -0,0 +1,553 @@
+package api
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file is a line-for-line port of native/src/contextsqueeze.cpp. Output must stay
+// byte-identical to the C++ engine; TestGoEngineParity enforces it on cgo builds.
+
+var goStopwords = map[string]bool{
+	"the": true, "and": true, "or": true, "a": true, "an": true, "is": true, "are": true, "to": true, "of": true,
+	"in": true, "for": true, "on": true, "with": true, "as": true, "at": true, "by": true, "be": true, "this": true,
+	"that": true, "it": true, "from": true, "was": true, "were": true, "will": true, "can": true, "if": true,
+}
+
+var goAbbrevs = map[string]bool{"e.g.": true, "i.e.": true, "mr.": true, "dr.": true, "vs.": true, "etc.": true, "ms.": true, "mrs.": true, "prof.": true}
+
+var goDropRatios = [10]float64{0.0, 0.05, 0.10, 0.15, 0.20, 0.25, 0.30, 0.35, 0.40, 0.45}
+
+type goSpan struct{ start, end int }
+
+type goSentence struct {
+	span   goSpan
+	tf     map[string]int
+	uniq   []string
+	anchor bool
+	score  float64
+	reason DropReason
+}
+
+func isASCIIAlnum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// fnv1aFolded mirrors fnv1a_folded: typographic quotes, dashes and ellipses hash as ASCII.
+func fnv1aFolded(s []byte) uint64 {
+	h := uint64(1469598103934665603)
+	mix := func(c byte) {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == 0xE2 && i+2 < len(s) {
+			b1, b2 := s[i+1], s[i+2]
+			switch {
+			case b1 == 0x80 && ((b2 >= 0x98 && b2 <= 0x9B) || b2 == 0xB2):
+				mix('\'')
+				i += 2
+				continue
+			case b1 == 0x80 && ((b2 >= 0x9C && b2 <= 0x9F) || b2 == 0xB3):
+				mix('"')
+				i += 2
+				continue
+			case (b1 == 0x80 && b2 >= 0x90 && b2 <= 0x95) || (b1 == 0x88 && b2 == 0x92):
+				mix('-')
+				i += 2
+				continue
+			case b1 == 0x80 && b2 == 0xA6:
+				mix('.')
+				mix('.')
+				mix('.')
+				i += 2
+				continue
+			}
+		}
+		mix(c)
+	}
+	return h
+}
+
+func isTrimSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+func trimASCII(s []byte) []byte {
+	b, e := 0, len(s)
+	for b < e && isTrimSpace(s[b]) {
+		b++
+	}
+	for e > b && isTrimSpace(s[e-1]) {
+		e--
+	}
+	return s[b:e]
+}
+
+func hasDoubleNewline(s []byte, i int) bool {
+	return i+1 < len(s) && s[i] == '\n' && s[i+1] == '\n'
+}
+
+func isURLToken(t string) bool {
+	return strings.Contains(t, "http://") || strings.Contains(t, "https://")
+}
+
+func isAbbrevBefore(s []byte, punct int) bool {
+	if s[punct] != '.' {
+		return false
+	}
+	end, start := punct+1, punct
+	for start > 0 && ((s[start-1] >= 'a' && s[start-1] <= 'z') || (s[start-1] >= 'A' && s[start-1] <= 'Z')) {
+		start--
+	}
+	if end-start < 2 || end-start > 6 {
+		return false
+	}
+	t := make([]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		t = append(t, lowerASCII(s[i]))
+	}
+	return goAbbrevs[string(t)]
+}
+
+func goSegmentSentences(s []byte) []goSpan {
+	spans := make([]goSpan, 0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if hasDoubleNewline(s, i) {
+			if i > start {
+				spans = append(spans, goSpan{start, i})
+			}
+			spans = append(spans, goSpan{i, i + 2})
+			start = i + 2
+			i++
+			continue
+		}
+		c := s[i]
+		if (c == '.' || c == '?' || c == '!') && !isAbbrevBefore(s, i) {
+			if c == '.' {
+				tstart := i
+				for tstart > start && s[tstart-1] != ' ' && s[tstart-1] != '\n' && s[tstart-1] != '\t' && s[tstart-1] != '\r' {
+					tstart--
+				}
+				if isURLToken(string(s[tstart : i+1])) {
+					continue
+				}
+			}
+			end := i + 1
+			for end < len(s) && (s[end] == ' ' || s[end] == '\t' || s[end] == '\r' || (s[end] == '\n' && !hasDoubleNewline(s, end))) {
+				end++
+			}
+			spans = append(spans, goSpan{start, end})
+			start = end
+			i = end - 1
+		}
+	}
+	if start < len(s) {
+		spans = append(spans, goSpan{start, len(s)})
+	}
+	return spans
+}
+
+func goIsAnchor(sv []byte) bool {
+	str := string(sv)
+	if strings.Contains(str, "```") || isURLToken(str) {
+		return true
+	}
+	digits := 0
+	for _, c := range sv {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if digits >= 4 {
+		return true
+	}
+	trimmed := trimASCII(sv)
+	if len(trimmed) > 0 && trimmed[0] == '#' {
+		return true
+	}
+	alphaWords, allCaps := 0, 0
+	for i := 0; i < len(trimmed); {
+		for i < len(trimmed) && !isASCIIAlnum(trimmed[i]) {
+			i++
+		}
+		j := i
+		alpha, caps := 0, 0
+		for j < len(trimmed) && isASCIIAlnum(trimmed[j]) {
+			if trimmed[j] >= 'A' && trimmed[j] <= 'Z' {
+				alpha++
+				caps++
+			} else if trimmed[j] >= 'a' && trimmed[j] <= 'z' {
+				alpha++
+			}
+			j++
+		}
+		if alpha > 1 {
+			alphaWords++
+			if alpha == caps {
+				allCaps++
+			}
+		}
+		i = j
+	}
+	return alphaWords > 0 && float64(allCaps)/float64(alphaWords) >= 0.6
+}
+
+func goTokenize(sv []byte) []string {
+	out := make([]string, 0)
+	cur := make([]byte, 0, 16)
+	for _, c := range sv {
+		if isASCIIAlnum(c) {
+			cur = append(cur, lowerASCII(c))
+		} else if len(cur) > 0 {
+			if !goStopwords[string(cur)] {
+				out = append(out, string(cur))
+			}
+			cur = cur[:0]
+		}
+	}
+	if len(cur) > 0 && !goStopwords[string(cur)] {
+		out = append(out, string(cur))
+	}
+	return out
+}
+
+func cosineTF(a, b map[string]int) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	dot, na, nb := 0.0, 0.0, 0.0
+	for t, n := range a {
+		if m, ok := b[t]; ok {
+			dot += float64(n * m)
+		}
+		na += float64(n * n)
+	}
+	for _, m := range b {
+		nb += float64(m * m)
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// portableLog mirrors portable_log; the explicit float64 conversions stop the compiler from
+// fusing multiply-adds on architectures that have them.
+func portableLog(x float64) float64 {
+	const ln2 = 0.6931471805599453
+	const sqrtHalf = 0.7071067811865476
+	m, e := math.Frexp(x)
+	if m < sqrtHalf {
+		m *= 2
+		e--
+	}
+	s := (m - 1) / (m + 1)
+	s2 := s * s
+	term, sum := s, 0.0
+	for k := 0; k < 14; k++ {
+		sum += term / float64(2*k+1)
+		term *= s2
+	}
+	return float64(2*sum) + float64(float64(e)*ln2)
+}
+
+func idfWeight(n, df int) float64 {
+	return portableLog(1 + float64(n)/(1+float64(df)))
+}
+
+func dupThreshold(aggr int) float64 {
+	if aggr <= 3 {
+		return 0.95
+	}
+	if aggr <= 6 {
+		return 0.90
+	}
+	return 0.85
+}
+
+func tokenSignature(s *goSentence) string {
+	v := make([]string, 0, len(s.uniq))
+	for _, t := range s.uniq {
+		v = append(v, t[:min(4, len(t))])
+	}
+	sort.Strings(v)
+	if len(v) > 3 {
+		v = v[:3]
+	}
+	return strings.Join(v, "|")
+}
+
+// goProgress reports percentages to cb and stops the squeeze once ctx is done, at the same
+// points where the native engine consults its abort callback.
+type goProgress struct {
+	ctx context.Context
+	cb  func(float32)
+}
+
+func (p goProgress) enabled() bool { return p.cb != nil || p.ctx.Done() != nil }
+
+func (p goProgress) report(pct float32) error {
+	if p.cb != nil {
+		p.cb(pct)
+	}
+	return p.ctx.Err()
+}
+
+// goSqueeze runs the compression algorithm in Go, counting into m. aggr must already be
+// clamped to 0..9.
+func goSqueeze(ctx context.Context, input []byte, aggr int, cb func(float32), m *NativeMetrics) ([]byte, error) {
+	p := goProgress{ctx: ctx, cb: cb}
+	if aggr <= 0 || len(input) == 0 {
+		if err := p.report(100); err != nil {
+			return nil, err
+		}
+		return append([]byte{}, input...), nil
+	}
+	a, err := goAnalyze(p, input, aggr, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.Sentences) == 0 {
+		return a.Text, nil
+	}
+	return a.Kept(), nil
+}
+
+// goAnalyze mirrors analyze_impl and may keep input as the analysis text.
+func goAnalyze(p goProgress, input []byte, aggr int, m *NativeMetrics) (Analysis, error) {
+	if len(input) == 0 {
+		return Analysis{Text: []byte{}}, p.report(100)
+	}
+	if err := p.report(5); err != nil {
+		return Analysis{}, err
+	}
+	filtered := input
+	if aggr > 0 {
+		var err error
+		if filtered, err = goFilterBlocks(p, input); err != nil {
+			return Analysis{}, err
+		}
+	}
+	if err := p.report(20); err != nil {
+		return Analysis{}, err
+	}
+
+	spans := goSegmentSentences(filtered)
+	if len(spans) == 0 {
+		return Analysis{Text: filtered}, p.report(100)
+	}
+
+	m.SentencesTotal += uint64(len(spans))
+	sentences := make([]goSentence, 0, len(spans))
+	lastPct := float32(-1)
+	for i, sp := range spans {
+		sv := filtered[sp.start:sp.end]
+		info := goSentence{span: sp, anchor: goIsAnchor(sv), tf: map[string]int{}}
+		tokens := goTokenize(sv)
+		m.TokensParsed += uint64(len(tokens))
+		for _, t := range tokens {
+			info.tf[t]++
+		}
+		for t := range info.tf {
+			info.uniq = append(info.uniq, t)
+		}
+		sort.Strings(info.uniq)
+		sentences = append(sentences, info)
+		pct := 20 + 30*float32(i)/float32(len(spans))
+		if p.enabled() && int(pct) != int(lastPct) {
+			if err := p.report(pct); err != nil {
+				return Analysis{}, err
+			}
+			lastPct = pct
+		}
+	}
+
+	if aggr > 0 {
+		if err := goDropNearDuplicates(p, sentences, aggr, m); err != nil {
+			return Analysis{}, err
+		}
+	}
+	if err := p.report(70); err != nil {
+		return Analysis{}, err
+	}
+
+	df := map[string]int{}
+	n := 0
+	for _, s := range sentences {
+		if s.reason != Keep {
+			continue
+		}
+		n++
+		for t := range s.tf {
+			df[t]++
+		}
+	}
+	if err := p.report(80); err != nil {
+		return Analysis{}, err
+	}
+
+	for i := range sentences {
+		s := &sentences[i]
+		if s.reason != Keep {
+			continue
+		}
+		for _, t := range s.uniq {
+			s.score += float64(float64(s.tf[t]) * idfWeight(n, df[t]))
+		}
+		if s.span.end-s.span.start < 25 {
+			rare := false
+			for _, t := range s.uniq {
+				if idfWeight(n, df[t]) > 1.5 {
+					rare = true
+					break
+				}
+			}
+			if !rare {
+				s.score *= 0.3
+			}
+		}
+	}
+	if err := p.report(90); err != nil {
+		return Analysis{}, err
+	}
+
+	candidates := make([]int, 0, len(sentences))
+	for i, s := range sentences {
+		if s.reason == Keep && !s.anchor {
+			candidates = append(candidates, i)
+		}
+	}
+	toDrop := int(math.Floor(goDropRatios[aggr] * float64(len(sentences))))
+	if toDrop > len(candidates) {
+		toDrop = len(candidates)
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		sa, sb := sentences[candidates[a]].score, sentences[candidates[b]].score
+		if sa == sb {
+			return candidates[a] < candidates[b]
+		}
+		return sa < sb
+	})
+	for _, i := range candidates[:toDrop] {
+		sentences[i].reason = DropLowScore
+	}
+
+	out := Analysis{Text: filtered, Sentences: make([]Sentence, len(sentences))}
+	for i, s := range sentences {
+		out.Sentences[i] = Sentence{Start: s.span.start, End: s.span.end, Score: s.score, Anchor: s.anchor, Reason: s.reason}
+	}
+	return out, p.report(100)
+}
+
+func goFilterBlocks(p goProgress, input []byte) ([]byte, error) {
+	blocks := make([]goSpan, 0)
+	pstart := 0
+	for i := 0; i < len(input); {
+		if hasDoubleNewline(input, i) {
+			blocks = append(blocks, goSpan{pstart, i}, goSpan{i, i + 2})
+			i += 2
+			pstart = i
+		} else {
+			i++
+		}
+	}
+	blocks = append(blocks, goSpan{pstart, len(input)})
+
+	blockDrop := make([]bool, len(blocks))
+	firstSeen := map[uint64]int{}
+	lastPct := float32(-1)
+	for i, b := range blocks {
+		if b.end <= b.start {
+			continue
+		}
+		sv := input[b.start:b.end]
+		if string(sv) == "\n\n" {
+			continue
+		}
+		if len(sv) >= 120 {
+			h := fnv1aFolded(sv)
+			if _, ok := firstSeen[h]; !ok {
+				firstSeen[h] = i
+			} else {
+				blockDrop[i] = true
+			}
+		}
+		if len(sv) >= 300 {
+			var seen [256]bool
+			uniq := 0
+			for _, c := range sv {
+				if !seen[c] {
+					seen[c] = true
+					uniq++
+				}
+			}
+			if float64(uniq)/float64(len(sv)) < 0.08 {
+				blockDrop[i] = true
+			}
+		}
+		pct := 5 + 10*float32(i)/float32(len(blocks))
+		if p.enabled() && int(pct) != int(lastPct) {
+			if err := p.report(pct); err != nil {
+				return nil, err
+			}
+			lastPct = pct
+		}
+	}
+
+	filtered := make([]byte, 0, len(input))
+	for i, b := range blocks {
+		if !blockDrop[i] {
+			filtered = append(filtered, input[b.start:b.end]...)
+		}
+	}
+	return filtered, nil
+}
+
+func goDropNearDuplicates(p goProgress, sentences []goSentence, aggr int, m *NativeMetrics) error {
+	buckets := map[string][]int{}
+	lastPct := float32(-1)
+	for i := range sentences {
+		if sentences[i].anchor {
+			continue
+		}
+		key := strconv.Itoa((sentences[i].span.end-sentences[i].span.start)/20) + "|" + tokenSignature(&sentences[i])
+		cand := buckets[key]
+		begin := 0
+		if len(cand) > 64 {
+			begin = len(cand) - 64
+		}
+		m.SimilarityCandidates += uint64(len(cand) - begin)
+		pct := 50 + 20*float32(i)/float32(len(sentences))
+		if p.enabled() && int(pct) != int(lastPct) {
+			if err := p.report(pct); err != nil {
+				return err
+			}
+			lastPct = pct
+		}
+		dup := false
+		for _, prev := range cand[begin:] {
+			m.SimilarityPairs++
+			if cosineTF(sentences[prev].tf, sentences[i].tf) >= dupThreshold(aggr) {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			sentences[i].reason = DropNearDuplicate
+		} else {
+			buckets[key] = append(cand, i)
+		}
+	}
+	return nil
+}
@@ -24,7 +24,7 @@ func TestJSONSchemaLock(t *testing.T) {
 	if m["schema_version"] != float64(1) {
 		t.Fatalf("schema_version must be 1, got %v", m["schema_version"])
 	}
-	required := []string{"schema_version", "engine_version", "build", "bytes_in", "bytes_out", "tokens_in_approx", "tokens_out_approx", "reduction_pct", "aggressiveness", "profile", "budget_applied", "truncated", "source_type", "warnings"}
+	required := []string{"schema_version", "engine_version", "build", "bytes_in", "bytes_out", "tokens_in", "tokens_out", "tokens_in_approx", "tokens_out_approx", "reduction_pct", "aggressiveness", "profile", "budget_applied", "truncated", "source_type", "warnings"}
 	for _, k := range required {
 		if _, ok := m[k]; !ok {
 			t.Fatalf("missing required key: %s", k)
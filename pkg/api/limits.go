@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Size measures text in the units a squeeze can be limited by.
+type Size struct {
+	Tokens int
+	Bytes  int
+	Words  int
+}
+
+// Measure returns the size of b, counting tokens with t or, when t is nil, as ApproxTokenizer
+// does. Approximate sizes of pieces add up to at least the size of the pieces joined; exact
+// token counts usually do too, but a merge across a join can break that.
+func Measure(b []byte, t Tokenizer) Size {
+	words := 0
+	inWord := false
+	for _, c := range b {
+		if c == ' ' || c == '\n' || c == '\t' || c == '\r' {
+			inWord = false
+			continue
+		}
+		if !inWord {
+			words++
+			inWord = true
+		}
+	}
+	s := Size{Bytes: len(b), Words: words}
+	switch {
+	case t != nil:
+		s.Tokens = t.Count(b)
+	case len(b) > 0:
+		s.Tokens = (len(b)+3)/4 + words
+	}
+	return s
+}
+
+// IsZero reports whether no limit is set.
+func (s Size) IsZero() bool { return s == Size{} }
+
+// Add returns the field-wise sum of s and o.
+func (s Size) Add(o Size) Size {
+	return Size{Tokens: s.Tokens + o.Tokens, Bytes: s.Bytes + o.Bytes, Words: s.Words + o.Words}
+}
+
+// Within reports whether s fits limit. Zero fields of limit are unset.
+func (s Size) Within(limit Size) bool {
+	return (limit.Tokens <= 0 || s.Tokens <= limit.Tokens) &&
+		(limit.Bytes <= 0 || s.Bytes <= limit.Bytes) &&
+		(limit.Words <= 0 || s.Words <= limit.Words)
+}
+
+// Share is the largest fraction of a set field of limit that s takes up.
+func (s Size) Share(limit Size) float64 {
+	share := 0.0
+	if limit.Tokens > 0 {
+		share = math.Max(share, float64(s.Tokens)/float64(limit.Tokens))
+	}
+	if limit.Bytes > 0 {
+		share = math.Max(share, float64(s.Bytes)/float64(limit.Bytes))
+	}
+	if limit.Words > 0 {
+		share = math.Max(share, float64(s.Words)/float64(limit.Words))
+	}
+	return share
+}
+
+// Limited reports whether o sets any size limit.
+func (o Options) Limited() bool {
+	return o.MaxTokens > 0 || o.MaxBytes > 0 || o.MaxWords > 0 || (o.TargetRatio > 0 && o.TargetRatio < 1)
+}
+
+// Limit returns the size a squeeze of in must fit. TargetRatio becomes a token limit of in,
+// counted with o.Tokenizer, and the tighter of it and MaxTokens wins.
+func (o Options) Limit(in []byte) (Size, error) {
+	if o.TargetRatio < 0 || o.TargetRatio > 1 || math.IsNaN(o.TargetRatio) {
+		return Size{}, fmt.Errorf("target ratio must be between 0 and 1, got %g", o.TargetRatio)
+	}
+	if o.MaxTokens < 0 || o.MaxBytes < 0 || o.MaxWords < 0 {
+		return Size{}, fmt.Errorf("size limits must not be negative")
+	}
+	limit := Size{Tokens: o.MaxTokens, Bytes: o.MaxBytes, Words: o.MaxWords}
+	if o.TargetRatio > 0 && o.TargetRatio < 1 && len(in) > 0 {
+		t := max(int(o.TargetRatio*float64(Measure(in, o.Tokenizer).Tokens)), 1)
+		if limit.Tokens <= 0 || t < limit.Tokens {
+			limit.Tokens = t
+		}
+	}
+	return limit, nil
+}
+
+// Fit keeps the sentences of a worth the most per share of limit, in order, and never
+// exceeds it, counting tokens with opt.Tokenizer. Kept sentences are the candidates, and with
+// opt.TargetRatio so are those dropped for their score, which lets a limit replace the
+// aggressiveness cut. Whitespace after a candidate, such as a blank-line separator, goes with
+// it and is only written between two kept sentences or at the end of Text, so dropped
+// sentences leave no runs of blank lines. Anchors are chosen first; when they alone do not
+// fit, they compete with the rest and fits is false.
+//
+// Costs are Measure of each sentence with its whitespace, whose sum rarely undercounts the
+// joined result, so one greedy pass by score per share is almost always enough. When a
+// tokenizer merges across a join, the pass is repeated with the excess taken off the token
+// limit, and when rounding leaves tokens unused, with them added back.
+func (a Analysis) Fit(limit Size, opt Options) (out []byte, fits bool) {
+	out, _, fits = a.FitKept(limit, opt)
+	return out, fits
+}
+
+// FitKept is Fit that also reports which of a.Sentences out keeps.
+func (a Analysis) FitKept(limit Size, opt Options) (out []byte, kept []bool, fits bool) {
+	sentences := a.Sentences
+	if len(sentences) == 0 && len(a.Text) > 0 {
+		sentences = []Sentence{{End: len(a.Text), Reason: Keep}}
+	}
+	type piece struct {
+		s, e   int
+		sepEnd int
+		// sentence is the index of the piece in a.Sentences.
+		sentence int
+		score    float64
+		anchor   bool
+		cost     Size
+	}
+	blank := func(b []byte) bool { return len(bytes.TrimSpace(b)) == 0 }
+	pieces := make([]piece, 0, len(sentences))
+	// open is whether the whitespace up to here still follows the last piece.
+	open := false
+	for si, s := range sentences {
+		if open && !blank(a.Text[pieces[len(pieces)-1].sepEnd:s.Start]) {
+			open = false
+		}
+		if blank(a.Text[s.Start:s.End]) {
+			if open {
+				pieces[len(pieces)-1].sepEnd = s.End
+			}
+			continue
+		}
+		if s.Reason != Keep && !(opt.TargetRatio > 0 && s.Reason == DropLowScore) {
+			open = false
+			continue
+		}
+		if open {
+			pieces[len(pieces)-1].sepEnd = s.Start
+		}
+		pieces = append(pieces, piece{s: s.Start, e: s.End, sepEnd: s.End, sentence: si, score: s.Score, anchor: s.Anchor})
+		open = true
+	}
+	if open && blank(a.Text[pieces[len(pieces)-1].sepEnd:]) {
+		pieces[len(pieces)-1].sepEnd = len(a.Text)
+	}
+	var anchors Size
+	for i := range pieces {
+		p := &pieces[i]
+		p.cost = Measure(a.Text[p.s:p.sepEnd], opt.Tokenizer)
+		if p.anchor {
+			anchors = anchors.Add(p.cost)
+		}
+	}
+	fits = anchors.Within(limit)
+	order := make([]int, len(pieces))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		px, py := pieces[order[x]], pieces[order[y]]
+		if fits && px.anchor != py.anchor {
+			return px.anchor
+		}
+		return px.score*py.cost.Share(limit) > py.score*px.cost.Share(limit)
+	})
+	budget := limit
+	var best []byte
+	var bestKept []bool
+	bestTokens := 0
+	for {
+		keep := make([]bool, len(pieces))
+		var used Size
+		for _, i := range order {
+			if next := used.Add(pieces[i].cost); next.Within(budget) {
+				keep[i] = true
+				used = next
+			}
+		}
+		out = make([]byte, 0, used.Bytes)
+		prev := -1
+		for i, p := range pieces {
+			if !keep[i] {
+				continue
+			}
+			if prev >= 0 {
+				out = append(out, a.Text[pieces[prev].e:pieces[prev].sepEnd]...)
+			}
+			out = append(out, a.Text[p.s:p.e]...)
+			prev = i
+		}
+		if prev >= 0 && prev == len(pieces)-1 {
+			out = append(out, a.Text[pieces[prev].e:pieces[prev].sepEnd]...)
+		}
+		kept = make([]bool, len(a.Sentences))
+		for i, p := range pieces {
+			if keep[i] && len(a.Sentences) > 0 {
+				kept[p.sentence] = true
+			}
+		}
+		got := Measure(out, opt.Tokenizer)
+		switch {
+		case !got.Within(limit) && best != nil:
+			return best, bestKept, fits
+		case !got.Within(limit):
+			// Only exact token counts can grow when pieces are joined; take the excess off
+			// and choose again.
+			if budget.Tokens = used.Tokens - (got.Tokens - limit.Tokens); limit.Tokens <= 0 || budget.Tokens <= 0 {
+				return []byte{}, make([]bool, len(a.Sentences)), false
+			}
+		case best != nil && got.Tokens <= bestTokens:
+			return best, bestKept, fits
+		case limit.Tokens <= 0 || got.Tokens == limit.Tokens:
+			return out, kept, fits
+		default:
+			// Costs rounded up piece by piece can leave out short of the token limit; spend
+			// the rest and choose again.
+			best, bestKept, bestTokens = out, kept, got.Tokens
+			budget.Tokens += limit.Tokens - got.Tokens
+		}
+	}
+}
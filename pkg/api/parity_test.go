@@ -0,0 +1,102 @@
+//go:build cgo
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func parityCorpus(t testing.TB) [][]byte {
+	corpus := [][]byte{
+		[]byte(""),
+		[]byte("hello world"),
+		[]byte("alpha\n\nalpha\n\n# HEAD\nVisit https://example.com\n"),
+		[]byte("Noise sentence repeated. Noise sentence repeated. Noise sentence repeated.\nUnique insight with token quartz99 appears once.\nNoise sentence repeated.\n"),
+		[]byte("See e.g. the Dr. notes vs. the draft. Why? Because! Then https://x.org/a.b. Done.\n\n\n\nTrailing"),
+		[]byte("“Quoted” — text… " + strings.Repeat("block of filler words ", 8) + "\n\n\"Quoted\" - text... " + strings.Repeat("block of filler words ", 8)),
+		bytes.Repeat([]byte("="), 400),
+	}
+	var b strings.Builder
+	for i := 0; i < 400; i++ {
+		b.WriteString("Sentence " + strconv.Itoa(i%23) + " mentions topic " + strconv.Itoa(i%7) + " and item " + strconv.Itoa(i%11) + ". ")
+		if i%9 == 0 {
+			b.WriteString("\n\n")
+		}
+	}
+	corpus = append(corpus, []byte(b.String()))
+	files, _ := filepath.Glob("../../testdata/bench/*")
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus = append(corpus, data)
+	}
+	return corpus
+}
+
+func TestGoEngineParity(t *testing.T) {
+	for ci, in := range parityCorpus(t) {
+		for aggr := 0; aggr <= 9; aggr++ {
+			want, native, err := csqSqueeze(context.Background(), in, aggr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m NativeMetrics
+			got, err := goSqueeze(context.Background(), in, aggr, nil, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("corpus %d aggr %d: go engine output differs (%d vs %d bytes)", ci, aggr, len(got), len(want))
+			}
+			if len(in) > 0 && m != native {
+				t.Fatalf("corpus %d aggr %d: metrics differ: %+v vs %+v", ci, aggr, m, native)
+			}
+		}
+	}
+}
+
+func TestGoEngineAnalyzeParity(t *testing.T) {
+	for ci, in := range parityCorpus(t) {
+		for _, aggr := range []int{0, 1, 6, 9} {
+			want, _, err := csqAnalyze(context.Background(), in, aggr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := goAnalyze(goProgress{ctx: context.Background()}, append([]byte{}, in...), aggr, new(NativeMetrics))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Text, want.Text) || len(got.Sentences) != len(want.Sentences) {
+				t.Fatalf("corpus %d aggr %d: go analysis differs (%d vs %d sentences)", ci, aggr, len(got.Sentences), len(want.Sentences))
+			}
+			for i := range want.Sentences {
+				if got.Sentences[i] != want.Sentences[i] {
+					t.Fatalf("corpus %d aggr %d sentence %d: %+v vs %+v", ci, aggr, i, got.Sentences[i], want.Sentences[i])
+				}
+			}
+		}
+	}
+}
+
+func FuzzGoEngineParity(f *testing.F) {
+	f.Add([]byte("hello world. hello world. Hello WORLD!"), 6)
+	f.Add([]byte("# H\nVisit https://example.com\n\nBody text. Body text."), 9)
+	f.Fuzz(func(t *testing.T, data []byte, aggr int) {
+		aggr = min(max(aggr, 0), 9)
+		want, _, err := csqSqueeze(context.Background(), data, aggr, nil)
+		if err != nil {
+			t.Skip()
+		}
+		if got, _ := goSqueeze(context.Background(), data, aggr, nil, new(NativeMetrics)); !bytes.Equal(got, want) {
+			t.Fatalf("go engine output differs for aggr %d", aggr)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// bm25K1 and bm25B are the usual Okapi BM25 term-frequency saturation and length
+	// normalization.
+	bm25K1 = 1.2
+	bm25B  = 0.75
+	// queryWeight is how much of a sentence's score comes from the query once focused.
+	queryWeight = 0.5
+	// proximityWindow is how many sentences on each side a relevant sentence lends its
+	// relevance to, halving with each step.
+	proximityWindow = 2
+)
+
+// QueryTerms returns the terms Options.Query matches sentences by: lowercased runs of
+// letters, marks and digits in any script without English stopwords, with each Han, Hiragana
+// and Katakana character a term of its own since those scripts do not separate words. A
+// query without terms has no effect.
+func QueryTerms(query string) []string {
+	out := make([]string, 0)
+	add := func(t string) {
+		if t = strings.ToLower(t); !goStopwords[t] {
+			out = append(out, t)
+		}
+	}
+	start := -1
+	for i, r := range query {
+		word := unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r)
+		single := unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+		if start >= 0 && (!word || single) {
+			add(query[start:i])
+			start = -1
+		}
+		switch {
+		case single:
+			add(string(r))
+		case word && start < 0:
+			start = i
+		}
+	}
+	if start >= 0 {
+		add(query[start:])
+	}
+	return out
+}
+
+// Focus scores the sentences of a against query and redoes the score cut of aggr with the
+// blended scores. Engines focus each Analysis on Options.Query; callers that join analyses of
+// separate chunks can analyze them without it and focus the joined sentences once, so the
+// scores stay comparable across chunks. Each sentence's Relevance is its BM25 score against the query, with the
+// sentences the engine scored as the documents. Relevance, scaled to the most relevant
+// sentence and boosted by relevant neighbours, then replaces queryWeight of the importance
+// score. Near duplicates and sentences without terms keep their score, and a query with no
+// terms leaves a unchanged.
+func (a *Analysis) Focus(query string, aggr int) {
+	terms := map[string]bool{}
+	for _, t := range QueryTerms(query) {
+		terms[t] = true
+	}
+	if len(terms) == 0 || len(a.Sentences) == 0 {
+		return
+	}
+	scored := func(s Sentence) bool { return s.Reason == Keep || s.Reason == DropLowScore }
+	tfs := make([]map[string]int, len(a.Sentences))
+	lengths := make([]int, len(a.Sentences))
+	df := map[string]int{}
+	n, total := 0, 0
+	for i, s := range a.Sentences {
+		tokens := QueryTerms(string(a.Text[s.Start:s.End]))
+		if !scored(s) || len(tokens) == 0 {
+			continue
+		}
+		tfs[i] = map[string]int{}
+		for _, t := range tokens {
+			if terms[t] {
+				tfs[i][t]++
+			}
+		}
+		for t := range tfs[i] {
+			df[t]++
+		}
+		lengths[i] = len(tokens)
+		total += len(tokens)
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	avg := math.Max(float64(total)/float64(n), 1)
+	best, bestScore := 0.0, 0.0
+	for i := range a.Sentences {
+		s := &a.Sentences[i]
+		if tfs[i] == nil {
+			continue
+		}
+		s.Relevance = 0
+		for t, tf := range tfs[i] {
+			idf := portableLog(1 + (float64(n-df[t])+0.5)/(float64(df[t])+0.5))
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(lengths[i])/avg)
+			s.Relevance += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+		}
+		best = math.Max(best, s.Relevance)
+		bestScore = math.Max(bestScore, s.Score)
+	}
+	if best == 0 {
+		return
+	}
+	blended := make([]float64, len(a.Sentences))
+	for i, s := range a.Sentences {
+		if tfs[i] == nil {
+			continue
+		}
+		focus := s.Relevance / best
+		for d := 1; d <= proximityWindow; d++ {
+			for _, j := range []int{i - d, i + d} {
+				if j >= 0 && j < len(a.Sentences) && tfs[j] != nil {
+					focus = math.Max(focus, a.Sentences[j].Relevance/best/float64(int(1)<<d))
+				}
+			}
+		}
+		blended[i] = (1-queryWeight)*s.Score + queryWeight*bestScore*focus
+	}
+
+	candidates := make([]int, 0, len(a.Sentences))
+	for i := range a.Sentences {
+		s := &a.Sentences[i]
+		if !scored(*s) {
+			continue
+		}
+		if tfs[i] != nil {
+			s.Score = blended[i]
+		}
+		s.Reason = Keep
+		if !s.Anchor {
+			candidates = append(candidates, i)
+		}
+	}
+	toDrop := min(int(math.Floor(goDropRatios[aggr]*float64(len(a.Sentences)))), len(candidates))
+	sort.SliceStable(candidates, func(x, y int) bool {
+		sx, sy := a.Sentences[candidates[x]].Score, a.Sentences[candidates[y]].Score
+		if sx == sy {
+			return candidates[x] < candidates[y]
+		}
+		return sx < sy
+	})
+	for _, i := range candidates[:toDrop] {
+		a.Sentences[i].Reason = DropLowScore
+	}
+}
+
+// choose focuses a on opt.Query and returns the kept sentences, fitted to limit when set.
+func (a Analysis) choose(limit Size, opt Options, aggr int) []byte {
+	a.Focus(opt.Query, aggr)
+	if limit.IsZero() {
+		return a.Kept()
+	}
+	out, _ := a.Fit(limit, opt)
+	return out
+}
@@ -1,6 +1,9 @@
 package api
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 type NativeMetrics struct {
 	TokensParsed         uint64
@@ -13,6 +16,17 @@ type Options struct {
 	Aggressiveness int
 	MaxTokens      int
 	Profile        string
+	// TargetRatio, between 0 and 1, keeps about that fraction of the input's tokens and
+	// replaces the score cut of Aggressiveness. MaxBytes and MaxWords cap the output like
+	// MaxTokens. Limits are met by choosing whole sentences; see Analysis.Fit.
+	TargetRatio float64
+	MaxBytes    int
+	MaxWords    int
+	// Tokenizer counts tokens for MaxTokens and TargetRatio; nil means ApproxTokenizer.
+	Tokenizer Tokenizer
+	// Query, when set, favours the sentences relevant to it and those next to them over the
+	// rest of equal importance; see Sentence.Relevance and QueryTerms.
+	Query string
 }
 
 func Version() string {
@@ -42,18 +56,55 @@ func SqueezeBytes(in []byte, opt Options) ([]byte, error) {
 
 // SqueezeBytesWithProgress supports an optional progress callback.
 func SqueezeBytesWithProgress(in []byte, opt Options, cb func(float32)) ([]byte, error) {
+	out, _, err := squeeze(context.Background(), in, opt, cb)
+	return out, err
+}
+
+// SqueezeBytesWithMetrics also returns the engine counters of this call, which stay correct
+// when several squeezes run concurrently.
+func SqueezeBytesWithMetrics(in []byte, opt Options) ([]byte, NativeMetrics, error) {
+	return squeeze(context.Background(), in, opt, nil)
+}
+
+// SqueezeContext stops early once ctx is done, including in the middle of the engine's work,
+// and then returns an error wrapping ctx.Err().
+func SqueezeContext(ctx context.Context, in []byte, opt Options) ([]byte, error) {
+	out, _, err := squeeze(ctx, in, opt, nil)
+	return out, err
+}
+
+func squeeze(ctx context.Context, in []byte, opt Options, cb func(float32)) ([]byte, NativeMetrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, NativeMetrics{}, fmt.Errorf("squeeze failed: %w", err)
+	}
 	aggr := normalizeAggressiveness(opt)
-	var pCB *func(float32)
-	if cb != nil {
-		pCB = &cb
+	limit, err := opt.Limit(in)
+	if err != nil {
+		return nil, NativeMetrics{}, fmt.Errorf("squeeze failed: %w", err)
+	}
+	var out []byte
+	var m NativeMetrics
+	if limit.IsZero() && opt.Query == "" {
+		out, m, err = csqSqueeze(ctx, in, aggr, cb)
+	} else {
+		var a Analysis
+		if a, m, err = csqAnalyze(ctx, in, aggr); err == nil {
+			out = a.choose(limit, opt, aggr)
+		}
 	}
-	out, err := csqSqueeze(in, aggr, pCB)
 	if err != nil {
-		return nil, fmt.Errorf("squeeze failed: %w", err)
+		return nil, NativeMetrics{}, fmt.Errorf("squeeze failed: %w", err)
 	}
-	return out, nil
+	recordMetrics(m)
+	return out, m, nil
 }
 
+// LastNativeMetrics returns the counters of the most recent squeeze, whichever engine ran it.
+//
+// Deprecated: concurrent calls overwrite each other's counters; use SqueezeBytesWithMetrics
+// or the metrics returned by Engine.Squeeze.
 func LastNativeMetrics() NativeMetrics {
-	return csqLastMetrics()
+	lastMetricsMu.Lock()
+	defer lastMetricsMu.Unlock()
+	return lastMetrics
 }
@@ -8,16 +8,20 @@ package api
 #include "contextsqueeze.h"
 #include "metrics.h"
 
-extern void goProgressCallback(float pct, void* userData);
+extern int goProgressCallback(float pct, void* userData);
 */
 import "C"
 
 import (
+	"context"
 	"errors"
 	"math"
+	"runtime/cgo"
 	"unsafe"
 )
 
+const nativeAvailable = true
+
 func csqVersion() string {
 	return C.GoString(C.csq_version())
 }
@@ -26,8 +30,7 @@ func csqLastError() string {
 	return C.GoString(C.csq_last_error())
 }
 
-func csqLastMetrics() NativeMetrics {
-	m := C.csq_metrics_get()
+func nativeMetrics(m C.csq_metrics_snapshot) NativeMetrics {
 	return NativeMetrics{
 		TokensParsed:         uint64(m.tokens_parsed),
 		SentencesTotal:       uint64(m.sentences_total),
@@ -36,43 +39,104 @@ func csqLastMetrics() NativeMetrics {
 	}
 }
 
+// progressState travels to goProgressCallback through a cgo.Handle, since C may not hold
+// Go pointers to the context or the callback.
+type progressState struct {
+	ctx context.Context
+	cb  func(float32)
+}
+
 //export goProgressCallback
-func goProgressCallback(pct C.float, userData unsafe.Pointer) {
-	cb := (*func(float32))(userData)
-	if cb != nil {
-		(*cb)(float32(pct))
+func goProgressCallback(pct C.float, userData unsafe.Pointer) C.int {
+	st := (*(*cgo.Handle)(userData)).Value().(*progressState)
+	if st.cb != nil {
+		st.cb(float32(pct))
 	}
+	if st.ctx.Err() != nil {
+		return 1
+	}
+	return 0
 }
 
-func csqSqueeze(in []byte, aggr int, cb *func(float32)) ([]byte, error) {
-	var view C.csq_view
-	if len(in) > 0 {
-		view.data = (*C.char)(unsafe.Pointer(&in[0]))
-		view.len = C.size_t(len(in))
+// abortArgs returns the callback arguments that let ctx, and cb when set, follow a native
+// call. release must be called once the call returns.
+func abortArgs(ctx context.Context, cb func(float32)) (C.csq_progress_abort_cb, unsafe.Pointer, func()) {
+	if cb == nil && ctx.Done() == nil {
+		return nil, nil, func() {}
 	}
+	h := cgo.NewHandle(&progressState{ctx: ctx, cb: cb})
+	return (C.csq_progress_abort_cb)(C.goProgressCallback), unsafe.Pointer(&h), h.Delete
+}
 
-	var out C.csq_buf
-	var status C.int
-	if cb != nil {
-		status = C.csq_squeeze_progress(view, C.int(aggr), (C.csq_progress_cb)(C.goProgressCallback), unsafe.Pointer(cb), &out)
-	} else {
-		status = C.csq_squeeze_ex(view, C.int(aggr), &out)
+func nativeStatus(ctx context.Context, status C.int) error {
+	if status == C.CSQ_ERR_ABORTED && ctx.Err() != nil {
+		return ctx.Err()
 	}
-
 	if status != 0 {
 		errStr := csqLastError()
 		if errStr == "" {
 			errStr = "native squeeze returned non-zero"
 		}
-		return nil, errors.New(errStr)
+		return errors.New(errStr)
+	}
+	return nil
+}
+
+func csqSqueeze(ctx context.Context, in []byte, aggr int, cb func(float32)) ([]byte, NativeMetrics, error) {
+	var view C.csq_view
+	if len(in) > 0 {
+		view.data = (*C.char)(unsafe.Pointer(&in[0]))
+		view.len = C.size_t(len(in))
+	}
+
+	var out C.csq_buf
+	var cm C.csq_metrics_snapshot
+	abort, userData, release := abortArgs(ctx, cb)
+	status := C.csq_squeeze_metrics(view, C.int(aggr), abort, userData, &out, &cm)
+	release()
+	if err := nativeStatus(ctx, status); err != nil {
+		return nil, NativeMetrics{}, err
 	}
 	defer C.csq_free(&out)
+	m := nativeMetrics(cm)
 
 	if out.data == nil || out.len == 0 {
-		return []byte{}, nil
+		return []byte{}, m, nil
 	}
 	if out.len > C.size_t(math.MaxInt32) {
-		return nil, errors.New("native output too large")
+		return nil, NativeMetrics{}, errors.New("native output too large")
+	}
+	return C.GoBytes(unsafe.Pointer(out.data), C.int(out.len)), m, nil
+}
+
+func csqAnalyze(ctx context.Context, in []byte, aggr int) (Analysis, NativeMetrics, error) {
+	var view C.csq_view
+	if len(in) > 0 {
+		view.data = (*C.char)(unsafe.Pointer(&in[0]))
+		view.len = C.size_t(len(in))
+	}
+
+	var out C.csq_analysis
+	var cm C.csq_metrics_snapshot
+	abort, userData, release := abortArgs(ctx, nil)
+	status := C.csq_analyze(view, C.int(aggr), abort, userData, &out, &cm)
+	release()
+	if err := nativeStatus(ctx, status); err != nil {
+		return Analysis{}, NativeMetrics{}, err
+	}
+	defer C.csq_analysis_free(&out)
+	if out.text.len > C.size_t(math.MaxInt32) {
+		return Analysis{}, NativeMetrics{}, errors.New("native output too large")
+	}
+
+	a := Analysis{Text: []byte{}, Sentences: make([]Sentence, int(out.count))}
+	if out.text.len > 0 {
+		a.Text = C.GoBytes(unsafe.Pointer(out.text.data), C.int(out.text.len))
+	}
+	if out.count > 0 {
+		for i, s := range unsafe.Slice(out.sentences, int(out.count)) {
+			a.Sentences[i] = Sentence{Start: int(s.start), End: int(s.end), Score: float64(s.score), Anchor: s.anchor != 0, Reason: DropReason(s.reason)}
+		}
 	}
-	return C.GoBytes(unsafe.Pointer(out.data), C.int(out.len)), nil
+	return a, nativeMetrics(cm), nil
 }
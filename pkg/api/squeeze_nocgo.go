@@ -2,12 +2,27 @@
 
 package api
 
+import "context"
+
+const nativeAvailable = false
+
 func csqVersion() string { return "1.0.0" }
 
-func csqSqueeze(in []byte, _ int, _ *func(float32)) ([]byte, error) {
-	out := make([]byte, len(in))
-	copy(out, in)
-	return out, nil
+// Without cgo the pure-Go port of the native engine does the work.
+func csqSqueeze(ctx context.Context, in []byte, aggr int, cb func(float32)) ([]byte, NativeMetrics, error) {
+	var m NativeMetrics
+	out, err := goSqueeze(ctx, in, aggr, cb, &m)
+	if err != nil {
+		return nil, NativeMetrics{}, err
+	}
+	return out, m, nil
 }
 
-func csqLastMetrics() NativeMetrics { return NativeMetrics{} }
+func csqAnalyze(ctx context.Context, in []byte, aggr int) (Analysis, NativeMetrics, error) {
+	var m NativeMetrics
+	a, err := goAnalyze(goProgress{ctx: ctx}, append([]byte{}, in...), aggr, &m)
+	if err != nil {
+		return Analysis{}, NativeMetrics{}, err
+	}
+	return a, m, nil
+}
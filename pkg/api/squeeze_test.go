@@ -2,6 +2,11 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -34,3 +39,258 @@ func TestSqueezeAggressivenessHighShorter(t *testing.T) {
 		t.Fatalf("expected shorter output at higher aggressiveness; in=%d out=%d", len(in), len(out))
 	}
 }
+
+func TestEngineByName(t *testing.T) {
+	e, err := EngineByName("go")
+	if err != nil || e.Name() != "go" {
+		t.Fatalf("go engine: %v %v", e, err)
+	}
+	if _, err := EngineByName("rust"); err == nil {
+		t.Fatal("expected unknown engine error")
+	}
+	in := []byte("Noise sentence repeated. Noise sentence repeated. Unique insight quartz99 once.\n")
+	want, err := SqueezeBytes(in, Options{Aggressiveness: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := e.Squeeze(context.Background(), in, Options{Aggressiveness: 6})
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("go engine output %q, default %q (%v)", got, want, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := DefaultEngine().Squeeze(ctx, in, Options{}); err == nil {
+		t.Fatal("expected cancelled context error")
+	}
+}
+
+func TestConcurrentMetrics(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("One sentence here. Another sentence there. One sentence here."),
+		[]byte(strings.Repeat("Repeated line of filler text. ", 40) + "Unique closing remark."),
+		[]byte("Short."),
+	}
+	want := make([]NativeMetrics, len(inputs))
+	for i, in := range inputs {
+		_, m, err := SqueezeBytesWithMetrics(in, Options{Aggressiveness: 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = m
+	}
+	if want[2].SentencesTotal != 1 || want[0].SentencesTotal != 3 {
+		t.Fatalf("unexpected metrics: %+v", want)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 64)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < 20; r++ {
+				i := (g + r) % len(inputs)
+				_, m, err := SqueezeBytesWithMetrics(inputs[i], Options{Aggressiveness: 6})
+				if err != nil || m != want[i] {
+					errs <- fmt.Sprintf("input %d: got %+v want %+v (%v)", i, m, want[i], err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Fatal(e)
+	}
+}
+
+func TestSqueezeContextCancel(t *testing.T) {
+	in := []byte(strings.Repeat("Alpha beta gamma delta. Epsilon zeta eta theta.\n\n", 200))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SqueezeContext(ctx, in, Options{Aggressiveness: 6}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	for _, name := range []string{"native", "go"} {
+		e, err := EngineByName(name)
+		if err != nil {
+			continue
+		}
+		if _, _, err := e.Squeeze(ctx, in, Options{Aggressiveness: 6}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected context.Canceled, got %v", name, err)
+		}
+	}
+
+	// Cancelling from the first progress report must stop the engine before it finishes.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	reports := 0
+	_, _, err := csqSqueeze(ctx, in, 6, func(float32) {
+		reports++
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) || reports != 1 {
+		t.Fatalf("expected abort after one report, got %v after %d", err, reports)
+	}
+}
+
+func TestAnalyzeKeptMatchesSqueeze(t *testing.T) {
+	in := []byte("# Notes\nIntro line. Noise sentence repeated. Noise sentence repeated. Short.\n" +
+		"Unique insight with token quartz99 appears once. Another remark about the weather.\n")
+	engines := []Engine{GoEngine(), DefaultEngine()}
+	for _, e := range engines {
+		for _, aggr := range []int{0, 6} {
+			want, _, err := e.Squeeze(context.Background(), in, Options{Aggressiveness: aggr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, _, err := e.Analyze(context.Background(), in, Options{Aggressiveness: aggr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(a.Kept(), want) {
+				t.Fatalf("%s aggr %d: kept sentences %q differ from squeeze output %q", e.Name(), aggr, a.Kept(), want)
+			}
+			reasons := map[DropReason]int{}
+			for _, s := range a.Sentences {
+				reasons[s.Reason]++
+				if s.Reason == Keep && !s.Anchor && s.Score <= 0 {
+					t.Fatalf("%s aggr %d: kept sentence %q has no score", e.Name(), aggr, a.Text[s.Start:s.End])
+				}
+			}
+			if aggr == 6 && reasons[DropNearDuplicate] == 0 {
+				t.Fatalf("%s: expected a near duplicate, got %v", e.Name(), reasons)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, e := range engines {
+		if _, _, err := e.Analyze(ctx, in, Options{Aggressiveness: 6}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected context.Canceled, got %v", e.Name(), err)
+		}
+	}
+}
+
+func TestSqueezeSizeLimits(t *testing.T) {
+	word := func(n int) string { return string([]byte{byte('a' + n%26), byte('a' + n/26%26), byte('a' + n*7%26)}) }
+	var b bytes.Buffer
+	for i := 0; i < 60; i++ {
+		fmt.Fprintf(&b, "Report %s notes %s beside %s and %s.\n\n", word(i), word(i*3+1), word(i*11+5), word(i*17+2))
+	}
+	in := b.Bytes()
+	for _, e := range []Engine{GoEngine(), DefaultEngine()} {
+		for _, opt := range []Options{
+			{Aggressiveness: 0, TargetRatio: 0.3},
+			{Aggressiveness: 9, TargetRatio: 0.6},
+			{Aggressiveness: 2, MaxBytes: 500},
+			{Aggressiveness: 2, MaxWords: 40, MaxTokens: 1000},
+		} {
+			out, _, err := e.Squeeze(context.Background(), in, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit, _ := opt.Limit(in)
+			if got := Measure(out, nil); !got.Within(limit) || got.Share(limit) < 0.9 {
+				t.Fatalf("%s %+v: %+v does not fill %+v", e.Name(), opt, got, limit)
+			}
+		}
+		if _, _, err := e.Squeeze(context.Background(), in, Options{TargetRatio: 1.5}); err == nil {
+			t.Fatalf("%s: expected error for target ratio 1.5", e.Name())
+		}
+	}
+}
+
+func TestFitSeparators(t *testing.T) {
+	text := []byte("Alpha kept here.\n\nFiller one.\n\nOmega kept too.\n")
+	a := Analysis{Text: text, Sentences: []Sentence{
+		{Start: 0, End: 16, Score: 12},
+		{Start: 16, End: 18},
+		{Start: 18, End: 29, Score: 1},
+		{Start: 29, End: 31},
+		{Start: 31, End: len(text), Score: 9},
+	}}
+	for _, c := range []struct {
+		limit Size
+		want  string
+	}{
+		{Size{Bytes: 40}, "Alpha kept here.\n\nOmega kept too.\n"},
+		{Size{Bytes: 20}, "Alpha kept here."},
+		{Size{Tokens: 1}, ""},
+	} {
+		if out, _ := a.Fit(c.limit, Options{}); string(out) != c.want {
+			t.Fatalf("%+v: got %q, want %q", c.limit, out, c.want)
+		}
+	}
+}
+
+func TestSqueezeQueryFocus(t *testing.T) {
+	word := func(n int) string { return string([]byte{byte('a' + n%26), byte('a' + n/26%26), byte('a' + n*7%26)}) }
+	var b bytes.Buffer
+	for i := 0; i < 60; i++ {
+		if i%6 == 0 {
+			fmt.Fprintf(&b, "Report %s notes the glacier. ", word(i))
+		} else {
+			fmt.Fprintf(&b, "Report %s notes %s beside %s and %s. ", word(i), word(i*3+1), word(i*11+5), word(i*17+2))
+		}
+		if i%5 == 4 {
+			b.WriteString("\n\n")
+		}
+	}
+	in := b.Bytes()
+	for _, e := range []Engine{GoEngine(), DefaultEngine()} {
+		plain, _, err := e.Squeeze(context.Background(), in, Options{Aggressiveness: 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		focused, _, err := e.Squeeze(context.Background(), in, Options{Aggressiveness: 9, Query: "Glacier"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Count(focused, []byte("glacier")); got != 10 || got <= bytes.Count(plain, []byte("glacier")) {
+			t.Fatalf("%s: query kept %d glacier sentences, %d without", e.Name(), got, bytes.Count(plain, []byte("glacier")))
+		}
+		a, _, err := e.Analyze(context.Background(), in, Options{Aggressiveness: 9, Query: "Glacier"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a.Kept(), focused) {
+			t.Fatalf("%s: analysis does not match squeeze", e.Name())
+		}
+		for _, s := range a.Sentences {
+			if relevant := bytes.Contains(a.Text[s.Start:s.End], []byte("glacier")); relevant != (s.Relevance > 0) {
+				t.Fatalf("%s: relevance %g for %q", e.Name(), s.Relevance, a.Text[s.Start:s.End])
+			}
+		}
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	for query, want := range map[string]string{
+		"Café au LAIT":     "café au lait",
+		"cafe\u0301 crème": "cafe\u0301 crème",
+		"東京の天気 2024":       "東 京 の 天 気 2024",
+		"Straße, naïve?":   "straße naïve",
+		"the and of":       "",
+	} {
+		if got := strings.Join(QueryTerms(query), " "); got != want {
+			t.Fatalf("QueryTerms(%q) = %q, want %q", query, got, want)
+		}
+	}
+	in := []byte("Le café est chaud. Il pleut sur la ville. 東京の天気は晴れです。")
+	for _, query := range []string{"CAFÉ", "天気"} {
+		a, _, err := GoEngine().Analyze(context.Background(), in, Options{Aggressiveness: 1, Query: query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		relevant := 0
+		for _, s := range a.Sentences {
+			if s.Relevance > 0 {
+				relevant++
+			}
+		}
+		if relevant == 0 {
+			t.Fatalf("query %q matched no sentence of %q", query, in)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+// Tokenizer counts the tokens a model would see in some text. Count must be safe for
+// concurrent use. Options.Tokenizer and the pipeline's budgets and stats use it; nil means
+// ApproxTokenizer.
+type Tokenizer interface {
+	Name() string
+	Count(b []byte) int
+}
+
+type approxTokenizer struct{}
+
+func (approxTokenizer) Name() string { return "approx" }
+
+func (approxTokenizer) Count(b []byte) int { return Measure(b, nil).Tokens }
+
+// ApproxTokenizer estimates one token per four bytes, rounded up, plus one per word. It
+// needs no vocabulary but overshoots on English prose and undershoots on code and CJK.
+func ApproxTokenizer() Tokenizer { return approxTokenizer{} }
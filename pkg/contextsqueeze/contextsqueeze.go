@@ -0,0 +1,344 @@
+// Package contextsqueeze runs the whole contextsqueeze command as a library: format detection,
+// text extraction, normalization and budgeted compression. A Squeezer is configured once and
+// returns the same Result the command prints with --json.
+package contextsqueeze
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+	"unicode/utf8"
+
+	"contextsqueezer/internal/ingest"
+	"contextsqueezer/internal/pipeline"
+	"contextsqueezer/internal/version"
+	"contextsqueezer/pkg/api"
+	"contextsqueezer/pkg/format"
+)
+
+// SchemaVersion is the version of the JSON layout of Result.
+const SchemaVersion = 1
+
+// Config holds the options of the contextsqueeze command. The zero value squeezes nothing:
+// like api.Options, Aggressiveness 0 keeps the input as-is.
+type Config struct {
+	// Aggressiveness is 0..9; a negative value picks the Profile default. The command's
+	// --aggr defaults to -1, so set -1 here to squeeze the way it does: 0 is a real level
+	// that keeps every sentence.
+	Aggressiveness int
+	MaxTokens      int
+	Profile        string
+	// TargetRatio, MaxBytes and MaxWords are the size limits of api.Options.
+	TargetRatio float64
+	MaxBytes    int
+	MaxWords    int
+	// Tokenizer counts tokens for the limits and the result; nil means api.ApproxTokenizer.
+	Tokenizer api.Tokenizer
+	// Query focuses the squeeze on what is relevant to it; see api.Options.Query.
+	Query string
+	// MaxMemoryMB is the soft memory ceiling; 0 means 1024.
+	MaxMemoryMB int
+	// Source names a registered format.Parser to skip detection; "" or "auto" detects.
+	Source string
+	// Encoding is "auto" (or "") or one of the names accepted by --encoding.
+	Encoding        string
+	NoNormalize     bool
+	NoInferHeadings bool
+	Provenance      bool
+	MetadataHeader  bool
+	// Engine defaults to api.DefaultEngine().
+	Engine api.Engine
+	// Workers bounds how many chunks are compressed at once; 0 means all CPUs.
+	Workers int
+}
+
+func (c Config) options() api.Options {
+	return api.Options{Aggressiveness: c.Aggressiveness, MaxTokens: c.MaxTokens, Profile: c.Profile, TargetRatio: c.TargetRatio, MaxBytes: c.MaxBytes, MaxWords: c.MaxWords, Tokenizer: c.Tokenizer, Query: c.Query}
+}
+
+// Squeezer is safe for concurrent use.
+type Squeezer struct {
+	cfg Config
+}
+
+// New validates cfg and fills in defaults.
+func New(cfg Config) (*Squeezer, error) {
+	if cfg.Source != "" && cfg.Source != "auto" {
+		if _, ok := format.Lookup(cfg.Source); !ok {
+			return nil, fmt.Errorf("unknown source %q", cfg.Source)
+		}
+	}
+	switch cfg.Profile {
+	case "", "local", "api":
+	default:
+		return nil, fmt.Errorf("unknown profile %q (want local or api)", cfg.Profile)
+	}
+	if cfg.MaxTokens < 0 {
+		return nil, fmt.Errorf("max tokens must not be negative, got %d", cfg.MaxTokens)
+	}
+	if _, err := cfg.options().Limit(nil); err != nil {
+		return nil, err
+	}
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative, got %d", cfg.Workers)
+	}
+	if cfg.Engine == nil {
+		cfg.Engine = api.DefaultEngine()
+	}
+	return &Squeezer{cfg: cfg}, nil
+}
+
+// SqueezeBytes detects the format of data by content alone; set Config.Source to skip it.
+func (s *Squeezer) SqueezeBytes(ctx context.Context, data []byte) (Result, error) {
+	return s.SqueezeReader(ctx, bytes.NewReader(data))
+}
+
+// SqueezeFile also uses the file extension for format detection.
+func (s *Squeezer) SqueezeFile(ctx context.Context, path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	return s.squeeze(ctx, path, f)
+}
+
+// SqueezeReader reads r to the end, up to the CSQ_MAX_BYTES limit.
+func (s *Squeezer) SqueezeReader(ctx context.Context, r io.Reader) (Result, error) {
+	return s.squeeze(ctx, "", r)
+}
+
+// Stream squeezes UTF-8 text from r into w incrementally, holding about one window of input
+// in memory however long r is. Format detection, Provenance and MetadataHeader do not apply,
+// and the returned Result has no Text. A budget is spread over the whole input when r is a
+// regular file and spent from the start otherwise; see pipeline.RunStream.
+func (s *Squeezer) Stream(ctx context.Context, r io.Reader, w io.Writer) (Result, error) {
+	cfg := pipeline.RunConfig{MaxMemoryMB: s.cfg.MaxMemoryMB, Engine: s.cfg.Engine, Workers: s.cfg.Workers}
+	if f, ok := r.(*os.File); ok {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			if pos, err := f.Seek(0, io.SeekCurrent); err == nil {
+				cfg.StreamSize = st.Size() - pos
+			}
+		}
+	}
+	opts := ingest.Options{NoNormalize: s.cfg.NoNormalize, NoHeadings: s.cfg.NoInferHeadings}
+	cfg.Prepare = func(b []byte) ([]byte, []string) { return ingest.PrepareText(b, opts) }
+	res, err := pipeline.RunStream(ctx, r, w, s.cfg.options(), cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	return NewResult(ingest.Result{Detection: ingest.Detection{Confidence: 1, Reason: "streamed as text"}}, res, s.cfg.Engine.Name()), nil
+}
+
+func (s *Squeezer) squeeze(ctx context.Context, name string, r io.Reader) (Result, error) {
+	start := time.Now()
+	ing, err := ingest.RunReader(ctx, name, r, ingest.Options{Source: s.cfg.Source, Encoding: s.cfg.Encoding, NoNormalize: s.cfg.NoNormalize, NoHeadings: s.cfg.NoInferHeadings})
+	if err != nil {
+		return Result{}, err
+	}
+	ingestMS := time.Since(start).Milliseconds()
+	res, err := pipeline.RunResultWithConfig(ctx, ing.Text,
+		s.cfg.options(),
+		ing.SourceType, ing.Warnings,
+		pipeline.RunConfig{MaxMemoryMB: s.cfg.MaxMemoryMB, Provenance: s.cfg.Provenance, SourceMap: ing.SourceMap, Metadata: ing.Metadata, MetadataHeader: s.cfg.MetadataHeader, Engine: s.cfg.Engine, Workers: s.cfg.Workers},
+	)
+	if err != nil {
+		return Result{}, err
+	}
+	res.Metrics.IngestMS = ingestMS
+	return NewResult(ing, res, s.cfg.Engine.Name()), nil
+}
+
+// Build describes the binary that produced a Result.
+type Build struct {
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+	CGO    string `json:"cgo"`
+}
+
+// Detection explains which parser was chosen for the input.
+type Detection struct {
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason"`
+}
+
+// Section is a byte range of the extracted text that was squeezed as one chunk. With
+// Config.Query, Relevance is the highest BM25 relevance among the sentences kept from it.
+type Section struct {
+	Start     int      `json:"start"`
+	End       int      `json:"end"`
+	Heading   string   `json:"heading,omitempty"`
+	Keywords  []string `json:"keywords,omitempty"`
+	Relevance *float64 `json:"relevance,omitempty"`
+}
+
+// Provenance ties a byte range of Result.Text to the extracted-text range it came from and,
+// when the format reports it, to its place in the original file.
+type Provenance struct {
+	OutStart int `json:"out_start"`
+	OutEnd   int `json:"out_end"`
+	InStart  int `json:"in_start"`
+	InEnd    int `json:"in_end"`
+	format.Location
+}
+
+// Target pairs a size limit of Config with what the output achieved. Name is "tokens",
+// "ratio", "bytes" or "words"; a ratio is of approximate tokens.
+type Target struct {
+	Name     string  `json:"name"`
+	Target   float64 `json:"target"`
+	Achieved float64 `json:"achieved"`
+}
+
+// Metrics are per-stage timings and engine counters. They are not part of the JSON schema.
+type Metrics struct {
+	IngestMS             int64
+	SegmentationMS       int64
+	TokenizationMS       int64
+	CandidateFilterMS    int64
+	SimilarityMS         int64
+	PruneMS              int64
+	AssemblyMS           int64
+	CrossChunkRegistryMS int64
+	BudgetLoopMS         int64
+	SimilarityCandidates uint64
+	SimilarityPairs      uint64
+	TokensParsed         uint64
+	SentencesTotal       uint64
+	PeakMemoryEstimateB  int64
+}
+
+// Result marshals to the JSON printed by contextsqueeze --json, with Text as "text" when it
+// is valid UTF-8 and as base64 "text_b64" otherwise.
+type Result struct {
+	SchemaVersion int    `json:"schema_version"`
+	EngineVersion string `json:"engine_version"`
+	Build         Build  `json:"build"`
+	Engine        string `json:"engine"`
+	BytesIn       int    `json:"bytes_in"`
+	BytesOut      int    `json:"bytes_out"`
+	// TokensIn and TokensOut are counted with Config.Tokenizer. TokensInApprox and
+	// TokensOutApprox are their older names and hold the same, exact with a vocabulary.
+	TokensIn        int             `json:"tokens_in"`
+	TokensOut       int             `json:"tokens_out"`
+	TokensInApprox  int             `json:"tokens_in_approx"`
+	TokensOutApprox int             `json:"tokens_out_approx"`
+	Tokenizer       string          `json:"tokenizer,omitempty"`
+	ReductionPct    float64         `json:"reduction_pct"`
+	Aggressiveness  int             `json:"aggressiveness"`
+	Profile         string          `json:"profile"`
+	BudgetApplied   bool            `json:"budget_applied"`
+	Truncated       bool            `json:"truncated"`
+	SourceType      string          `json:"source_type"`
+	Detection       Detection       `json:"detection"`
+	SourceURL       string          `json:"source_url,omitempty"`
+	Metadata        format.Metadata `json:"metadata"`
+	Sections        []Section       `json:"sections"`
+	Provenance      []Provenance    `json:"provenance,omitempty"`
+	Targets         []Target        `json:"targets,omitempty"`
+	Warnings        []string        `json:"warnings"`
+	Metrics         Metrics         `json:"-"`
+	Text            []byte          `json:"-"`
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	type plain Result
+	out := struct {
+		plain
+		Text    string `json:"text,omitempty"`
+		TextB64 string `json:"text_b64,omitempty"`
+	}{plain: plain(r)}
+	if utf8.Valid(r.Text) {
+		out.Text = string(r.Text)
+	} else {
+		out.TextB64 = base64.StdEncoding.EncodeToString(r.Text)
+	}
+	return json.Marshal(out)
+}
+
+func (r *Result) UnmarshalJSON(b []byte) error {
+	type plain Result
+	in := struct {
+		*plain
+		Text    string `json:"text"`
+		TextB64 string `json:"text_b64"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if in.TextB64 != "" {
+		text, err := base64.StdEncoding.DecodeString(in.TextB64)
+		if err != nil {
+			return fmt.Errorf("text_b64: %w", err)
+		}
+		r.Text = text
+		return nil
+	}
+	r.Text = []byte(in.Text)
+	return nil
+}
+
+// NewResult assembles the Result of an ingest and pipeline run with the named engine. The
+// command builds its --json output with it.
+func NewResult(ing ingest.Result, res pipeline.Result, engine string) Result {
+	out := Result{
+		SchemaVersion:   SchemaVersion,
+		EngineVersion:   version.Current(),
+		Build:           Build{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, CGO: version.CGO()},
+		Engine:          engine,
+		BytesIn:         res.BytesIn,
+		BytesOut:        res.BytesOut,
+		TokensIn:        res.TokensInApprox,
+		TokensOut:       res.TokensOutApprox,
+		TokensInApprox:  res.TokensInApprox,
+		TokensOutApprox: res.TokensOutApprox,
+		Tokenizer:       res.Tokenizer,
+		ReductionPct:    res.ReductionPct,
+		Aggressiveness:  res.Aggressiveness,
+		Profile:         res.Profile,
+		BudgetApplied:   res.BudgetApplied,
+		Truncated:       res.Truncated,
+		SourceType:      res.SourceType,
+		Detection:       Detection{Confidence: ing.Detection.Confidence, Reason: ing.Detection.Reason},
+		SourceURL:       ing.SourceURL,
+		Metadata:        res.Metadata,
+		Sections:        make([]Section, 0, len(res.Sections)),
+		Warnings:        res.Warnings,
+		Text:            res.Text,
+		Metrics: Metrics{
+			IngestMS:             res.Metrics.IngestMS,
+			SegmentationMS:       res.Metrics.SegmentationMS,
+			TokenizationMS:       res.Metrics.TokenizationMS,
+			CandidateFilterMS:    res.Metrics.CandidateFilterMS,
+			SimilarityMS:         res.Metrics.SimilarityMS,
+			PruneMS:              res.Metrics.PruneMS,
+			AssemblyMS:           res.Metrics.AssemblyMS,
+			CrossChunkRegistryMS: res.Metrics.CrossChunkRegistryMS,
+			BudgetLoopMS:         res.Metrics.BudgetLoopMS,
+			SimilarityCandidates: res.Metrics.SimilarityCandidates,
+			SimilarityPairs:      res.Metrics.SimilarityPairs,
+			TokensParsed:         res.Metrics.TokensParsed,
+			SentencesTotal:       res.Metrics.SentencesTotal,
+			PeakMemoryEstimateB:  res.Metrics.PeakMemoryEstimateB,
+		},
+	}
+	for _, s := range res.Sections {
+		out.Sections = append(out.Sections, Section(s))
+	}
+	for _, p := range res.Provenance {
+		out.Provenance = append(out.Provenance, Provenance(p))
+	}
+	for _, t := range res.Targets {
+		out.Targets = append(out.Targets, Target(t))
+	}
+	if out.Warnings == nil {
+		out.Warnings = []string{}
+	}
+	return out
+}
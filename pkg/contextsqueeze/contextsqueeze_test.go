@@ -0,0 +1,65 @@
+package contextsqueeze
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSqueezerInputs(t *testing.T) {
+	sq, err := New(Config{Aggressiveness: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := "<html><body><h1>Title</h1><p>Body text.</p></body></html>"
+	res, err := sq.SqueezeReader(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SourceType != "html" || !strings.Contains(string(res.Text), "# Title") {
+		t.Fatalf("unexpected result %q from %s", res.Text, res.SourceType)
+	}
+
+	raw := []byte{0xff, 0xfe, 0xfd, 0xfa}
+	sq, _ = New(Config{Encoding: "utf-8", Source: "text"})
+	res, err = sq.SqueezeBytes(context.Background(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(res)
+	var back Result
+	if err := json.Unmarshal(b, &back); err != nil || !bytes.Equal(back.Text, raw) || !bytes.Contains(b, []byte(`"text_b64"`)) {
+		t.Fatalf("binary text did not round-trip through text_b64: %s", b)
+	}
+
+	if _, err := New(Config{Source: "nope"}); err == nil {
+		t.Fatal("expected error for unknown source")
+	}
+	if _, err := sq.SqueezeFile(context.Background(), "does-not-exist.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sq.SqueezeBytes(ctx, []byte("text")); err == nil {
+		t.Fatal("expected error for cancelled context")
+	}
+}
+
+func TestSqueezerStream(t *testing.T) {
+	sq, err := New(Config{Aggressiveness: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Repeat("A line of log text.\n", 100)
+	var out bytes.Buffer
+	res, err := sq.Stream(context.Background(), strings.NewReader(in), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "A line of log text.\n" || res.BytesOut != out.Len() || res.Text != nil {
+		t.Fatalf("unexpected stream result %q (%d bytes reported)", out.String(), res.BytesOut)
+	}
+}
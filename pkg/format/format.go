@@ -0,0 +1,189 @@
+// Package format is the registry of input parsers used by ingest. The built-in parsers (pdf,
+// office and epub containers, archives, markup, email and text) register themselves when the
+// ingest package is linked in; applications add in-house formats by calling Register from an
+// init function.
+package format
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Sniff scores, highest wins; ties go to the parser registered first. A content hint is a
+// substring match, structure means the data parsed as the format, extension is the file name
+// alone and magic is a signature or container manifest naming the format.
+const (
+	ScoreNone      = 0
+	ScoreContent   = 30
+	ScoreStructure = 45
+	ScoreExtension = 60
+	ScoreMagic     = 90
+	ScoreOverride  = 100
+)
+
+type Document struct {
+	Text     []byte
+	Warnings []string
+	// SourceMap is optional; spans are ordered, non-overlapping byte ranges of Text.
+	SourceMap []SourceSpan
+	Metadata  Metadata
+}
+
+// Metadata is what the source document says about itself. Empty fields are unknown; Created
+// is RFC 3339 when the source date could be parsed and verbatim otherwise.
+type Metadata struct {
+	Title    string `json:"title,omitempty"`
+	Author   string `json:"author,omitempty"`
+	Created  string `json:"created,omitempty"`
+	Pages    int    `json:"pages,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+func (m Metadata) IsZero() bool { return m == Metadata{} }
+
+// Location points into the original file. Zero fields are unknown; numbers are 1-based.
+type Location struct {
+	File      string `json:"file,omitempty"`
+	Page      int    `json:"page,omitempty"`
+	Paragraph int    `json:"paragraph,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Element   string `json:"element,omitempty"`
+}
+
+type SourceSpan struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	Location
+}
+
+// Locate returns the location of the span containing offset, if any.
+func Locate(spans []SourceSpan, offset int) (Location, bool) {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].End > offset })
+	if i < len(spans) && spans[i].Start <= offset {
+		return spans[i].Location, true
+	}
+	return Location{}, false
+}
+
+type Source struct {
+	Name string
+	Data []byte
+	// Nested re-enters detection for an embedded file, for container formats.
+	Nested func(ctx context.Context, name string, data []byte) (Document, error)
+	// Budget bounds what container formats may inflate. Every nesting level of one input
+	// spends from the same Budget, so nesting archives cannot multiply the limits.
+	Budget Budget
+}
+
+// Budget bounds the bytes and entries inflated out of one input and all the containers
+// nested in it.
+type Budget interface {
+	// Inflate reads one container entry stored in compressed bytes, or 0 when unknown, and
+	// fails once the input as a whole would expand past its limits.
+	Inflate(name string, r io.Reader, compressed int64) ([]byte, error)
+	// Entries fails when n more entries would exceed the input's entry limit.
+	Entries(n int) error
+}
+
+type Parser interface {
+	Name() string
+	// Sniff returns how confident the parser is that data, read from path, is its format,
+	// and a short human-readable reason for the score.
+	Sniff(path string, data []byte) (int, string)
+	Parse(ctx context.Context, src Source) (Document, error)
+}
+
+var (
+	mu      sync.RWMutex
+	parsers []Parser
+	byName  = map[string]Parser{}
+)
+
+func Register(p Parser) error {
+	if p == nil || p.Name() == "" {
+		return errors.New("format: parser must have a name")
+	}
+	if p.Name() == "auto" {
+		return errors.New(`format: "auto" is reserved`)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := byName[p.Name()]; ok {
+		return fmt.Errorf("format: parser %q already registered", p.Name())
+	}
+	parsers = append(parsers, p)
+	byName[p.Name()] = p
+	return nil
+}
+
+func MustRegister(p Parser) {
+	if err := Register(p); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the parser registered as name, if any, so tests can undo Register.
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := byName[name]; !ok {
+		return
+	}
+	delete(byName, name)
+	for i, p := range parsers {
+		if p.Name() == name {
+			parsers = append(parsers[:i:i], parsers[i+1:]...)
+			break
+		}
+	}
+}
+
+func Lookup(name string) (Parser, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := byName[name]
+	return p, ok
+}
+
+// Parsers returns the registered parsers in registration order.
+func Parsers() []Parser {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Parser{}, parsers...)
+}
+
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(parsers))
+	for _, p := range parsers {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+type Detection struct {
+	Parser Parser
+	Score  int
+	Reason string
+}
+
+// Confidence maps the score onto 0..1.
+func (d Detection) Confidence() float64 {
+	return float64(d.Score) / float64(ScoreOverride)
+}
+
+// Best returns the highest scoring parser for path and data; Parser is nil when none matches.
+func Best(path string, data []byte) Detection {
+	best := Detection{}
+	for _, p := range Parsers() {
+		if s, reason := p.Sniff(path, data); s > best.Score {
+			best = Detection{Parser: p, Score: s, Reason: reason}
+		}
+	}
+	return best
+}
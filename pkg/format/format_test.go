@@ -0,0 +1,53 @@
+package format
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type stubParser struct {
+	name  string
+	score int
+}
+
+func (p stubParser) Name() string                       { return p.name }
+func (p stubParser) Sniff(string, []byte) (int, string) { return p.score, "stub" }
+func (p stubParser) Parse(context.Context, Source) (Document, error) {
+	return Document{Text: []byte(p.name)}, nil
+}
+
+func TestRegisterAndBest(t *testing.T) {
+	for _, name := range []string{"stub-low", "stub-high", "stub-tie"} {
+		t.Cleanup(func() { Unregister(name) })
+	}
+	if err := Register(stubParser{name: "stub-low", score: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(stubParser{name: "stub-high", score: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(stubParser{name: "stub-tie", score: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(stubParser{name: "stub-low", score: 99}); err == nil {
+		t.Fatal("expected duplicate registration error")
+	}
+	if err := Register(stubParser{name: "auto"}); err == nil {
+		t.Fatal("expected reserved name error")
+	}
+	d := Best("x.any", nil)
+	if d.Parser == nil || d.Parser.Name() != "stub-high" || d.Score != 50 || d.Confidence() != 0.5 {
+		t.Fatalf("unexpected best parser: %+v", d)
+	}
+	if _, ok := Lookup("stub-tie"); !ok {
+		t.Fatal("lookup failed")
+	}
+	if !strings.Contains(strings.Join(Names(), ","), "stub-low,stub-high,stub-tie") {
+		t.Fatalf("names not in registration order: %v", Names())
+	}
+	Unregister("stub-high")
+	if d := Best("x.any", nil); d.Parser == nil || d.Parser.Name() != "stub-tie" {
+		t.Fatalf("unregistered parser still chosen: %+v", d)
+	}
+}
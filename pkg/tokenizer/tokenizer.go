@@ -0,0 +1,357 @@
+// Package tokenizer counts tokens exactly the way a model's byte-pair encoding does, so token
+// budgets fit the model's real limit. Vocabularies are read from local files in the tiktoken
+// format used by cl100k_base and o200k_base: one base64 token and its rank per line. Text is
+// split into pieces with the pattern of the matching encoding before merging. Nothing is
+// downloaded.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"contextsqueezer/pkg/api"
+)
+
+// cacheLimit bounds how many pre-tokenized pieces a BPE remembers the count of.
+const cacheLimit = 1 << 16
+
+// maxPiece caps the bytes merged at once. Longer pieces, such as a run of letters with no
+// spaces, are counted a slice at a time, so their count can differ slightly from the model's.
+const maxPiece = 1 << 12
+
+// BPE is a byte-level byte-pair encoding. Merge priority is the rank of the merged token, as
+// in tiktoken. It is safe for concurrent use.
+type BPE struct {
+	name  string
+	ranks map[string]int
+	// split returns the length of the first pre-token of its argument.
+	split func([]byte) int
+
+	mu    sync.Mutex
+	cache map[string]int
+}
+
+// Load reads a vocabulary file; its base name without extension becomes the tokenizer name.
+func Load(path string) (*BPE, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	bpe, err := Read(name, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return bpe, nil
+}
+
+// o200kSize is the vocabulary size above which a vocabulary is taken for the o200k family.
+const o200kSize = 150000
+
+// Read parses a vocabulary. Every single byte must have a rank, so any input can be encoded.
+// Vocabularies named o200k* or with more than 150,000 tokens are pre-tokenized with the
+// o200k_base pattern, all others with the cl100k_base one.
+func Read(name string, r io.Reader) (*BPE, error) {
+	ranks := map[string]int{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a base64 token and a rank", line)
+		}
+		tok, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(tok) == 0 {
+			return nil, fmt.Errorf("line %d: invalid token %q", line, fields[0])
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil || rank < 0 {
+			return nil, fmt.Errorf("line %d: invalid rank %q", line, fields[1])
+		}
+		ranks[string(tok)] = rank
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("vocabulary has no token for byte 0x%02x", b)
+		}
+	}
+	split := nextPiece
+	if strings.HasPrefix(name, "o200k") || len(ranks) > o200kSize {
+		split = nextPieceO200k
+	}
+	return &BPE{name: name, ranks: ranks, split: split, cache: map[string]int{}}, nil
+}
+
+func (t *BPE) Name() string { return t.name }
+
+// Count returns the number of tokens b encodes to.
+func (t *BPE) Count(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		piece := b[:t.split(b)]
+		b = b[len(piece):]
+		for len(piece) > maxPiece {
+			cut := maxPiece
+			for cut > 0 && !utf8.RuneStart(piece[cut]) {
+				cut--
+			}
+			n += t.countPiece(piece[:cut])
+			piece = piece[cut:]
+		}
+		n += t.countPiece(piece)
+	}
+	return n
+}
+
+func (t *BPE) countPiece(piece []byte) int {
+	if _, ok := t.ranks[string(piece)]; ok {
+		return 1
+	}
+	t.mu.Lock()
+	n, ok := t.cache[string(piece)]
+	t.mu.Unlock()
+	if ok {
+		return n
+	}
+	n = t.merge(piece)
+	t.mu.Lock()
+	if len(t.cache) >= cacheLimit {
+		clear(t.cache)
+	}
+	t.cache[string(piece)] = n
+	t.mu.Unlock()
+	return n
+}
+
+// merge splits piece into bytes and repeatedly joins the adjacent pair whose concatenation
+// has the lowest rank, the leftmost among equals, returning the number of resulting tokens.
+// Parts are a linked list over byte offsets and candidate pairs wait in a heap, where pairs
+// broken up by an earlier merge are skipped, so a piece of n bytes takes O(n log n).
+func (t *BPE) merge(piece []byte) int {
+	n := len(piece)
+	next := make([]int, n)
+	prev := make([]int, n)
+	for i := range next {
+		next[i], prev[i] = i+1, i-1
+	}
+	end := func(s int) int {
+		if next[s] >= n {
+			return n
+		}
+		return next[next[s]]
+	}
+	h := &pairHeap{}
+	push := func(s int) {
+		if s >= 0 && next[s] < n {
+			if r, ok := t.ranks[string(piece[s:end(s)])]; ok {
+				heap.Push(h, pair{rank: r, start: s, end: end(s)})
+			}
+		}
+	}
+	for s := 0; s < n; s++ {
+		push(s)
+	}
+	tokens := n
+	for h.Len() > 0 {
+		p := heap.Pop(h).(pair)
+		if prev[p.start] == -2 || next[p.start] >= n || end(p.start) != p.end {
+			continue
+		}
+		m := next[p.start]
+		next[p.start] = next[m]
+		if next[m] < n {
+			prev[next[m]] = p.start
+		}
+		prev[m] = -2
+		tokens--
+		push(prev[p.start])
+		push(p.start)
+	}
+	return tokens
+}
+
+// pair is two adjacent parts, piece[start:end], that merge into a token of rank.
+type pair struct{ rank, start, end int }
+
+type pairHeap []pair
+
+func (h pairHeap) Len() int { return len(h) }
+func (h pairHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].start < h[j].start
+}
+func (h pairHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x any)   { *h = append(*h, x.(pair)) }
+func (h *pairHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// nextPiece returns the length of the first pre-token of b, following the cl100k_base
+// pattern: contractions, letter runs with one leading non-letter, up to three digits,
+// punctuation runs with an optional leading space, newlines with their indentation, and
+// other whitespace, leaving one space to lead the next word.
+func nextPiece(b []byte) int {
+	r, n := utf8.DecodeRune(b)
+	if r == '\'' && len(b) > 1 {
+		for _, c := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(b) > len(c) && strings.EqualFold(string(b[1:1+len(c)]), c) {
+				return 1 + len(c)
+			}
+		}
+	}
+	if unicode.IsLetter(r) {
+		return n + runOf(b[n:], unicode.IsLetter, -1)
+	}
+	if r != '\r' && r != '\n' && !unicode.IsNumber(r) {
+		if m := runOf(b[n:], unicode.IsLetter, -1); m > 0 {
+			return n + m
+		}
+	}
+	if unicode.IsNumber(r) {
+		return n + runOf(b[n:], unicode.IsNumber, 2)
+	}
+	punct := func(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+	start := 0
+	if r == ' ' {
+		start = n
+	}
+	if m := runOf(b[start:], punct, -1); m > 0 {
+		end := start + m
+		for end < len(b) && (b[end] == '\r' || b[end] == '\n') {
+			end++
+		}
+		return end
+	}
+	return spacePiece(b, n)
+}
+
+// spacePiece returns the length of the whitespace pre-token at the start of b, shared by both
+// patterns: up to the last newline with the indentation before it, else all but the last
+// space when a word follows, or n, the length of the first rune, when b has none.
+func spacePiece(b []byte, n int) int {
+	ws := runOf(b, unicode.IsSpace, -1)
+	if nl := bytes.LastIndexAny(b[:ws], "\r\n"); nl >= 0 {
+		return nl + 1
+	}
+	if ws < len(b) && ws > 1 {
+		_, last := utf8.DecodeLastRune(b[:ws])
+		return ws - last
+	}
+	return max(ws, n)
+}
+
+// nextPieceO200k returns the length of the first pre-token of b, following the o200k_base
+// pattern: words of upper-case letters then lower-case ones, so "HelloWorld" is two, each
+// with one leading non-letter and an optional contraction; up to three digits; punctuation
+// runs with an optional leading space and trailing newlines or slashes; and whitespace as in
+// nextPiece. Marks and letters without case count as both upper and lower case.
+func nextPieceO200k(b []byte) int {
+	r, n := utf8.DecodeRune(b)
+	starts := []int{0}
+	if r != '\r' && r != '\n' && !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+		starts = []int{n, 0}
+	}
+	// The lower-case run must not be empty, so it may take back the last upper-case rune
+	// that is also lower case; failing that, a word may end in upper case.
+	for _, s := range starts {
+		u := s + runOf(b[s:], isUpperO200k, -1)
+		if l := runOf(b[u:], isLowerO200k, -1); l > 0 {
+			return withContraction(b, u+l)
+		}
+		for j := u; j > s; {
+			r, size := utf8.DecodeLastRune(b[s:j])
+			if isLowerO200k(r) {
+				return withContraction(b, j)
+			}
+			j -= size
+		}
+	}
+	for _, s := range starts {
+		if u := runOf(b[s:], isUpperO200k, -1); u > 0 {
+			return withContraction(b, s+u+runOf(b[s+u:], isLowerO200k, -1))
+		}
+	}
+	if unicode.IsNumber(r) {
+		return n + runOf(b[n:], unicode.IsNumber, 2)
+	}
+	punct := func(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+	start := 0
+	if r == ' ' {
+		start = n
+	}
+	if m := runOf(b[start:], punct, -1); m > 0 {
+		end := start + m
+		for end < len(b) && (b[end] == '\r' || b[end] == '\n' || b[end] == '/') {
+			end++
+		}
+		return end
+	}
+	return spacePiece(b, n)
+}
+
+func isUpperO200k(r rune) bool {
+	return unicode.In(r, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+func isLowerO200k(r rune) bool {
+	return unicode.In(r, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// withContraction extends a word ending at end over a following 's, 't, 're, 've, 'm, 'll
+// or 'd, in any case.
+func withContraction(b []byte, end int) int {
+	if end < len(b) && b[end] == '\'' {
+		for _, c := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(b) > end+len(c) && strings.EqualFold(string(b[end+1:end+1+len(c)]), c) {
+				return end + 1 + len(c)
+			}
+		}
+	}
+	return end
+}
+
+// runOf returns the length in bytes of the leading runes of b that satisfy f, at most limit
+// runes when limit is positive.
+func runOf(b []byte, f func(rune) bool, limit int) int {
+	i := 0
+	for count := 0; i < len(b) && count != limit; count++ {
+		r, n := utf8.DecodeRune(b[i:])
+		if !f(r) {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// Open returns the tokenizer named by spec: "approx" (or "") for api.ApproxTokenizer, or the
+// path of a vocabulary file.
+func Open(spec string) (api.Tokenizer, error) {
+	if spec == "" || spec == "approx" {
+		return api.ApproxTokenizer(), nil
+	}
+	return Load(spec)
+}
@@ -0,0 +1,93 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vocab writes every byte plus the given merges, ranked in order, in the tiktoken format.
+func vocab(t *testing.T, merges ...string) string {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, m := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(m)), 256+i)
+	}
+	path := filepath.Join(t.TempDir(), "tiny.tiktoken")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func pieces(in string, split func([]byte) int) []string {
+	var got []string
+	for b := []byte(in); len(b) > 0; {
+		n := split(b)
+		got = append(got, string(b[:n]))
+		b = b[n:]
+	}
+	return got
+}
+
+func TestPreTokenize(t *testing.T) {
+	got := pieces("Hello, world!\n\n  x 123456 don't", nextPiece)
+	want := []string{"Hello", ",", " world", "!\n\n", " ", " x", " ", "123", "456", " don", "'t"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("pieces %q, want %q", got, want)
+	}
+	got = pieces("HelloWorld ABC's don't 12345 x!!/\n\n  y", nextPieceO200k)
+	want = []string{"Hello", "World", " ABC's", " don't", " ", "123", "45", " x", "!!/\n\n", " ", " y"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("o200k pieces %q, want %q", got, want)
+	}
+	path := vocab(t)
+	tiny, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	o200k, err := Read("o200k_base", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pieces("HelloWorld", tiny.split)) != 1 || len(pieces("HelloWorld", o200k.split)) != 2 {
+		t.Fatal("pre-tokenizer not chosen by vocabulary name")
+	}
+}
+
+func TestBPECount(t *testing.T) {
+	tok, err := Open(vocab(t, "th", "the", " c", " ca", "at"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Name() != "tiny" {
+		t.Fatalf("unexpected name %q", tok.Name())
+	}
+	for in, want := range map[string]int{"the cat": 3, "the": 1, "": 0, "xyz": 3, "the the": 3} {
+		if got := tok.Count([]byte(in)); got != want {
+			t.Fatalf("Count(%q) = %d, want %d", in, got, want)
+		}
+	}
+	long := strings.Repeat("éx", 2*maxPiece)
+	if got := tok.Count([]byte(long)); got != len(long) {
+		t.Fatalf("Count of a %d-byte piece = %d", len(long), got)
+	}
+	if _, err := Read("bad", strings.NewReader("YQ== 0\n")); err == nil {
+		t.Fatal("expected error for a vocabulary missing bytes")
+	}
+	if tok, _ := Open("approx"); tok.Count([]byte("four word long text")) != 9 {
+		t.Fatal("approx tokenizer does not match the pipeline estimate")
+	}
+}
@@ -35,7 +35,7 @@ CSQ_JSON_PATH="${TMPDIR_CSQ}/out.json" python - <<'PY'
 import json, os
 from pathlib import Path
 obj=json.loads(Path(os.environ["CSQ_JSON_PATH"]).read_text())
-required=["schema_version","engine_version","build","bytes_in","bytes_out","tokens_in_approx","tokens_out_approx","reduction_pct","aggressiveness","profile","budget_applied","truncated","source_type","warnings"]
+required=["schema_version","engine_version","build","bytes_in","bytes_out","tokens_in","tokens_out","tokens_in_approx","tokens_out_approx","reduction_pct","aggressiveness","profile","budget_applied","truncated","source_type","warnings"]
 for k in required:
     assert k in obj, f"missing {k}"
 assert obj["schema_version"] == 1